@@ -0,0 +1,258 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SharkFourSix/go-transact/messaging"
+	"github.com/SharkFourSix/go-transact/persistence"
+	"github.com/SharkFourSix/go-transact/reconciliation"
+	"github.com/SharkFourSix/go-transact/reference"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+const (
+	// Same header the callback is signed with
+	TOKEN_HEADER     = "X-Go-Transact-Token"
+	MAX_REQUEST_SIZE = 64 * 1024
+	REQUEST_TIMEOUT  = 30 * time.Second
+
+	EXPECTED_PAYMENTS_PATH = "/expected-payments"
+	REFERENCES_PATH        = "/references"
+	// JSON Schema of the callback envelope. Public
+	CALLBACK_SCHEMA_PATH = "/schemas/callback.v1.schema.json"
+	// Most references issued by a single request
+	MAX_REFERENCES = 100
+)
+
+// HTTP API used by the vendor's backend. Every request must carry Token, see utils.RequestToken
+type Server struct {
+	Address string
+	Token   string
+	// Issues the references returned by POST /references
+	References *reference.Generator
+
+	server *http.Server
+}
+
+// Handler Returns the routes of the API, without starting a server
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(EXPECTED_PAYMENTS_PATH, s.authorized(s.expectedPayments))
+	mux.HandleFunc(EXPECTED_PAYMENTS_PATH+"/", s.authorized(s.expectedPayment))
+	mux.HandleFunc(REFERENCES_PATH, s.authorized(s.references))
+	mux.HandleFunc(CALLBACK_SCHEMA_PATH, s.callbackSchema)
+	return mux
+}
+
+// Start Serves the API until it is shut down
+func (s *Server) Start() error {
+	s.server = &http.Server{
+		Addr:         s.Address,
+		Handler:      s.Handler(),
+		ReadTimeout:  REQUEST_TIMEOUT,
+		WriteTimeout: REQUEST_TIMEOUT,
+	}
+	log.Infof("serving API on http://%s", s.Address)
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown Stops accepting requests and waits for requests in progress
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
+}
+
+func (s *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !utils.TokenMatches(utils.RequestToken(r, TOKEN_HEADER), s.Token) {
+			log.Warnf("%s: API request rejected, invalid token", r.RemoteAddr)
+			reply(rw, http.StatusUnauthorized, errorBody("invalid token"))
+			return
+		}
+		handler(rw, r)
+	}
+}
+
+func reply(rw http.ResponseWriter, status int, body interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if body != nil {
+		json.NewEncoder(rw).Encode(body)
+	}
+}
+
+func errorBody(format string, args ...interface{}) map[string]string {
+	return map[string]string{"error": fmt.Sprintf(format, args...)}
+}
+
+func methodNotAllowed(rw http.ResponseWriter, allowed ...string) {
+	rw.Header().Set("Allow", strings.Join(allowed, ", "))
+	reply(rw, http.StatusMethodNotAllowed, errorBody("method not allowed"))
+}
+
+func decode(rw http.ResponseWriter, r *http.Request, body interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(rw, r.Body, MAX_REQUEST_SIZE))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(body); err != nil {
+		reply(rw, http.StatusBadRequest, errorBody("invalid request body. %s", err.Error()))
+		return false
+	}
+	return true
+}
+
+type expectedPaymentRequest struct {
+	VendorReferenceId string `json:"vendorReferenceId"`
+	// Plain decimal or as written by the bank, i.e, 5,000.00
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+	// RFC 3339 time after which payments are flagged as expired
+	ExpiresAt *time.Time `json:"expiresAt"`
+	// Alternative to ExpiresAt relative to now, i.e, 72h
+	ExpiresIn string `json:"expiresIn"`
+}
+
+// GET lists expected payments, optionally filtered with ?status=. POST registers one
+func (s *Server) expectedPayments(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		payments, err := reconciliation.List(r.URL.Query().Get("status"))
+		if err != nil {
+			log.Errorf("failed to list expected payments. %s", err.Error())
+			reply(rw, http.StatusInternalServerError, errorBody("failed to list expected payments"))
+			return
+		}
+		if payments == nil {
+			payments = []reconciliation.ExpectedPayment{}
+		}
+		reply(rw, http.StatusOK, payments)
+	case http.MethodPost:
+		var request expectedPaymentRequest
+		if !decode(rw, r, &request) {
+			return
+		}
+		payment := &reconciliation.ExpectedPayment{
+			VendorReferenceId: request.VendorReferenceId,
+			Amount:            request.Amount,
+			Currency:          request.Currency,
+			ExpiresAt:         request.ExpiresAt,
+		}
+		if !utils.IsStringEmpty(request.ExpiresIn) {
+			expiresIn, err := time.ParseDuration(request.ExpiresIn)
+			if err != nil || expiresIn <= 0 {
+				reply(rw, http.StatusBadRequest, errorBody("invalid expiresIn '%s'", request.ExpiresIn))
+				return
+			}
+			expiresAt := time.Now().Add(expiresIn)
+			payment.ExpiresAt = &expiresAt
+		}
+		if err := reconciliation.Register(payment); err != nil {
+			if errors.Is(err, reconciliation.ErrDuplicateReference) {
+				reply(rw, http.StatusConflict, errorBody(err.Error()))
+			} else {
+				reply(rw, http.StatusBadRequest, errorBody(err.Error()))
+			}
+			return
+		}
+		reply(rw, http.StatusCreated, payment)
+	default:
+		methodNotAllowed(rw, http.MethodGet, http.MethodPost)
+	}
+}
+
+// GET returns the payment expected with the reference in the path, DELETE cancels it
+func (s *Server) expectedPayment(rw http.ResponseWriter, r *http.Request) {
+	reference := strings.TrimPrefix(r.URL.Path, EXPECTED_PAYMENTS_PATH+"/")
+	if utils.IsStringEmpty(reference) || strings.Contains(reference, "/") {
+		reply(rw, http.StatusNotFound, errorBody("not found"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		payment, err := reconciliation.Get(reference)
+		if persistence.IsNotFound(err) {
+			reply(rw, http.StatusNotFound, errorBody("no payment is expected with vendor reference %s", reference))
+			return
+		}
+		if err != nil {
+			log.Errorf("failed to look up expected payment %s. %s", reference, err.Error())
+			reply(rw, http.StatusInternalServerError, errorBody("failed to look up expected payment"))
+			return
+		}
+		reply(rw, http.StatusOK, payment)
+	case http.MethodDelete:
+		deleted, err := reconciliation.Cancel(reference)
+		if err != nil {
+			log.Errorf("failed to cancel expected payment %s. %s", reference, err.Error())
+			reply(rw, http.StatusInternalServerError, errorBody("failed to cancel expected payment"))
+			return
+		}
+		if !deleted {
+			reply(rw, http.StatusNotFound, errorBody("no payment is expected with vendor reference %s", reference))
+			return
+		}
+		reply(rw, http.StatusNoContent, nil)
+	default:
+		methodNotAllowed(rw, http.MethodGet, http.MethodDelete)
+	}
+}
+
+type referencesRequest struct {
+	// Number of references to issue. Default = 1
+	Count int `json:"count"`
+}
+
+// POST issues new vendor references. The body is optional
+func (s *Server) references(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(rw, http.MethodPost)
+		return
+	}
+	request := referencesRequest{Count: 1}
+	if r.ContentLength != 0 && !decode(rw, r, &request) {
+		return
+	}
+	if request.Count < 1 || request.Count > MAX_REFERENCES {
+		reply(rw, http.StatusBadRequest, errorBody("count must be between 1 and %d", MAX_REFERENCES))
+		return
+	}
+
+	generator := s.References
+	if generator == nil {
+		generator = &reference.Generator{}
+	}
+	references := make([]string, 0, request.Count)
+	for len(references) < request.Count {
+		generated, err := generator.Generate()
+		if err != nil {
+			log.Errorf("failed to generate reference. %s", err.Error())
+			reply(rw, http.StatusInternalServerError, errorBody("failed to generate reference"))
+			return
+		}
+		references = append(references, generated)
+	}
+	reply(rw, http.StatusCreated, map[string][]string{"references": references})
+}
+
+// GET returns the JSON Schema of the callback envelope
+func (s *Server) callbackSchema(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(rw, http.MethodGet)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/schema+json")
+	rw.Write(messaging.Schema)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/twinj/uuid"
+
+	"github.com/SharkFourSix/go-transact/persistence"
+	"github.com/SharkFourSix/go-transact/reconciliation"
+	"github.com/SharkFourSix/go-transact/reference"
+)
+
+func TestExpectedPayments(t *testing.T) {
+	if err := persistence.Initialize(5000); err != nil {
+		t.Fatal(err)
+	}
+	defer persistence.Cleanup()
+	if err := persistence.Migrate(&reconciliation.ExpectedPayment{}, &reconciliation.ReceivedTotal{}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := (&Server{Token: "secret"}).Handler()
+	request := func(method string, target string, body string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set(TOKEN_HEADER, token)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw
+	}
+
+	reference := uuid.NewV4().String()
+	payment := `{"vendorReferenceId": "` + reference + `", "amount": "5,000.00", "currency": "MWK", "expiresIn": "72h"}`
+
+	if rw := request(http.MethodPost, EXPECTED_PAYMENTS_PATH, payment, ""); rw.Code != http.StatusUnauthorized {
+		t.Errorf("missing token: got %d", rw.Code)
+	}
+	if rw := request(http.MethodPost, EXPECTED_PAYMENTS_PATH, `{"amount": "5000"}`, "secret"); rw.Code != http.StatusBadRequest {
+		t.Errorf("missing reference: got %d", rw.Code)
+	}
+
+	rw := request(http.MethodPost, EXPECTED_PAYMENTS_PATH, payment, "secret")
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("register: got %d %s", rw.Code, rw.Body.String())
+	}
+	var created reconciliation.ExpectedPayment
+	if err := json.Unmarshal(rw.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Amount != "5000.00" || created.Status != reconciliation.STATUS_PENDING || created.ExpiresAt == nil {
+		t.Errorf("unexpected payment %s", rw.Body.String())
+	}
+
+	if rw := request(http.MethodPost, EXPECTED_PAYMENTS_PATH, payment, "secret"); rw.Code != http.StatusConflict {
+		t.Errorf("duplicate: got %d", rw.Code)
+	}
+	if rw := request(http.MethodGet, EXPECTED_PAYMENTS_PATH+"/"+strings.ToUpper(reference), "", "secret"); rw.Code != http.StatusOK {
+		t.Errorf("get: got %d", rw.Code)
+	}
+	if rw := request(http.MethodGet, EXPECTED_PAYMENTS_PATH+"?status=pending", "", "secret"); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), reference) {
+		t.Errorf("list: got %d %s", rw.Code, rw.Body.String())
+	}
+	if rw := request(http.MethodDelete, EXPECTED_PAYMENTS_PATH+"/"+reference, "", "secret"); rw.Code != http.StatusNoContent {
+		t.Errorf("delete: got %d", rw.Code)
+	}
+	if rw := request(http.MethodGet, EXPECTED_PAYMENTS_PATH+"/"+reference, "", "secret"); rw.Code != http.StatusNotFound {
+		t.Errorf("get deleted: got %d", rw.Code)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	generator := &reference.Generator{Prefix: "INV-", Length: 6, CheckDigit: reference.CHECK_DIGIT_LUHN}
+	handler := (&Server{Token: "secret", References: generator}).Handler()
+	request := func(method string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, REFERENCES_PATH, strings.NewReader(body))
+		r.Header.Set(TOKEN_HEADER, "secret")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw
+	}
+
+	var response struct {
+		References []string `json:"references"`
+	}
+	rw := request(http.MethodPost, "")
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("generate: got %d %s", rw.Code, rw.Body.String())
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.References) != 1 || !generator.Valid(response.References[0]) {
+		t.Errorf("unexpected references %v", response.References)
+	}
+
+	rw = request(http.MethodPost, `{"count": 5}`)
+	if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.References) != 5 {
+		t.Errorf("expected 5 references, got %v", response.References)
+	}
+
+	if rw := request(http.MethodPost, `{"count": 1000}`); rw.Code != http.StatusBadRequest {
+		t.Errorf("too many references: got %d", rw.Code)
+	}
+	if rw := request(http.MethodGet, ""); rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("get: got %d", rw.Code)
+	}
+}
@@ -7,11 +7,16 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/natefinch/lumberjack"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/SharkFourSix/go-transact/mailing"
+	"github.com/SharkFourSix/go-transact/messaging"
+	"github.com/SharkFourSix/go-transact/reference"
+	"github.com/SharkFourSix/go-transact/sms"
 	"github.com/SharkFourSix/go-transact/transaction"
 	"github.com/SharkFourSix/go-transact/utils"
 	"gopkg.in/yaml.v3"
@@ -22,14 +27,72 @@ type Config struct {
 	Callback  struct {
 		ForwardURL   string `yaml:"url"`
 		ForwardToken string `yaml:"token"`
+		// messaging.FORMAT_LEGACY (default), messaging.FORMAT_ENVELOPE or messaging.FORMAT_CLOUDEVENTS
+		Format string `yaml:"format"`
+		// messaging.CLOUDEVENTS_STRUCTURED (default) or messaging.CLOUDEVENTS_BINARY
+		CloudEventsMode string `yaml:"cloudEventsMode"`
+		// Body, content type and headers of transaction callbacks. Replaces Format when set
+		Payload *messaging.PayloadTemplate `yaml:"payload"`
+		// Timeout, concurrency limit and circuit breaker of the callback url
+		messaging.EndpointOptions `yaml:",inline"`
 	}
-	Server struct {
-		Address         string   `yaml:"address"`
-		UseTls          bool     `yaml:"useTls"`
-		CertificateFile string   `yaml:"certFile"`
-		KeyFile         string   `yaml:"keyFile"`
-		KeyPassphrase   string   `yaml:"keyPassphrase"`
-		Mailboxes       []string `yaml:"mailboxes"`
+	// Mailboxes to fetch mail from, in addition to or instead of the SMTP daemon
+	Imap []ImapSource `yaml:"imap"`
+	// HTTP endpoint receiving SMS alerts from SMS forwarder apps
+	Sms struct {
+		Enabled bool   `yaml:"enabled"`
+		Address string `yaml:"address"`
+		Path    string `yaml:"path"`
+		Token   string `yaml:"token"`
+	} `yaml:"sms"`
+	// HTTP API used by the vendor's backend, i.e, to register expected payments
+	Api struct {
+		Enabled bool   `yaml:"enabled"`
+		Address string `yaml:"address"`
+		Token   string `yaml:"token"`
+	} `yaml:"api"`
+	// Matching of transactions against the expected payments registered through the API
+	Reconciliation struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"reconciliation"`
+	// Vendor references issued through the API. Vendor references in transactions are checked and corrected against them
+	References reference.Generator `yaml:"references"`
+	Server     struct {
+		// Do not run the SMTP daemon, i.e, when all mail is fetched over IMAP
+		Disabled bool `yaml:"disabled"`
+		// Settings of the default listener, used when no listeners are defined.
+		// Mailboxes lists every mailbox accepted by the daemon
+		Listener  `yaml:",inline"`
+		Listeners []Listener `yaml:"listeners"`
+		// Domains accepted by the daemon, i.e, go-transact.tld or *.go-transact.tld. Empty = any domain
+		Domains []string `yaml:"domains"`
+		// Where the original sender of forwarded mail is taken from
+		SenderResolution struct {
+			Sources           []string `yaml:"sources"`
+			TrustedArcSealers []string `yaml:"trustedArcSealers"`
+		} `yaml:"senderResolution"`
+		Verification struct {
+			Enabled   bool   `yaml:"enabled"`
+			DnsServer string `yaml:"dnsServer"`
+		} `yaml:"verification"`
+		// Where accepted mail is stored before it is acknowledged, see SPOOL_*
+		Spool struct {
+			Type      string `yaml:"type"`
+			Directory string `yaml:"directory"`
+		} `yaml:"spool"`
+		// Processing of accepted mail
+		Workers struct {
+			Count     int `yaml:"count"`
+			QueueSize int `yaml:"queueSize"`
+			// How long to wait for queued mail to be processed on shutdown
+			ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+		} `yaml:"workers"`
+		// Shared by all listeners. Zero disables a limit
+		Limits struct {
+			mailing.Limits `yaml:",inline"`
+			// Maximum number of spam mails kept in the database. Further spam is dropped
+			SpamQuota int `yaml:"spamQuota"`
+		} `yaml:"limits"`
 	}
 	Log struct {
 		LogLevel   string `yaml:"level"`
@@ -38,8 +101,71 @@ type Config struct {
 	}
 }
 
+// One SMTP listener and the settings that apply to connections it accepts
+type Listener struct {
+	Name string `yaml:"name"`
+	// smtp or lmtp, see mailing.Protocols
+	Protocol string `yaml:"protocol"`
+	// tcp or unix. Unix sockets are only supported by lmtp listeners, the address is then the socket path
+	Network            string   `yaml:"network"`
+	Address            string   `yaml:"address"`
+	UseTls             bool     `yaml:"useTls"`
+	TlsPolicy          string   `yaml:"tlsPolicy"`
+	ImplicitTlsAddress string   `yaml:"implicitTlsAddress"`
+	ImplicitTls        bool     `yaml:"implicitTls"`
+	TlsMinVersion      string   `yaml:"tlsMinVersion"`
+	TlsCipherSuites    []string `yaml:"tlsCipherSuites"`
+	CertificateFile    string   `yaml:"certFile"`
+	KeyFile            string   `yaml:"keyFile"`
+	KeyPassphrase      string   `yaml:"keyPassphrase"`
+	Mailboxes          []string `yaml:"mailboxes"`
+	AllowedNetworks    []string `yaml:"allowedNetworks"`
+	Auth               struct {
+		Mechanisms    []string             `yaml:"mechanisms"`
+		Required      bool                 `yaml:"required"`
+		AllowInsecure bool                 `yaml:"allowInsecure"`
+		Credentials   []mailing.Credential `yaml:"credentials"`
+	} `yaml:"auth"`
+}
+
+// An IMAP folder polled for new mail
+type ImapSource struct {
+	Name    string `yaml:"name"`
+	Address string `yaml:"address"`
+	Tls     bool   `yaml:"tls"`
+	// Log in without TLS when the server does not offer STARTTLS
+	Insecure bool   `yaml:"insecure"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Folder   string `yaml:"folder"`
+	// flag or move, see mailing.IMAPActions
+	ProcessedAction string        `yaml:"processedAction"`
+	ProcessedFolder string        `yaml:"processedFolder"`
+	PollInterval    time.Duration `yaml:"pollInterval"`
+	Idle            bool          `yaml:"idle"`
+}
+
+const (
+	DEFAULT_LISTENER_NAME = "default"
+
+	// Mail is acknowledged before it is stored
+	SPOOL_NONE = "none"
+	// Mail is stored in the database before it is acknowledged
+	SPOOL_DATABASE = "database"
+	// Mail is stored as files in spool.directory before it is acknowledged
+	SPOOL_DIRECTORY = "directory"
+)
+
+var SpoolTypes = []string{SPOOL_NONE, SPOOL_DATABASE, SPOOL_DIRECTORY}
+
 var configuration Config
 
+// Compiled from configuration.Callback.Payload when the configuration is loaded
+var callbackPayload *messaging.Payload
+
+// Compiled from the allowedNetworks of configuration.Templates, by index, when the configuration is loaded
+var templateAllowlists []*mailing.Allowlist
+
 func (c *Config) parse(data []byte) error {
 	return yaml.Unmarshal(data, c)
 }
@@ -104,6 +230,24 @@ func LoadConfigs(file string, verbosity bool) error {
 		return fmt.Errorf("error parsing configuration file %s. %s", file, err.Error())
 	}
 
+	if errs := configuration.Validate(); errs != nil {
+		return fmt.Errorf("invalid configuration file %s.\n%s", file, errs.Error())
+	}
+
+	callbackPayload = nil
+	if payload := configuration.Callback.Payload; payload != nil {
+		if callbackPayload, err = payload.Compile(); err != nil {
+			return fmt.Errorf("invalid callback payload. %s", err.Error())
+		}
+	}
+
+	templateAllowlists = make([]*mailing.Allowlist, len(configuration.Templates))
+	for i, tpl := range configuration.Templates {
+		if templateAllowlists[i], err = mailing.NewAllowlist(tpl.AllowedNetworks); err != nil {
+			return fmt.Errorf("invalid templates[%d].allowedNetworks. %s", i, err.Error())
+		}
+	}
+
 	if err := configuration.prepareLogger(); err != nil {
 		return err
 	}
@@ -115,24 +259,88 @@ func GetTemplates() []transaction.TransactionTemplate {
 	return configuration.Templates
 }
 
+// GetListeners Returns the configured listeners, or the default listener if none are defined
+func (cfg *Config) GetListeners() []Listener {
+	if len(cfg.Server.Listeners) > 0 {
+		return cfg.Server.Listeners
+	}
+	listener := cfg.Server.Listener
+	if utils.IsStringEmpty(listener.Name) {
+		listener.Name = DEFAULT_LISTENER_NAME
+	}
+	// The top level mailboxes apply to the whole daemon, not just this listener
+	listener.Mailboxes = nil
+	return []Listener{listener}
+}
+
+func GetListeners() []Listener {
+	return configuration.GetListeners()
+}
+
 func GetConfiguration() Config {
 	return configuration
 }
 
+// GetCallbackPayload Returns the compiled callback.payload, or nil if none is configured
+func GetCallbackPayload() *messaging.Payload {
+	return callbackPayload
+}
+
 func GetTemplateByEmail(email string) *transaction.TransactionTemplate {
 	for _, tpl := range configuration.Templates {
-		if strings.EqualFold(tpl.Email, email) {
+		if !utils.IsStringEmpty(tpl.Email) && strings.EqualFold(tpl.Email, email) {
+			return &tpl
+		}
+	}
+	return nil
+}
+
+// GetTemplateBySmsSender Returns the template matching an SMS sender ID, or nil
+func GetTemplateBySmsSender(sender string) *transaction.TransactionTemplate {
+	for _, tpl := range configuration.Templates {
+		if !utils.IsStringEmpty(tpl.SmsSender) && sms.SenderMatches(tpl.SmsSender, sender) {
 			return &tpl
 		}
 	}
 	return nil
 }
 
-func MailBoxExists(mailbox string) bool {
-	for _, mb := range configuration.Server.Mailboxes {
-		if strings.EqualFold(mb, mailbox) {
-			return true
+// GetTemplateForMail Returns the template for mail from the sender to the recipients and the networks allowed to relay
+// its mail, or nil. Templates bound to one of the recipients' mailboxes are preferred over templates accepting any
+// mailbox.
+func GetTemplateForMail(email string, recipients []string) (*transaction.TransactionTemplate, *mailing.Allowlist) {
+	fallback := -1
+	found := func(i int) (*transaction.TransactionTemplate, *mailing.Allowlist) {
+		tpl := configuration.Templates[i]
+		return &tpl, templateAllowlists[i]
+	}
+	for i, tpl := range configuration.Templates {
+		if utils.IsStringEmpty(tpl.Email) || !strings.EqualFold(tpl.Email, email) {
+			continue
+		}
+		if len(tpl.Mailboxes) == 0 {
+			if fallback < 0 {
+				fallback = i
+			}
+			continue
 		}
+		for _, recipient := range recipients {
+			if mailing.MatchAnyMailbox(tpl.Mailboxes, recipient) {
+				return found(i)
+			}
+		}
+	}
+	if fallback < 0 {
+		return nil, nil
+	}
+	return found(fallback)
+}
+
+// MailBoxExists Checks a recipient address against server.domains and server.mailboxes
+func MailBoxExists(address string) bool {
+	domains := configuration.Server.Domains
+	if len(domains) > 0 && !mailing.MatchAnyDomain(domains, address) {
+		return false
 	}
-	return false
+	return mailing.MatchAnyMailbox(configuration.Server.Mailboxes, address)
 }
@@ -0,0 +1,588 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	regexp "github.com/dlclark/regexp2"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/SharkFourSix/go-transact/mailing"
+	"github.com/SharkFourSix/go-transact/messaging"
+	"github.com/SharkFourSix/go-transact/sms"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+// A single problem found in the configuration. Field is the yaml path of the offending value,
+// i.e, templates[0].amountPattern
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// All problems found in the configuration, in the order they were found
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type validator struct {
+	errors ValidationErrors
+}
+
+func (v *validator) fail(field string, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) required(field string, value string) bool {
+	if utils.IsStringEmpty(strings.TrimSpace(value)) {
+		v.fail(field, "value is required")
+		return false
+	}
+	return true
+}
+
+func (v *validator) fileExists(field string, file string) {
+	if v.required(field, file) && !utils.FileExists(file) {
+		v.fail(field, "file '%s' does not exist", file)
+	}
+}
+
+// Checks that the pattern compiles the same way the transaction parser compiles it
+// and that it declares the named group the parser will look for.
+func (v *validator) pattern(field string, pattern string, group string, required bool) {
+	if utils.IsStringEmpty(pattern) {
+		if required {
+			v.fail(field, "value is required")
+		}
+		return
+	}
+	re, err := regexp.Compile(pattern, regexp.Multiline|regexp.RE2)
+	if err != nil {
+		v.fail(field, "invalid pattern. %s", err.Error())
+		return
+	}
+	for _, name := range re.GetGroupNames() {
+		if name == group {
+			return
+		}
+	}
+	v.fail(field, "pattern must declare the named group (?P<%s>...)", group)
+}
+
+func (v *validator) networks(field string, networks []string) {
+	for i, network := range networks {
+		if _, err := mailing.ParseNetwork(network); err != nil {
+			v.fail(fmt.Sprintf("%s[%d]", field, i), err.Error())
+		}
+	}
+}
+
+// Checks that a mailbox restricting a listener, credential or template is accepted by the daemon
+func (v *validator) knownMailbox(field string, mailbox string, mailboxes map[string]int) {
+	if err := mailing.ValidateMailboxPattern(mailbox); err != nil {
+		v.fail(field, err.Error())
+		return
+	}
+	if _, ok := mailboxes[strings.ToLower(mailbox)]; ok {
+		return
+	}
+	if !mailing.IsMailboxPattern(mailbox) {
+		for pattern := range mailboxes {
+			// A mailbox without a domain only has to match the local part
+			if !strings.Contains(mailbox, "@") {
+				pattern = strings.Split(pattern, "@")[0]
+			}
+			if mailing.MatchMailbox(pattern, mailbox) {
+				return
+			}
+		}
+	}
+	v.fail(field, "mailbox '%s' is not listed in server.mailboxes", mailbox)
+}
+
+func (v *validator) tls(prefix string, l *Listener) {
+	policy := strings.ToLower(l.TlsPolicy)
+	switch policy {
+	case "":
+		policy = mailing.TLS_POLICY_NONE
+		if l.UseTls {
+			policy = mailing.TLS_POLICY_OPTIONAL
+		}
+	case mailing.TLS_POLICY_NONE, mailing.TLS_POLICY_OPTIONAL, mailing.TLS_POLICY_REQUIRED:
+	default:
+		v.fail(prefix+".tlsPolicy", "unsupported policy '%s'. Supported: %s", l.TlsPolicy, strings.Join(mailing.TLSPolicies, ", "))
+	}
+
+	if implicit := l.ImplicitTlsAddress; !utils.IsStringEmpty(implicit) {
+		if _, _, err := net.SplitHostPort(implicit); err != nil {
+			v.fail(prefix+".implicitTlsAddress", "invalid address '%s'. %s", implicit, err.Error())
+		}
+	}
+
+	if policy != mailing.TLS_POLICY_NONE || l.ImplicitTls || !utils.IsStringEmpty(l.ImplicitTlsAddress) {
+		v.fileExists(prefix+".certFile", l.CertificateFile)
+		v.fileExists(prefix+".keyFile", l.KeyFile)
+	}
+
+	if _, err := utils.ParseTLSVersion(l.TlsMinVersion); err != nil {
+		v.fail(prefix+".tlsMinVersion", err.Error())
+	}
+	for i, suite := range l.TlsCipherSuites {
+		if _, err := mailing.ParseCipherSuites([]string{suite}); err != nil {
+			v.fail(fmt.Sprintf("%s.tlsCipherSuites[%d]", prefix, i), err.Error())
+		}
+	}
+}
+
+func (v *validator) auth(prefix string, l *Listener, mailboxes map[string]int) {
+	auth := l.Auth
+	mechanisms := map[string]bool{}
+	for i, mechanism := range auth.Mechanisms {
+		field := fmt.Sprintf("%s.auth.mechanisms[%d]", prefix, i)
+		supported := false
+		for _, m := range mailing.AuthMechanisms {
+			supported = supported || strings.EqualFold(m, mechanism)
+		}
+		if !supported {
+			v.fail(field, "unsupported mechanism '%s'. Supported: %s", mechanism, strings.Join(mailing.AuthMechanisms, ", "))
+			continue
+		}
+		mechanisms[strings.ToUpper(mechanism)] = true
+	}
+
+	if auth.Required && len(mechanisms) == 0 {
+		v.fail(prefix+".auth.required", "authentication is required but no mechanisms are enabled")
+	}
+	if len(mechanisms) > 0 && len(auth.Credentials) == 0 {
+		v.fail(prefix+".auth.credentials", "at least one credential is required when authentication is enabled")
+	}
+
+	usernames := map[string]int{}
+	for i, credential := range auth.Credentials {
+		field := fmt.Sprintf("%s.auth.credentials[%d]", prefix, i)
+		if v.required(field+".username", credential.Username) {
+			if first, ok := usernames[credential.Username]; ok {
+				v.fail(field+".username", "duplicate of %s.auth.credentials[%d].username", prefix, first)
+			} else {
+				usernames[credential.Username] = i
+			}
+		}
+		if mechanisms[mailing.AUTH_PLAIN] || mechanisms[mailing.AUTH_LOGIN] {
+			if v.required(field+".passwordHash", credential.PasswordHash) {
+				if _, err := bcrypt.Cost([]byte(credential.PasswordHash)); err != nil {
+					v.fail(field+".passwordHash", "not a bcrypt hash. %s", err.Error())
+				}
+			}
+		}
+		if mechanisms[mailing.AUTH_CRAM_MD5] {
+			v.required(field+".secret", credential.Secret)
+		}
+		for j, mailbox := range credential.Mailboxes {
+			v.knownMailbox(fmt.Sprintf("%s.mailboxes[%d]", field, j), mailbox, mailboxes)
+		}
+	}
+}
+
+func (v *validator) listener(prefix string, l *Listener, mailboxes map[string]int) {
+	lmtp := false
+	switch strings.ToLower(l.Protocol) {
+	case "", mailing.PROTOCOL_SMTP:
+	case mailing.PROTOCOL_LMTP:
+		lmtp = true
+	default:
+		v.fail(prefix+".protocol", "unsupported protocol '%s'. Supported: %s", l.Protocol, strings.Join(mailing.Protocols, ", "))
+	}
+
+	unix := false
+	switch strings.ToLower(l.Network) {
+	case "", mailing.NETWORK_TCP:
+	case mailing.NETWORK_UNIX:
+		unix = true
+		if !lmtp {
+			v.fail(prefix+".network", "unix sockets are only supported by %s listeners", mailing.PROTOCOL_LMTP)
+		}
+		if len(l.AllowedNetworks) > 0 {
+			v.fail(prefix+".allowedNetworks", "not supported on unix sockets, use file permissions instead")
+		}
+	default:
+		v.fail(prefix+".network", "unsupported network '%s'. Supported: %s, %s", l.Network, mailing.NETWORK_TCP, mailing.NETWORK_UNIX)
+	}
+
+	if !utils.IsStringEmpty(l.Address) && !unix {
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			v.fail(prefix+".address", "invalid address '%s'. %s", l.Address, err.Error())
+		}
+	}
+	v.networks(prefix+".allowedNetworks", l.AllowedNetworks)
+
+	if lmtp {
+		// LMTP is spoken by a local, trusted MTA
+		if l.UseTls || !utils.IsStringEmpty(l.TlsPolicy) || l.ImplicitTls || !utils.IsStringEmpty(l.ImplicitTlsAddress) {
+			v.fail(prefix+".tlsPolicy", "TLS is not supported by %s listeners", mailing.PROTOCOL_LMTP)
+		}
+		if len(l.Auth.Mechanisms) > 0 || l.Auth.Required {
+			v.fail(prefix+".auth", "authentication is not supported by %s listeners", mailing.PROTOCOL_LMTP)
+		}
+		return
+	}
+	v.tls(prefix, l)
+	v.auth(prefix, l, mailboxes)
+}
+
+func (v *validator) imap(sources []ImapSource) {
+	names := map[string]int{}
+	for i, source := range sources {
+		prefix := fmt.Sprintf("imap[%d]", i)
+		if v.required(prefix+".name", source.Name) {
+			if first, ok := names[source.Name]; ok {
+				v.fail(prefix+".name", "duplicate of imap[%d].name", first)
+			} else {
+				names[source.Name] = i
+			}
+		}
+		if v.required(prefix+".address", source.Address) {
+			if _, _, err := net.SplitHostPort(source.Address); err != nil {
+				v.fail(prefix+".address", "invalid address '%s'. %s", source.Address, err.Error())
+			}
+		}
+		v.required(prefix+".username", source.Username)
+		if source.Insecure && source.Tls {
+			v.fail(prefix+".insecure", "has no effect with tls, which always encrypts the connection")
+		}
+
+		switch strings.ToLower(source.ProcessedAction) {
+		case "", mailing.IMAP_ACTION_FLAG:
+		case mailing.IMAP_ACTION_MOVE:
+			folder := source.Folder
+			if utils.IsStringEmpty(folder) {
+				folder = mailing.DEFAULT_IMAP_FOLDER
+			}
+			if v.required(prefix+".processedFolder", source.ProcessedFolder) && strings.EqualFold(source.ProcessedFolder, folder) {
+				v.fail(prefix+".processedFolder", "must differ from the polled folder")
+			}
+		default:
+			v.fail(prefix+".processedAction", "unsupported action '%s'. Supported: %s", source.ProcessedAction, strings.Join(mailing.IMAPActions, ", "))
+		}
+		if source.PollInterval < 0 {
+			v.fail(prefix+".pollInterval", "must not be negative")
+		}
+	}
+}
+
+// Validate Checks the configuration and returns every problem found, or nil if the configuration is usable.
+func (cfg *Config) Validate() ValidationErrors {
+	var v validator
+
+	var logLevel log.Level
+	if err := logLevel.UnmarshalText([]byte(cfg.Log.LogLevel)); err != nil {
+		v.fail("log.level", "invalid log level '%s'", cfg.Log.LogLevel)
+	}
+
+	if cfg.Server.Disabled && len(cfg.Imap) == 0 && !cfg.Sms.Enabled {
+		v.fail("server.disabled", "the SMTP daemon is disabled and no imap sources or sms webhook are configured")
+	}
+	if len(cfg.Server.Mailboxes) == 0 && !cfg.Server.Disabled {
+		v.fail("server.mailboxes", "at least one mailbox is required")
+	}
+	mailboxes := map[string]int{}
+	for i, mailbox := range cfg.Server.Mailboxes {
+		field := fmt.Sprintf("server.mailboxes[%d]", i)
+		if !v.required(field, mailbox) {
+			continue
+		}
+		if err := mailing.ValidateMailboxPattern(mailbox); err != nil {
+			v.fail(field, err.Error())
+		}
+		if first, ok := mailboxes[strings.ToLower(mailbox)]; ok {
+			v.fail(field, "duplicate of server.mailboxes[%d]", first)
+			continue
+		}
+		mailboxes[strings.ToLower(mailbox)] = i
+	}
+
+	for i, domain := range cfg.Server.Domains {
+		field := fmt.Sprintf("server.domains[%d]", i)
+		if !v.required(field, domain) {
+			continue
+		}
+		if strings.Contains(domain, "@") {
+			v.fail(field, "domain '%s' must not contain @", domain)
+		} else if err := mailing.ValidateMailboxPattern("*@" + domain); err != nil {
+			v.fail(field, "invalid domain pattern '%s'", domain)
+		}
+	}
+
+	if len(cfg.Server.Listeners) == 0 {
+		v.listener("server", &cfg.Server.Listener, mailboxes)
+	} else {
+		if !utils.IsStringEmpty(cfg.Server.Address) {
+			v.fail("server.address", "must not be set when server.listeners are defined")
+		}
+		names := map[string]int{}
+		addresses := map[string]string{}
+		for i := range cfg.Server.Listeners {
+			l := &cfg.Server.Listeners[i]
+			prefix := fmt.Sprintf("server.listeners[%d]", i)
+			if v.required(prefix+".name", l.Name) {
+				if first, ok := names[l.Name]; ok {
+					v.fail(prefix+".name", "duplicate of server.listeners[%d].name", first)
+				} else {
+					names[l.Name] = i
+				}
+			}
+			if v.required(prefix+".address", l.Address) {
+				for _, address := range []string{l.Address, l.ImplicitTlsAddress} {
+					if utils.IsStringEmpty(address) {
+						continue
+					}
+					if first, ok := addresses[address]; ok {
+						v.fail(prefix+".address", "address '%s' is already used by %s", address, first)
+					} else {
+						addresses[address] = prefix
+					}
+				}
+			}
+			v.listener(prefix, l, mailboxes)
+			for j, mailbox := range l.Mailboxes {
+				v.knownMailbox(fmt.Sprintf("%s.mailboxes[%d]", prefix, j), mailbox, mailboxes)
+			}
+		}
+	}
+
+	if dnsServer := cfg.Server.Verification.DnsServer; !utils.IsStringEmpty(dnsServer) {
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			v.fail("server.verification.dnsServer", "invalid address '%s'. %s", dnsServer, err.Error())
+		}
+	}
+
+	limits := cfg.Server.Limits
+	for _, limit := range []struct {
+		field string
+		value int
+	}{
+		{"maxMessageSize", limits.MaxMessageSize},
+		{"maxSessions", limits.MaxSessions},
+		{"connectionsPerMinute", limits.ConnectionsPerMinute},
+		{"messagesPerMinute", limits.MessagesPerMinute},
+		{"spamQuota", limits.SpamQuota},
+	} {
+		if limit.value < 0 {
+			v.fail("server.limits."+limit.field, "must not be negative")
+		}
+	}
+
+	switch strings.ToLower(cfg.Server.Spool.Type) {
+	case "", SPOOL_NONE, SPOOL_DATABASE:
+	case SPOOL_DIRECTORY:
+		v.required("server.spool.directory", cfg.Server.Spool.Directory)
+	default:
+		v.fail("server.spool.type", "unsupported spool '%s'. Supported: %s", cfg.Server.Spool.Type, strings.Join(SpoolTypes, ", "))
+	}
+
+	workers := cfg.Server.Workers
+	if workers.Count < 0 {
+		v.fail("server.workers.count", "must not be negative")
+	}
+	if workers.QueueSize < 0 {
+		v.fail("server.workers.queueSize", "must not be negative")
+	}
+	if workers.ShutdownTimeout < 0 {
+		v.fail("server.workers.shutdownTimeout", "must not be negative")
+	}
+
+	arc := false
+	for i, source := range cfg.Server.SenderResolution.Sources {
+		supported := false
+		for _, s := range mailing.SenderSources {
+			supported = supported || strings.EqualFold(s, source)
+		}
+		if !supported {
+			v.fail(fmt.Sprintf("server.senderResolution.sources[%d]", i), "unsupported source '%s'. Supported: %s",
+				source, strings.Join(mailing.SenderSources, ", "))
+		}
+		arc = arc || strings.EqualFold(source, mailing.SENDER_ARC)
+	}
+	if arc && len(cfg.Server.SenderResolution.TrustedArcSealers) == 0 {
+		v.fail("server.senderResolution.trustedArcSealers", "at least one trusted sealer is required when using the %s source", mailing.SENDER_ARC)
+	}
+
+	v.imap(cfg.Imap)
+
+	if cfg.Sms.Enabled {
+		if v.required("sms.address", cfg.Sms.Address) {
+			if _, _, err := net.SplitHostPort(cfg.Sms.Address); err != nil {
+				v.fail("sms.address", "invalid address '%s'. %s", cfg.Sms.Address, err.Error())
+			}
+		}
+		if path := cfg.Sms.Path; !utils.IsStringEmpty(path) && !strings.HasPrefix(path, "/") {
+			v.fail("sms.path", "path must start with /")
+		}
+		v.required("sms.token", cfg.Sms.Token)
+	}
+
+	if cfg.Api.Enabled {
+		if v.required("api.address", cfg.Api.Address) {
+			if _, _, err := net.SplitHostPort(cfg.Api.Address); err != nil {
+				v.fail("api.address", "invalid address '%s'. %s", cfg.Api.Address, err.Error())
+			}
+		}
+		v.required("api.token", cfg.Api.Token)
+		if cfg.Sms.Enabled && cfg.Sms.Address == cfg.Api.Address {
+			v.fail("api.address", "address '%s' is already used by sms.address", cfg.Api.Address)
+		}
+	}
+	if cfg.Reconciliation.Enabled && !cfg.Api.Enabled {
+		v.fail("reconciliation.enabled", "requires api.enabled to register expected payments")
+	}
+	if err := cfg.References.Validate(); err != nil {
+		v.fail("references", err.Error())
+	}
+
+	if v.required("callback.url", cfg.Callback.ForwardURL) {
+		if u, err := url.Parse(cfg.Callback.ForwardURL); err != nil {
+			v.fail("callback.url", "invalid url. %s", err.Error())
+		} else if (u.Scheme != "http" && u.Scheme != "https") || utils.IsStringEmpty(u.Host) {
+			v.fail("callback.url", "url must be an absolute http or https url")
+		}
+	}
+	switch cfg.Callback.Format {
+	case "", messaging.FORMAT_LEGACY, messaging.FORMAT_ENVELOPE, messaging.FORMAT_CLOUDEVENTS:
+	default:
+		v.fail("callback.format", "unsupported format '%s'. Supported: %s", cfg.Callback.Format, strings.Join(messaging.Formats, ", "))
+	}
+	if cfg.Callback.Timeout < 0 {
+		v.fail("callback.timeout", "must not be negative")
+	}
+	if cfg.Callback.MaxConcurrent < 0 {
+		v.fail("callback.maxConcurrent", "must not be negative")
+	}
+	if breaker := cfg.Callback.CircuitBreaker; breaker.FailureThreshold < 0 || breaker.OpenDuration < 0 || breaker.HalfOpenProbes < 0 {
+		v.fail("callback.circuitBreaker", "failureThreshold, openDuration and halfOpenProbes must not be negative")
+	}
+	if retry := cfg.Callback.Retry; retry.MaxAttempts < 0 || retry.InitialBackoff < 0 || retry.MaxBackoff < 0 || retry.Interval < 0 {
+		v.fail("callback.retry", "maxAttempts, initialBackoff, maxBackoff and interval must not be negative")
+	} else if retry.MaxBackoff > 0 && retry.MaxBackoff < retry.InitialBackoff {
+		v.fail("callback.retry.maxBackoff", "must not be shorter than initialBackoff")
+	}
+	if clientTls := cfg.Callback.Tls; utils.IsStringEmpty(clientTls.CertFile) != utils.IsStringEmpty(clientTls.KeyFile) {
+		v.fail("callback.tls", "certFile and keyFile must be set together")
+	} else if _, err := clientTls.Config(); err != nil {
+		v.fail("callback.tls", err.Error())
+	}
+	switch auth := cfg.Callback.Auth; auth.Type {
+	case "":
+	case messaging.AUTH_BASIC:
+		v.required("callback.auth.username", auth.Username)
+	case messaging.AUTH_OAUTH2:
+		if v.required("callback.auth.tokenUrl", auth.TokenUrl) {
+			if u, err := url.Parse(auth.TokenUrl); err != nil {
+				v.fail("callback.auth.tokenUrl", "invalid url. %s", err.Error())
+			} else if (u.Scheme != "http" && u.Scheme != "https") || utils.IsStringEmpty(u.Host) {
+				v.fail("callback.auth.tokenUrl", "url must be an absolute http or https url")
+			}
+		}
+		v.required("callback.auth.clientId", auth.ClientId)
+		v.required("callback.auth.clientSecret", auth.ClientSecret)
+		if auth.RefreshBefore < 0 {
+			v.fail("callback.auth.refreshBefore", "must not be negative")
+		}
+		if authTls := auth.Tls; utils.IsStringEmpty(authTls.CertFile) != utils.IsStringEmpty(authTls.KeyFile) {
+			v.fail("callback.auth.tls", "certFile and keyFile must be set together")
+		} else if _, err := authTls.Config(); err != nil {
+			v.fail("callback.auth.tls", err.Error())
+		}
+	default:
+		v.fail("callback.auth.type", "unsupported type '%s'. Supported: %s", auth.Type, strings.Join(messaging.AuthTypes, ", "))
+	}
+	for name, value := range cfg.Callback.Headers {
+		if utils.IsStringEmpty(name) || strings.ContainsAny(name, " \t\r\n:") {
+			v.fail("callback.headers", "invalid header name '%s'", name)
+		} else if strings.ContainsAny(value, "\r\n") {
+			v.fail("callback.headers", "value of header %s contains a line break", name)
+		}
+	}
+	if cfg.Callback.Payload != nil {
+		if _, err := cfg.Callback.Payload.Compile(); err != nil {
+			v.fail("callback.payload", err.Error())
+		}
+	}
+	switch cfg.Callback.CloudEventsMode {
+	case "", messaging.CLOUDEVENTS_STRUCTURED, messaging.CLOUDEVENTS_BINARY:
+	default:
+		v.fail("callback.cloudEventsMode", "unsupported mode '%s'. Supported: %s", cfg.Callback.CloudEventsMode, strings.Join(messaging.CloudEventsModes, ", "))
+	}
+
+	if len(cfg.Templates) == 0 {
+		v.fail("templates", "at least one template is required")
+	}
+	emails := map[string]int{}
+	for i, tpl := range cfg.Templates {
+		prefix := fmt.Sprintf("templates[%d]", i)
+
+		v.required(prefix+".name", tpl.TemplateName)
+
+		if utils.IsStringEmpty(tpl.Email) && utils.IsStringEmpty(tpl.SmsSender) {
+			v.fail(prefix+".email", "email or smsSender is required")
+		}
+		if !utils.IsStringEmpty(tpl.Email) {
+			if _, err := mail.ParseAddress(tpl.Email); err != nil {
+				v.fail(prefix+".email", "invalid email address '%s'", tpl.Email)
+			}
+			// Templates of the same sender must be told apart by their mailboxes
+			if first, ok := emails[strings.ToLower(tpl.Email)]; ok && len(tpl.Mailboxes) == 0 {
+				v.fail(prefix+".email", "duplicate of templates[%d].email. Set mailboxes on one of them", first)
+			} else if len(tpl.Mailboxes) == 0 {
+				emails[strings.ToLower(tpl.Email)] = i
+			}
+		}
+		if !utils.IsStringEmpty(tpl.SmsSender) {
+			for j := 0; j < i; j++ {
+				if sms.SenderMatches(cfg.Templates[j].SmsSender, tpl.SmsSender) {
+					v.fail(prefix+".smsSender", "duplicate of templates[%d].smsSender", j)
+					break
+				}
+			}
+		}
+
+		v.networks(prefix+".allowedNetworks", tpl.AllowedNetworks)
+
+		for j, mailbox := range tpl.Mailboxes {
+			field := fmt.Sprintf("%s.mailboxes[%d]", prefix, j)
+			if len(cfg.Server.Mailboxes) == 0 {
+				// Mail fetched over IMAP is not checked against server.mailboxes
+				if err := mailing.ValidateMailboxPattern(mailbox); err != nil {
+					v.fail(field, err.Error())
+				}
+				continue
+			}
+			v.knownMailbox(field, mailbox, mailboxes)
+		}
+
+		if !tpl.Verification.IsEmpty() && !cfg.Server.Verification.Enabled {
+			v.fail(prefix+".verification", "requires server.verification.enabled")
+		}
+
+		v.pattern(prefix+".vendorReferenceIdPattern", tpl.VendorReferenceIdPattern, "vendorReferenceId", true)
+		v.pattern(prefix+".amountPattern", tpl.AmountPattern, "amount", true)
+		v.pattern(prefix+".datePattern", tpl.DatePattern, "date", true)
+		v.pattern(prefix+".transactionReferenceIdPattern", tpl.TransactionReferenceIdPattern, "transactionReferenceId", false)
+		v.pattern(prefix+".accountNumberPattern", tpl.AccountNumberPattern, "accountNumber", false)
+		v.pattern(prefix+".currencyPattern", tpl.CurrencyPattern, "currency", false)
+	}
+
+	return v.errors
+}
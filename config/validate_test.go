@@ -0,0 +1,267 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SharkFourSix/go-transact/messaging"
+	"github.com/SharkFourSix/go-transact/transaction"
+)
+
+const VALID_CONFIG = `
+log:
+  level: info
+server:
+  address: 127.0.0.1:2525
+  mailboxes: [payments]
+callback:
+  url: https://vendor.example.com/callback
+  token: secret
+templates:
+  - name: National Bank
+    email: alerts@bank.tld
+    vendorReferenceIdPattern: "Ref (?P<vendorReferenceId>[A-Z0-9]+)"
+    amountPattern: "(?P<amount>[0-9,.]+) on "
+    datePattern: "on (?P<date>[0-9]{8})"
+`
+
+func validConfig(t *testing.T) *Config {
+	var cfg Config
+	if err := cfg.parse([]byte(VALID_CONFIG)); err != nil {
+		t.Fatal(err)
+	}
+	return &cfg
+}
+
+func errorFields(errs ValidationErrors) []string {
+	fields := make([]string, len(errs))
+	for i, err := range errs {
+		fields[i] = err.Field
+	}
+	return fields
+}
+
+func TestValidate(t *testing.T) {
+	if errs := validConfig(t).Validate(); errs != nil {
+		t.Fatalf("valid configuration was rejected:\n%s", errs.Error())
+	}
+
+	cases := []struct {
+		name   string
+		modify func(cfg *Config)
+		fields []string
+	}{
+		{"log level", func(cfg *Config) {
+			cfg.Log.LogLevel = "loud"
+		}, []string{"log.level"}},
+
+		{"no mailboxes", func(cfg *Config) {
+			cfg.Server.Mailboxes = nil
+		}, []string{"server.mailboxes"}},
+		{"mailboxes", func(cfg *Config) {
+			cfg.Server.Mailboxes = []string{"payments", "", "PAYMENTS", "pay[ments"}
+		}, []string{"server.mailboxes[1]", "server.mailboxes[2]", "server.mailboxes[3]"}},
+		{"disabled without sources", func(cfg *Config) {
+			cfg.Server.Disabled = true
+		}, []string{"server.disabled"}},
+		{"domains", func(cfg *Config) {
+			cfg.Server.Domains = []string{"go-transact.tld", "payments@go-transact.tld", ""}
+		}, []string{"server.domains[1]", "server.domains[2]"}},
+
+		{"listener", func(cfg *Config) {
+			cfg.Server.Address = "2525"
+			cfg.Server.Protocol = "pop3"
+			cfg.Server.AllowedNetworks = []string{"40.92.0.0/15", "40.92.0.0/33"}
+		}, []string{"server.protocol", "server.address", "server.allowedNetworks[1]"}},
+		{"listener tls", func(cfg *Config) {
+			cfg.Server.TlsPolicy = "required"
+			cfg.Server.CertificateFile = "/nonexistent/cert.pem"
+			cfg.Server.TlsMinVersion = "0.9"
+			cfg.Server.TlsCipherSuites = []string{"TLS_NULL"}
+		}, []string{"server.certFile", "server.keyFile", "server.tlsMinVersion", "server.tlsCipherSuites[0]"}},
+		{"listener auth", func(cfg *Config) {
+			cfg.Server.Auth.Mechanisms = []string{"PLAIN", "KERBEROS"}
+		}, []string{"server.auth.mechanisms[1]", "server.auth.credentials"}},
+		{"lmtp over tcp with tls", func(cfg *Config) {
+			cfg.Server.Protocol = "lmtp"
+			cfg.Server.UseTls = true
+		}, []string{"server.tlsPolicy"}},
+		{"smtp on a unix socket", func(cfg *Config) {
+			cfg.Server.Network = "unix"
+			cfg.Server.Address = "/run/go-transact.sock"
+		}, []string{"server.network"}},
+
+		{"listeners", func(cfg *Config) {
+			cfg.Server.Listeners = []Listener{
+				{Name: "mx", Address: "127.0.0.1:25"},
+				{Name: "mx", Address: "127.0.0.1:25", Mailboxes: []string{"refunds"}},
+				{Address: "127.0.0.1:587"},
+			}
+		}, []string{
+			"server.address",
+			"server.listeners[1].name", "server.listeners[1].address", "server.listeners[1].mailboxes[0]",
+			"server.listeners[2].name",
+		}},
+
+		{"verification dns server", func(cfg *Config) {
+			cfg.Server.Verification.DnsServer = "8.8.8.8"
+		}, []string{"server.verification.dnsServer"}},
+		{"limits", func(cfg *Config) {
+			cfg.Server.Limits.MaxSessions = -1
+			cfg.Server.Limits.SpamQuota = -1
+		}, []string{"server.limits.maxSessions", "server.limits.spamQuota"}},
+		{"spool", func(cfg *Config) {
+			cfg.Server.Spool.Type = "directory"
+		}, []string{"server.spool.directory"}},
+		{"spool type", func(cfg *Config) {
+			cfg.Server.Spool.Type = "tape"
+		}, []string{"server.spool.type"}},
+		{"workers", func(cfg *Config) {
+			cfg.Server.Workers.Count = -1
+			cfg.Server.Workers.QueueSize = -1
+			cfg.Server.Workers.ShutdownTimeout = -time.Second
+		}, []string{"server.workers.count", "server.workers.queueSize", "server.workers.shutdownTimeout"}},
+		{"sender resolution", func(cfg *Config) {
+			cfg.Server.SenderResolution.Sources = []string{"arc", "carrier-pigeon"}
+		}, []string{"server.senderResolution.sources[1]", "server.senderResolution.trustedArcSealers"}},
+
+		{"imap", func(cfg *Config) {
+			cfg.Imap = []ImapSource{
+				{Name: "bank", Address: "imap.bank.tld:993", Username: "payments", Tls: true, Insecure: true},
+				{Name: "bank", Address: "imap.bank.tld", ProcessedAction: "move", ProcessedFolder: "inbox", PollInterval: -time.Second},
+				{ProcessedAction: "delete"},
+			}
+		}, []string{
+			"imap[0].insecure",
+			"imap[1].name", "imap[1].address", "imap[1].username", "imap[1].processedFolder", "imap[1].pollInterval",
+			"imap[2].name", "imap[2].address", "imap[2].username", "imap[2].processedAction",
+		}},
+
+		{"sms", func(cfg *Config) {
+			cfg.Sms.Enabled = true
+			cfg.Sms.Address = "8080"
+			cfg.Sms.Path = "sms"
+		}, []string{"sms.address", "sms.path", "sms.token"}},
+		{"api", func(cfg *Config) {
+			cfg.Sms.Enabled = true
+			cfg.Sms.Address = "127.0.0.1:8080"
+			cfg.Sms.Token = "secret"
+			cfg.Api.Enabled = true
+			cfg.Api.Address = "127.0.0.1:8080"
+		}, []string{"api.token", "api.address"}},
+		{"reconciliation without api", func(cfg *Config) {
+			cfg.Reconciliation.Enabled = true
+		}, []string{"reconciliation.enabled"}},
+		{"references", func(cfg *Config) {
+			cfg.References.Alphabet = "AA"
+		}, []string{"references"}},
+
+		{"callback url", func(cfg *Config) {
+			cfg.Callback.ForwardURL = "vendor.example.com/callback"
+		}, []string{"callback.url"}},
+		{"callback options", func(cfg *Config) {
+			cfg.Callback.Format = "xml"
+			cfg.Callback.CloudEventsMode = "batched"
+			cfg.Callback.Timeout = -time.Second
+			cfg.Callback.MaxConcurrent = -1
+			cfg.Callback.CircuitBreaker.FailureThreshold = -1
+		}, []string{"callback.format", "callback.timeout", "callback.maxConcurrent", "callback.circuitBreaker", "callback.cloudEventsMode"}},
+		{"callback retry", func(cfg *Config) {
+			cfg.Callback.Retry.InitialBackoff = time.Minute
+			cfg.Callback.Retry.MaxBackoff = time.Second
+		}, []string{"callback.retry.maxBackoff"}},
+		{"callback tls", func(cfg *Config) {
+			cfg.Callback.Tls.CertFile = "client.pem"
+		}, []string{"callback.tls"}},
+		{"callback basic auth", func(cfg *Config) {
+			cfg.Callback.Auth.Type = messaging.AUTH_BASIC
+		}, []string{"callback.auth.username"}},
+		{"callback oauth2", func(cfg *Config) {
+			cfg.Callback.Auth.Type = messaging.AUTH_OAUTH2
+			cfg.Callback.Auth.TokenUrl = "/oauth/token"
+			cfg.Callback.Auth.RefreshBefore = -time.Second
+			cfg.Callback.Auth.Tls.KeyFile = "client.key"
+		}, []string{"callback.auth.tokenUrl", "callback.auth.clientId", "callback.auth.clientSecret", "callback.auth.refreshBefore", "callback.auth.tls"}},
+		{"callback auth type", func(cfg *Config) {
+			cfg.Callback.Auth.Type = "kerberos"
+		}, []string{"callback.auth.type"}},
+		{"callback headers", func(cfg *Config) {
+			cfg.Callback.Headers = map[string]string{"X-Vendor": "shop\r\nX-Injected: yes"}
+		}, []string{"callback.headers"}},
+		{"callback payload", func(cfg *Config) {
+			cfg.Callback.Payload = &messaging.PayloadTemplate{Body: "{{.Amount"}
+		}, []string{"callback.payload"}},
+
+		{"no templates", func(cfg *Config) {
+			cfg.Templates = nil
+		}, []string{"templates"}},
+		{"template", func(cfg *Config) {
+			tpl := &cfg.Templates[0]
+			tpl.TemplateName = ""
+			tpl.Email = "alerts"
+			tpl.AllowedNetworks = []string{"bank.tld"}
+			tpl.Mailboxes = []string{"refunds"}
+			tpl.Verification.RequireDkim = true
+		}, []string{
+			"templates[0].name", "templates[0].email", "templates[0].allowedNetworks[0]",
+			"templates[0].mailboxes[0]", "templates[0].verification",
+		}},
+		{"template sender", func(cfg *Config) {
+			cfg.Templates[0].Email = ""
+		}, []string{"templates[0].email"}},
+		{"duplicate templates", func(cfg *Config) {
+			tpl := cfg.Templates[0]
+			tpl.SmsSender = "NATBANK"
+			cfg.Templates = append(cfg.Templates, tpl, tpl)
+			cfg.Templates[2].Email = ""
+		}, []string{"templates[1].email", "templates[2].smsSender"}},
+		{"template patterns", func(cfg *Config) {
+			tpl := &cfg.Templates[0]
+			tpl.VendorReferenceIdPattern = ""
+			tpl.AmountPattern = "(?P<amount>[0-9"
+			tpl.DatePattern = "on ([0-9]{8})"
+			tpl.CurrencyPattern = "(?P<code>[A-Z]{3})"
+		}, []string{
+			"templates[0].vendorReferenceIdPattern", "templates[0].amountPattern", "templates[0].datePattern",
+			"templates[0].currencyPattern",
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			c.modify(cfg)
+			errs := cfg.Validate()
+			if fields := errorFields(errs); strings.Join(fields, ",") != strings.Join(c.fields, ",") {
+				t.Errorf("errors reported for %v, expected %v:\n%s", fields, c.fields, errs.Error())
+			}
+		})
+	}
+}
+
+// Every problem is reported, not just the first one found
+func TestValidateCollectsErrors(t *testing.T) {
+	cfg := validConfig(t)
+	cfg.Log.LogLevel = "loud"
+	cfg.Server.Spool.Type = "tape"
+	cfg.Sms.Enabled = true
+	cfg.Callback.ForwardURL = ""
+	cfg.Templates = append(cfg.Templates, transaction.TransactionTemplate{Email: "refunds@bank.tld"})
+
+	expected := []string{
+		"log.level",
+		"server.spool.type",
+		"sms.address", "sms.token",
+		"callback.url",
+		"templates[1].name",
+		"templates[1].vendorReferenceIdPattern", "templates[1].amountPattern", "templates[1].datePattern",
+	}
+	errs := cfg.Validate()
+	if fields := errorFields(errs); strings.Join(fields, ",") != strings.Join(expected, ",") {
+		t.Fatalf("errors reported for %v, expected %v", fields, expected)
+	}
+	if lines := strings.Split(errs.Error(), "\n"); len(lines) != len(expected) || lines[0] != "log.level: invalid log level 'loud'" {
+		t.Errorf("unexpected error message:\n%s", errs.Error())
+	}
+}
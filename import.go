@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/SharkFourSix/go-transact/mailing"
+	"github.com/SharkFourSix/go-transact/transaction"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+// Runs every message of a Maildir or mbox export through the same processing as received mail
+// and prints a summary. Returns the exit status.
+func importMail(maildir string, mbox string, options processOptions, server *mailing.MailServer) int {
+	if utils.IsStringEmpty(maildir) == utils.IsStringEmpty(mbox) {
+		fmt.Println("import requires exactly one of '--maildir' or '--mbox'")
+		return 1
+	}
+
+	var (
+		outcomes = map[string]int{}
+		failed   int
+		name     string
+	)
+	server.Handler = func(received *mailing.ReceivedMail) error {
+		outcome, parsed, err := processMail(received, options)
+		if err != nil {
+			return err
+		}
+		outcomes[outcome]++
+		if options.dryRun {
+			fmt.Printf("%s: %s from %s%s\n", name, outcome, received.Sender, describeTransaction(parsed))
+		}
+		return nil
+	}
+	importMessage := func(messageName string, raw []byte) error {
+		name = messageName
+		if err := server.Import(name, raw); err != nil {
+			failed++
+			fmt.Printf("%s: skipped, %s\n", name, err.Error())
+		}
+		return nil
+	}
+
+	var err error
+	if !utils.IsStringEmpty(maildir) {
+		err = mailing.ReadMaildir(maildir, importMessage)
+	} else {
+		var file *os.File
+		if file, err = os.Open(mbox); err == nil {
+			err = mailing.ReadMbox(file, importMessage)
+			file.Close()
+		}
+	}
+
+	fmt.Printf("transactions: %d, parse failures: %d, unverified: %d, spam: %d, skipped: %d\n",
+		outcomes[OUTCOME_TRANSACTION], outcomes[OUTCOME_PARSE_FAILED], outcomes[OUTCOME_UNVERIFIED], outcomes[OUTCOME_SPAM], failed)
+	if options.dryRun {
+		fmt.Println("dry run, nothing was stored")
+	}
+	if err != nil {
+		fmt.Printf("import stopped. %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+func describeTransaction(parsed *transaction.Transaction) string {
+	if parsed == nil {
+		return ""
+	}
+	return fmt.Sprintf(", %s %s %s reference %s", parsed.Date, parsed.Currency, parsed.Amount, parsed.VendorReferenceId)
+}
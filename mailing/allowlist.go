@@ -0,0 +1,81 @@
+package mailing
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// List of networks allowed to deliver mail. An empty list allows everyone.
+type Allowlist struct {
+	networks []*net.IPNet
+}
+
+// ParseNetwork Parses a CIDR block. A bare IP address is treated as a single host network.
+func ParseNetwork(network string) (*net.IPNet, error) {
+	network = strings.TrimSpace(network)
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR block '%s'", network)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR block '%s'", network)
+	}
+	return ipNet, nil
+}
+
+func NewAllowlist(networks []string) (*Allowlist, error) {
+	allowlist := &Allowlist{}
+	for _, network := range networks {
+		ipNet, err := ParseNetwork(network)
+		if err != nil {
+			return nil, err
+		}
+		allowlist.networks = append(allowlist.networks, ipNet)
+	}
+	return allowlist, nil
+}
+
+// AllowsRelay Checks the address mail was relayed from. Mail fetched over IMAP or imported from a file has no
+// such address and is allowed.
+func (a *Allowlist) AllowsRelay(addr net.Addr) bool {
+	return remoteIP(addr) == nil || a.Allows(addr)
+}
+
+// Allows Checks whether the address belongs to one of the networks. Nil and empty lists allow everything.
+func (a *Allowlist) Allows(addr net.Addr) bool {
+	if a == nil || len(a.networks) == 0 {
+		return true
+	}
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the recipient against the mailboxes this server accepts, if restricted
+func (ms *MailServer) acceptsMailbox(remoteAddr net.Addr, to string) bool {
+	if len(ms.Mailboxes) == 0 {
+		return true
+	}
+	if MatchAnyMailbox(ms.Mailboxes, to) {
+		return true
+	}
+	log.Debugf("%s: mailbox %s is not accepted by listener %s", remoteAddr.String(), to, ms.Name)
+	return false
+}
@@ -0,0 +1,42 @@
+package mailing
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	allowlist, err := NewAllowlist([]string{"40.92.0.0/15", "10.1.2.3", "2a01:111::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = map[string]bool{
+		"40.92.18.77":    true,
+		"40.94.0.1":      false,
+		"10.1.2.3":       true,
+		"10.1.2.4":       false,
+		"2a01:111::25":   true,
+		"2a01:112::25":   false,
+		"::ffff:a01:203": true,
+	}
+	for ip, expected := range cases {
+		addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}
+		if allowlist.Allows(addr) != expected {
+			t.Errorf("%s: expected allowed = %t", ip, expected)
+		}
+	}
+
+	if _, err := NewAllowlist([]string{"40.92.0.0/33"}); err == nil {
+		t.Error("invalid CIDR block was accepted")
+	}
+
+	if !allowlist.AllowsRelay(stringAddr("imap://imap.bank.tld:993/INBOX")) || allowlist.AllowsRelay(&net.TCPAddr{IP: net.ParseIP("40.94.0.1")}) {
+		t.Error("relays must be checked unless they have no network address")
+	}
+
+	var empty *Allowlist
+	if !empty.Allows(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Error("nil allowlist must allow everyone")
+	}
+}
@@ -0,0 +1,377 @@
+package mailing
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+var (
+	signatureTagRegex = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+	whitespaceRegex   = regexp.MustCompile(`[ \t]+`)
+)
+
+// Header field as it appears in the message. Folding of the value is preserved
+type headerField struct {
+	Name  string
+	Value string
+}
+
+// Splits the header section of a raw message into fields, keeping their order and original folding
+func parseHeaderFields(raw []byte) []headerField {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = len(raw)
+	}
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(raw[:end]), "\r\n") {
+		line = strings.TrimSuffix(line, "\r\n")
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.Value += "\r\n" + line
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		fields = append(fields, headerField{Name: line[:colon], Value: line[colon+1:]})
+	}
+	return fields
+}
+
+// Relaxed header canonicalization as defined in RFC 6376 section 3.4.2
+func canonicalizeHeaderRelaxed(field headerField) string {
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(field.Value)
+	value = strings.TrimSpace(whitespaceRegex.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(field.Name)) + ":" + value + "\r\n"
+}
+
+// Parses a DKIM style tag list, i.e, "i=1; a=rsa-sha256; d=example.com"
+func parseTagList(value string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(value, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return tags
+}
+
+func stripWhitespace(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// One ARC set (RFC 8617 section 4.1)
+type arcSet struct {
+	authenticationResults headerField
+	messageSignature      headerField
+	seal                  headerField
+	sealTags              map[string]string
+}
+
+// Groups the ARC header fields by instance. Returns an error if the chain is structurally invalid
+func arcSets(fields []headerField) ([]*arcSet, error) {
+	sets := map[int]*arcSet{}
+	instanceOf := func(field headerField) (*arcSet, error) {
+		i, err := strconv.Atoi(parseTagList(field.Value)["i"])
+		if err != nil || i < 1 || i > 50 {
+			return nil, fmt.Errorf("invalid ARC instance in %s", field.Name)
+		}
+		if sets[i] == nil {
+			sets[i] = &arcSet{}
+		}
+		return sets[i], nil
+	}
+
+	for _, field := range fields {
+		name := strings.ToLower(field.Name)
+		if name != "arc-authentication-results" && name != "arc-message-signature" && name != "arc-seal" {
+			continue
+		}
+		set, err := instanceOf(field)
+		if err != nil {
+			return nil, err
+		}
+		target := &set.seal
+		switch name {
+		case "arc-authentication-results":
+			target = &set.authenticationResults
+		case "arc-message-signature":
+			target = &set.messageSignature
+		default:
+			set.sealTags = parseTagList(field.Value)
+		}
+		if len(target.Name) > 0 {
+			return nil, fmt.Errorf("duplicate %s header", field.Name)
+		}
+		*target = field
+	}
+
+	if len(sets) == 0 {
+		return nil, nil
+	}
+	chain := make([]*arcSet, len(sets))
+	for i := range chain {
+		set, ok := sets[i+1]
+		if !ok || len(set.authenticationResults.Name) == 0 || len(set.messageSignature.Name) == 0 || len(set.seal.Name) == 0 {
+			return nil, fmt.Errorf("incomplete ARC set %d", i+1)
+		}
+		chain[i] = set
+	}
+	return chain, nil
+}
+
+// Hash signed by the ARC-Seal of the last set (RFC 8617 section 5.1.1)
+func arcSealHash(chain []*arcSet) []byte {
+	hash := sha256.New()
+	for i, set := range chain {
+		hash.Write([]byte(canonicalizeHeaderRelaxed(set.authenticationResults)))
+		hash.Write([]byte(canonicalizeHeaderRelaxed(set.messageSignature)))
+		seal := canonicalizeHeaderRelaxed(set.seal)
+		if i == len(chain)-1 {
+			unsigned := set.seal
+			unsigned.Value = signatureTagRegex.ReplaceAllString(unsigned.Value, "$1$2")
+			seal = strings.TrimSuffix(canonicalizeHeaderRelaxed(unsigned), "\r\n")
+		}
+		hash.Write([]byte(seal))
+	}
+	return hash.Sum(nil)
+}
+
+func (v *Verifier) lookupPublicKey(ctx context.Context, domain string, selector string) (crypto.PublicKey, error) {
+	txts, err := v.resolver().LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, err
+	}
+	tags := parseTagList(strings.Join(txts, ""))
+	data, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["p"]))
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid public key for %s._domainkey.%s", selector, domain)
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+			return key, nil
+		}
+		return x509.ParsePKCS1PublicKey(data)
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key for %s._domainkey.%s", selector, domain)
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", tags["k"])
+}
+
+// Body canonicalization as defined in RFC 6376 section 3.4.3 (simple) and 3.4.4 (relaxed)
+func canonicalizeBody(body []byte, relaxed bool) []byte {
+	text := string(body)
+	if relaxed {
+		lines := strings.Split(text, "\r\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(whitespaceRegex.ReplaceAllString(line, " "), " ")
+		}
+		text = strings.Join(lines, "\r\n")
+	}
+	for strings.HasSuffix(text, "\r\n") {
+		text = strings.TrimSuffix(text, "\r\n")
+	}
+	if len(text) == 0 {
+		if relaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(text + "\r\n")
+}
+
+// Simple header canonicalization as defined in RFC 6376 section 3.4.1
+func canonicalizeHeaderSimple(field headerField) string {
+	return field.Name + ":" + field.Value + "\r\n"
+}
+
+// Hash of the signed header fields of an ARC-Message-Signature, computed like a DKIM signature
+// (RFC 6376 section 3.7). Occurrences of a header field are selected from the bottom up
+func messageSignatureHash(fields []headerField, signature headerField, relaxed bool) []byte {
+	canonicalize := canonicalizeHeaderSimple
+	if relaxed {
+		canonicalize = canonicalizeHeaderRelaxed
+	}
+	hash := sha256.New()
+	used := map[string]int{}
+	for _, name := range strings.Split(parseTagList(signature.Value)["h"], ":") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		skip := used[name]
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !strings.EqualFold(strings.TrimSpace(fields[i].Name), name) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			hash.Write([]byte(canonicalize(fields[i])))
+			break
+		}
+		used[name]++
+	}
+	unsigned := signature
+	unsigned.Value = signatureTagRegex.ReplaceAllString(unsigned.Value, "$1$2")
+	hash.Write([]byte(strings.TrimSuffix(canonicalize(unsigned), "\r\n")))
+	return hash.Sum(nil)
+}
+
+// Verifies the b= signature of an ARC-Seal or ARC-Message-Signature over hashed, with the key published by the signer
+func (v *Verifier) verifySignature(ctx context.Context, tags map[string]string, hashed []byte) error {
+	domain := strings.ToLower(tags["d"])
+	algorithm := strings.ToLower(tags["a"])
+	if algorithm != "rsa-sha256" && algorithm != "ed25519-sha256" {
+		return fmt.Errorf("unsupported algorithm '%s'", tags["a"])
+	}
+	key, err := v.lookupPublicKey(ctx, domain, tags["s"])
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("invalid signature. %v", err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm != "rsa-sha256" {
+			return fmt.Errorf("key of %s does not match algorithm %s", domain, algorithm)
+		}
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed, signature)
+	case ed25519.PublicKey:
+		if algorithm != "ed25519-sha256" {
+			return fmt.Errorf("key of %s does not match algorithm %s", domain, algorithm)
+		}
+		if !ed25519.Verify(key, hashed, signature) {
+			err = fmt.Errorf("ed25519 verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported key type")
+	}
+	if err != nil {
+		return fmt.Errorf("signature of %s did not verify. %v", domain, err)
+	}
+	return nil
+}
+
+// Verifies the body hash and signature of an ARC-Message-Signature against the message
+func (v *Verifier) verifyMessageSignature(ctx context.Context, raw []byte, fields []headerField, signature headerField) error {
+	tags := parseTagList(signature.Value)
+	if _, ok := tags["l"]; ok {
+		// Content appended after the signed length would be accepted
+		return fmt.Errorf("body length limits are not supported")
+	}
+	signsFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		signsFrom = signsFrom || strings.EqualFold(strings.TrimSpace(name), "from")
+	}
+	if !signsFrom {
+		return fmt.Errorf("From header is not signed")
+	}
+
+	canonicalization := strings.SplitN(strings.ToLower(tags["c"]), "/", 2)
+	headerRelaxed := canonicalization[0] == "relaxed"
+	bodyRelaxed := len(canonicalization) == 2 && canonicalization[1] == "relaxed"
+	for i, c := range canonicalization {
+		if c != "simple" && c != "relaxed" && !(i == 0 && c == "") {
+			return fmt.Errorf("unsupported canonicalization '%s'", tags["c"])
+		}
+	}
+
+	var body []byte
+	if end := bytes.Index(raw, []byte("\r\n\r\n")); end >= 0 {
+		body = raw[end+4:]
+	}
+	bodyHash := sha256.Sum256(canonicalizeBody(body, bodyRelaxed))
+	expected, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["bh"]))
+	if err != nil || !bytes.Equal(expected, bodyHash[:]) {
+		return fmt.Errorf("body hash did not verify")
+	}
+	return v.verifySignature(ctx, tags, messageSignatureHash(fields, signature, headerRelaxed))
+}
+
+// Validates the ARC chain of a message and returns the envelope sender recorded by the last sealer,
+// provided that sealer is trusted. Every seal and the message signature of the last instance are verified,
+// so the headers and body are those the last sealer saw. Only the results of the last instance are used:
+// earlier instances were recorded by sealers that are not trusted, so the trusted sealer must be the one
+// receiving the mail from the bank.
+func (v *Verifier) ArcOriginalSender(raw []byte, trustedSealers []string) (string, error) {
+	fields := parseHeaderFields(raw)
+	chain, err := arcSets(fields)
+	if err != nil {
+		return "", err
+	}
+	if len(chain) == 0 {
+		return "", fmt.Errorf("message has no ARC headers")
+	}
+
+	last := chain[len(chain)-1]
+	for i, set := range chain {
+		cv := strings.ToLower(set.sealTags["cv"])
+		if (i == 0 && cv != "none") || (i > 0 && cv != "pass") {
+			return "", fmt.Errorf("ARC chain validation failed at instance %d (cv=%s)", i+1, cv)
+		}
+	}
+
+	domain := strings.ToLower(last.sealTags["d"])
+	trusted := false
+	for _, sealer := range trustedSealers {
+		trusted = trusted || isSubdomain(domain, sealer)
+	}
+	if !trusted {
+		return "", fmt.Errorf("ARC sealer %s is not trusted", domain)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), VERIFICATION_TIMEOUT)
+	defer cancel()
+	for i, set := range chain {
+		if err := v.verifySignature(ctx, set.sealTags, arcSealHash(chain[:i+1])); err != nil {
+			return "", fmt.Errorf("ARC-Seal %d did not verify. %v", i+1, err)
+		}
+	}
+	if err := v.verifyMessageSignature(ctx, raw, fields, last.messageSignature); err != nil {
+		return "", fmt.Errorf("ARC-Message-Signature of %s did not verify. %v", domain, err)
+	}
+
+	// ARC-Authentication-Results start with the instance tag, followed by a regular Authentication-Results value
+	value := last.authenticationResults.Value
+	value = value[strings.Index(value, ";")+1:]
+	_, results, err := authres.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return "", fmt.Errorf("invalid ARC-Authentication-Results. %v", err)
+	}
+	for _, result := range results {
+		if spfResult, ok := result.(*authres.SPFResult); ok && spfResult.Value == authres.ResultPass && strings.Contains(spfResult.From, "@") {
+			return spfResult.From, nil
+		}
+	}
+	return "", fmt.Errorf("ARC-Authentication-Results of %s have no passing SPF sender", domain)
+}
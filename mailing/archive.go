@@ -0,0 +1,148 @@
+package mailing
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+var mboxFromEscapeRegex = regexp.MustCompile(`^>+From `)
+
+// Called for every message of a mailbox export. Name identifies the message in the export
+type MessageFunc func(name string, raw []byte) error
+
+// ReadMaildir Calls fn for every message in the cur and new folders of a Maildir, oldest first.
+// Stops at the first error returned by fn.
+func ReadMaildir(dir string, fn MessageFunc) error {
+	var files []string
+	for _, sub := range []string{"cur", "new"} {
+		matches, err := filepath.Glob(filepath.Join(dir, sub, "*"))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 && !utils.FileExists(filepath.Join(dir, "cur")) && !utils.FileExists(filepath.Join(dir, "new")) {
+		return fmt.Errorf("%s is not a Maildir", dir)
+	}
+	// Maildir file names start with the delivery timestamp
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+
+	for _, file := range files {
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := fn(filepath.Base(file), toCRLF(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMbox Calls fn for every message of an mbox file, in order. Both mboxo and mboxrd
+// quoting of "From " lines is undone. Stops at the first error returned by fn.
+func ReadMbox(r io.Reader, fn MessageFunc) error {
+	var (
+		scanner = bufio.NewScanner(r)
+		message bytes.Buffer
+		count   int
+		started bool
+	)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	flush := func() error {
+		if !started {
+			return nil
+		}
+		count++
+		raw := bytes.TrimRight(message.Bytes(), "\r\n")
+		message.Reset()
+		return fn(fmt.Sprintf("message %d", count), append(toCRLF(raw), '\r', '\n'))
+	}
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if err := flush(); err != nil {
+				return err
+			}
+			started = true
+			continue
+		}
+		if !started && len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if !started {
+			return fmt.Errorf("not an mbox file, expected a \"From \" line")
+		}
+		if mboxFromEscapeRegex.Match(line) {
+			line = line[1:]
+		}
+		message.Write(line)
+		message.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Converts bare LF line endings, as found in most exports, to the CRLF endings of mail on the wire
+func toCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+// Import Processes a message taken from a mailbox export synchronously, like mail received over SMTP
+func (ms *MailServer) Import(name string, raw []byte) error {
+	return ms.processStored(stringAddr("import://"+name), raw)
+}
+
+// Processes a message that was delivered somewhere else first, i.e, fetched over IMAP or imported
+func (ms *MailServer) processStored(origin net.Addr, raw []byte) error {
+	received, err := ms.receiveStored(origin, raw)
+	if err != nil {
+		return err
+	}
+	return ms.handle(received)
+}
+
+// Reads a stored message. The envelope is gone, so it is recovered from what the delivering server recorded
+// in the headers.
+func (ms *MailServer) receiveStored(origin net.Addr, raw []byte) (*ReceivedMail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	from, _ := headerAddress(msg.Header, "Return-Path")
+	if utils.IsStringEmpty(from) {
+		from, _ = headerAddress(msg.Header, "From")
+	}
+	var to []string
+	for _, name := range []string{"Delivered-To", "To"} {
+		if addresses, err := msg.Header.AddressList(name); err == nil && len(addresses) > 0 {
+			for _, address := range addresses {
+				to = append(to, address.Address)
+			}
+			break
+		}
+	}
+
+	return ms.receive(origin, from, to, raw, "")
+}
@@ -0,0 +1,91 @@
+package mailing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadMbox(t *testing.T) {
+	const mbox = "From alerts@bank.tld Mon Jan  1 00:00:00 2024\n" +
+		"From: alerts@bank.tld\nSubject: Credit\n\nFirst\n>From the bank\n\n" +
+		"From alerts@bank.tld Tue Jan  2 00:00:00 2024\n" +
+		"From: alerts@bank.tld\nSubject: Debit\n\nSecond\n"
+
+	var messages []string
+	err := ReadMbox(strings.NewReader(mbox), func(name string, raw []byte) error {
+		messages = append(messages, string(raw))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0] != "From: alerts@bank.tld\r\nSubject: Credit\r\n\r\nFirst\r\nFrom the bank\r\n" {
+		t.Errorf("unexpected first message %q", messages[0])
+	}
+	if !strings.Contains(messages[1], "Subject: Debit") {
+		t.Errorf("unexpected second message %q", messages[1])
+	}
+
+	if err := ReadMbox(strings.NewReader("Subject: not an mbox\n"), func(string, []byte) error { return nil }); err == nil {
+		t.Error("file without a From line was read as mbox")
+	}
+}
+
+func TestReadMaildir(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"new/1700000002.host", "cur/1700000001.host:2,S", "tmp/1700000003.host"} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("Subject: "+filepath.Base(file)+"\n\nbody\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	err := ReadMaildir(dir, func(name string, raw []byte) error {
+		if !strings.HasPrefix(string(raw), "Subject: "+name+"\r\n") {
+			t.Errorf("%s: unexpected content %q", name, raw)
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "1700000001.host:2,S,1700000002.host" {
+		t.Errorf("expected cur and new messages oldest first, got %v", names)
+	}
+
+	if err := ReadMaildir(t.TempDir(), func(string, []byte) error { return nil }); err == nil {
+		t.Error("empty directory was read as a Maildir")
+	}
+}
+
+func TestImport(t *testing.T) {
+	var received *ReceivedMail
+	ms := &MailServer{
+		SenderResolver: &SenderResolver{Sources: []string{SENDER_SRS}},
+		Handler: func(mail *ReceivedMail) error {
+			received = mail
+			return nil
+		},
+	}
+	raw := "Return-Path: <SRS0=HHH=TT=bank.tld=alerts@forwarder.tld>\r\nDelivered-To: payments@go-transact.tld\r\n" + TEST_MESSAGE
+	if err := ms.Import("message 1", []byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if received == nil || received.Sender != "alerts@bank.tld" || received.To[0] != "payments@go-transact.tld" {
+		t.Fatalf("imported message was not processed like received mail: %+v", received)
+	}
+	if received.RemoteAddr.String() != "import://message 1" {
+		t.Errorf("unexpected origin %s", received.RemoteAddr.String())
+	}
+}
@@ -0,0 +1,108 @@
+package mailing
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AUTH_PLAIN    = "PLAIN"
+	AUTH_LOGIN    = "LOGIN"
+	AUTH_CRAM_MD5 = "CRAM-MD5"
+)
+
+// Mechanisms supported by the SMTP AUTH extension
+var AuthMechanisms = []string{AUTH_PLAIN, AUTH_LOGIN, AUTH_CRAM_MD5}
+
+// Credential accepted by the SMTP AUTH extension
+type Credential struct {
+	Username string `yaml:"username"`
+	// bcrypt hash of the password. Used by PLAIN and LOGIN
+	PasswordHash string `yaml:"passwordHash"`
+	// Plain text shared secret. Used by CRAM-MD5, which cannot work with hashed passwords
+	Secret string `yaml:"secret"`
+	// Mailboxes this credential may deliver to, see MatchMailbox. Empty = all mailboxes
+	Mailboxes []string `yaml:"mailboxes"`
+}
+
+// AllowsMailbox Checks whether this credential may deliver to the given recipient address
+func (c *Credential) AllowsMailbox(address string) bool {
+	return len(c.Mailboxes) == 0 || MatchAnyMailbox(c.Mailboxes, address)
+}
+
+func (ms *MailServer) credential(username string) *Credential {
+	for i := range ms.Credentials {
+		if ms.Credentials[i].Username == username {
+			return &ms.Credentials[i]
+		}
+	}
+	return nil
+}
+
+// Builds the mechanism overrides for smtpd. Mechanisms that are not configured are disabled.
+//
+//	PLAIN and LOGIN are only offered over TLS unless AllowInsecureAuth is set.
+func (ms *MailServer) authMechanisms() map[string]bool {
+	mechanisms := map[string]bool{}
+	for _, mechanism := range AuthMechanisms {
+		mechanisms[mechanism] = false
+	}
+	for _, mechanism := range ms.AuthMechanisms {
+		mechanism = strings.ToUpper(mechanism)
+		if mechanism == AUTH_CRAM_MD5 || ms.AllowInsecureAuth {
+			mechanisms[mechanism] = true
+		} else {
+			delete(mechanisms, mechanism)
+		}
+	}
+	return mechanisms
+}
+
+func (ms *MailServer) authenticate(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+	credential := ms.credential(string(username))
+	if credential == nil {
+		log.Warnf("%s: authentication failed for unknown user %s", remoteAddr.String(), username)
+		return false, nil
+	}
+
+	var authenticated bool
+	switch mechanism {
+	case AUTH_PLAIN, AUTH_LOGIN:
+		authenticated = bcrypt.CompareHashAndPassword([]byte(credential.PasswordHash), password) == nil
+	case AUTH_CRAM_MD5:
+		if len(credential.Secret) > 0 {
+			mac := hmac.New(md5.New, []byte(credential.Secret))
+			mac.Write(shared)
+			authenticated = hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), password)
+		}
+	}
+
+	if !authenticated {
+		log.Warnf("%s: %s authentication failed for user %s", remoteAddr.String(), mechanism, credential.Username)
+		return false, nil
+	}
+
+	log.Debugf("%s: authenticated as %s using %s", remoteAddr.String(), credential.Username, mechanism)
+	ms.session(remoteAddr).username = credential.Username
+	return true, nil
+}
+
+// Checks that an authenticated client may deliver to the recipient's mailbox
+func (ms *MailServer) authorizeRecipient(remoteAddr net.Addr, to string) bool {
+	username := ms.session(remoteAddr).username
+	if len(username) == 0 {
+		return true
+	}
+	credential := ms.credential(username)
+	if credential == nil || !credential.AllowsMailbox(to) {
+		log.Warnf("%s: user %s is not allowed to deliver to mailbox %s", remoteAddr.String(), username, to)
+		return false
+	}
+	return true
+}
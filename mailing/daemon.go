@@ -0,0 +1,111 @@
+package mailing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Runs several mail servers, i.e, one per listener, as a single SMTP daemon
+type Daemon struct {
+	Servers []*MailServer
+}
+
+// Start Binds every server before accepting connections on any of them, so that a misconfigured
+// listener does not leave the others running. Returns when the first server stops.
+func (d *Daemon) Start() error {
+	if len(d.Servers) == 0 {
+		return fmt.Errorf("no SMTP listeners configured")
+	}
+	for i, ms := range d.Servers {
+		if err := ms.Listen(); err != nil {
+			for _, started := range d.Servers[:i] {
+				started.closeListeners()
+			}
+			return fmt.Errorf("listener %s: %v", ms.Name, err)
+		}
+	}
+
+	errc := make(chan error, len(d.Servers))
+	for _, ms := range d.Servers {
+		go func(ms *MailServer) {
+			log.Infof("listener %s accepting connections on %s", ms.Name, ms.server.Addr)
+			if err := ms.Serve(); err != nil {
+				errc <- fmt.Errorf("listener %s: %v", ms.Name, err)
+				return
+			}
+			errc <- nil
+		}(ms)
+	}
+
+	err := <-errc
+	if err != nil {
+		// One listener failing takes the daemon down
+		d.Shutdown(context.Background())
+	}
+	return err
+}
+
+// Shutdown Shuts all servers down concurrently. Returns the first error encountered
+func (d *Daemon) Shutdown(ctx context.Context) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, ms := range d.Servers {
+		wg.Add(1)
+		go func(ms *MailServer) {
+			defer wg.Done()
+			if err := ms.Shutdown(ctx); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("listener %s: %v", ms.Name, err)
+				}
+				mu.Unlock()
+			}
+		}(ms)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Stats Returns the counters of all servers added together
+func (d *Daemon) Stats() Stats {
+	var total Stats
+	for _, ms := range d.Servers {
+		stats := ms.Stats()
+		total.RejectedConnections += stats.RejectedConnections
+		total.ThrottledConnections += stats.ThrottledConnections
+		total.ThrottledMessages += stats.ThrottledMessages
+		total.DeferredMessages += stats.DeferredMessages
+	}
+	return total
+}
+
+// Recover Processes mail left in the spool by a previous run, i.e, after a crash. Each mail is handled
+// by the server of the listener that accepted it. Returns the number of mails processed.
+func (d *Daemon) Recover(spool Spool) (int, error) {
+	if len(d.Servers) == 0 {
+		return 0, fmt.Errorf("no SMTP listeners configured")
+	}
+	pending, err := spool.Pending()
+	if err != nil {
+		return 0, fmt.Errorf("error reading spool. %v", err)
+	}
+	for _, spooled := range pending {
+		ms := d.Servers[0]
+		for _, server := range d.Servers {
+			if server.Name == spooled.Listener {
+				ms = server
+				break
+			}
+		}
+		log.Infof("recovering spooled mail %s from %s received %s", spooled.ID, spooled.From, spooled.CreatedAt.Format(time.RFC3339))
+		ms.recover(spool, spooled)
+	}
+	return len(pending), nil
+}
@@ -0,0 +1,357 @@
+package mailing
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SharkFourSix/go-transact/utils"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Processed mail is flagged \Seen and left in the folder. Only unseen mail is fetched
+	IMAP_ACTION_FLAG = "flag"
+	// Processed mail is moved to ProcessedFolder. All mail in the folder is fetched
+	IMAP_ACTION_MOVE = "move"
+
+	DEFAULT_IMAP_FOLDER   = "INBOX"
+	DEFAULT_POLL_INTERVAL = time.Minute
+	// Wait between reconnection attempts
+	IMAP_RETRY_INTERVAL = 30 * time.Second
+)
+
+var IMAPActions = []string{IMAP_ACTION_FLAG, IMAP_ACTION_MOVE}
+
+// Fetches mail from an IMAP folder and processes it like mail received over SMTP.
+// Mail is marked as processed only after the handler has stored it, so nothing is lost if the poller stops or storing fails.
+type IMAPPoller struct {
+	// Used in logs and as the remote address of fetched mail
+	Name    string
+	Address string
+	// Connect with implicit TLS, i.e, port 993. Otherwise STARTTLS is required
+	TLS bool
+	// Log in without TLS when the server does not offer STARTTLS. The password is sent in plain text
+	Insecure bool
+	// Custom TLS settings, i.e, to trust a private CA. Nil uses the defaults
+	TLSConfig *tls.Config
+	Username  string
+	Password  string
+	Folder    string
+	// What to do with processed mail, see IMAPActions. Default = flag
+	ProcessedAction string
+	// Destination of the move action
+	ProcessedFolder string
+	PollInterval    time.Duration
+	// Wait for new mail with IDLE instead of polling, when the server supports it.
+	// PollInterval is still used as a safety net.
+	Idle bool
+	// Provides sender resolution, verification and the handler. Its SMTP settings are not used
+	Server *MailServer
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+var errPollerStopped = fmt.Errorf("poller stopped")
+
+func (p *IMAPPoller) init() {
+	p.once.Do(func() {
+		p.stop = make(chan struct{})
+		p.done = make(chan struct{})
+	})
+}
+
+func (p *IMAPPoller) folder() string {
+	if utils.IsStringEmpty(p.Folder) {
+		return DEFAULT_IMAP_FOLDER
+	}
+	return p.Folder
+}
+
+func (p *IMAPPoller) interval() time.Duration {
+	if p.PollInterval <= 0 {
+		return DEFAULT_POLL_INTERVAL
+	}
+	return p.PollInterval
+}
+
+func (p *IMAPPoller) action() string {
+	if utils.IsStringEmpty(p.ProcessedAction) {
+		return IMAP_ACTION_FLAG
+	}
+	return strings.ToLower(p.ProcessedAction)
+}
+
+// Start Fetches mail until the poller is shut down, reconnecting after errors
+func (p *IMAPPoller) Start() error {
+	p.init()
+	defer close(p.done)
+
+	if p.Server == nil {
+		return fmt.Errorf("IMAP poller %s has no server to process mail with", p.Name)
+	}
+	if p.action() == IMAP_ACTION_MOVE && utils.IsStringEmpty(p.ProcessedFolder) {
+		return fmt.Errorf("IMAP poller %s moves processed mail but has no processed folder", p.Name)
+	}
+
+	for {
+		err := p.session()
+		if err == errPollerStopped {
+			return nil
+		}
+		log.Errorf("IMAP poller %s: %v. Reconnecting in %s", p.Name, err, IMAP_RETRY_INTERVAL)
+		select {
+		case <-p.stop:
+			return nil
+		case <-time.After(IMAP_RETRY_INTERVAL):
+		}
+	}
+}
+
+// Shutdown Stops polling and waits for the message being processed, if any
+func (p *IMAPPoller) Shutdown(ctx context.Context) error {
+	p.init()
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("IMAP poller %s did not stop. %v", p.Name, ctx.Err())
+	}
+}
+
+func (p *IMAPPoller) stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *IMAPPoller) connect() (*client.Client, error) {
+	var (
+		c   *client.Client
+		err error
+	)
+	if p.TLS {
+		c, err = client.DialTLS(p.Address, p.TLSConfig)
+	} else {
+		c, err = client.Dial(p.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s. %v", p.Address, err)
+	}
+
+	if !p.TLS {
+		if ok, _ := c.SupportStartTLS(); ok {
+			if err := c.StartTLS(p.TLSConfig); err != nil {
+				c.Logout()
+				return nil, fmt.Errorf("STARTTLS failed. %v", err)
+			}
+		} else if !p.Insecure {
+			c.Logout()
+			return nil, fmt.Errorf("%s does not offer STARTTLS, refusing to send the password in plain text", p.Address)
+		} else {
+			log.Warnf("IMAP poller %s: %s does not offer STARTTLS, logging in without TLS", p.Name, p.Address)
+		}
+	}
+	if err := c.Login(p.Username, p.Password); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("login failed. %v", err)
+	}
+	if _, err := c.Select(p.folder(), false); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("error selecting folder %s. %v", p.folder(), err)
+	}
+	return c, nil
+}
+
+// Processes the folder, then waits for new mail, until an error occurs or the poller is stopped
+func (p *IMAPPoller) session() error {
+	updates := make(chan client.Update, 10)
+	newMail := make(chan struct{}, 1)
+
+	c, err := p.connect()
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+	log.Infof("IMAP poller %s: watching %s on %s", p.Name, p.folder(), p.Address)
+
+	if p.Idle {
+		// Updates must be read continuously or the client blocks
+		sessionDone := make(chan struct{})
+		defer close(sessionDone)
+		c.Updates = updates
+		go func() {
+			for {
+				select {
+				case update := <-updates:
+					if _, ok := update.(*client.MailboxUpdate); ok {
+						select {
+						case newMail <- struct{}{}:
+						default:
+						}
+					}
+				case <-sessionDone:
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		if err := p.poll(c); err != nil {
+			return err
+		}
+		if err := p.wait(c, newMail); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *IMAPPoller) wait(c *client.Client, newMail <-chan struct{}) error {
+	timer := time.NewTimer(p.interval())
+	defer timer.Stop()
+
+	if !p.Idle {
+		select {
+		case <-p.stop:
+			return errPollerStopped
+		case <-timer.C:
+			return nil
+		}
+	}
+
+	stopIdle := make(chan struct{})
+	idleDone := make(chan error, 1)
+	go func() {
+		idleDone <- c.Idle(stopIdle, &client.IdleOptions{PollInterval: p.interval()})
+	}()
+
+	var result error
+	select {
+	case <-p.stop:
+		result = errPollerStopped
+	case <-timer.C:
+	case <-newMail:
+	case err := <-idleDone:
+		return err
+	}
+	close(stopIdle)
+	if err := <-idleDone; err != nil {
+		return err
+	}
+	return result
+}
+
+// Fetches and processes every pending message in the folder
+func (p *IMAPPoller) poll(c *client.Client) error {
+	criteria := imap.NewSearchCriteria()
+	if p.action() == IMAP_ACTION_FLAG {
+		criteria.WithoutFlags = []string{imap.SeenFlag}
+	}
+	criteria.WithoutFlags = append(criteria.WithoutFlags, imap.DeletedFlag)
+
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return fmt.Errorf("search failed. %v", err)
+	}
+	if len(uids) > 0 {
+		log.Debugf("IMAP poller %s: %d new messages", p.Name, len(uids))
+	}
+
+	for _, uid := range uids {
+		if p.stopped() {
+			return errPollerStopped
+		}
+		raw, err := p.fetch(c, uid)
+		if err != nil {
+			return err
+		}
+		if err := p.process(uid, raw); err != nil {
+			log.Errorf("IMAP poller %s: message %d left for the next poll. %s", p.Name, uid, err.Error())
+			continue
+		}
+		if err := p.markProcessed(c, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *IMAPPoller) fetch(c *client.Client, uid uint32) ([]byte, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	section := &imap.BodySectionName{Peek: true}
+
+	messages := make(chan *imap.Message, 1)
+	if err := c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages); err != nil {
+		return nil, fmt.Errorf("error fetching message %d. %v", uid, err)
+	}
+	msg := <-messages
+	if msg == nil {
+		return nil, fmt.Errorf("message %d disappeared", uid)
+	}
+	body := msg.GetBody(section)
+	if body == nil {
+		return nil, fmt.Errorf("server returned no body for message %d", uid)
+	}
+	return ioutil.ReadAll(body)
+}
+
+// Runs the message through the server's pipeline. Messages that cannot be read or processed are logged and
+// marked as processed so they are not fetched forever.
+// Hands the message to the handler. Messages that cannot be read are skipped. Handler errors, i.e, the mail could
+// not be stored, are returned so the message is not marked processed and is fetched again
+func (p *IMAPPoller) process(uid uint32, raw []byte) error {
+	origin := stringAddr(fmt.Sprintf("imap://%s/%s", p.Address, p.folder()))
+	received, err := p.Server.receiveStored(origin, raw)
+	if err != nil {
+		log.Errorf("IMAP poller %s: skipping message %d. %s", p.Name, uid, err.Error())
+		return nil
+	}
+	return p.Server.handle(received)
+}
+
+func (p *IMAPPoller) markProcessed(c *client.Client, uid uint32) error {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	if p.action() == IMAP_ACTION_MOVE {
+		err := c.UidMove(seqset, p.ProcessedFolder)
+		if err != nil {
+			// Some servers advertise MOVE without supporting it for every folder
+			log.Debugf("IMAP poller %s: MOVE failed, copying instead. %v", p.Name, err)
+			err = c.UidCopy(seqset, p.ProcessedFolder)
+			if err == nil {
+				err = c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+			}
+			if err == nil {
+				err = c.Expunge(nil)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("error moving message %d to %s. %v", uid, p.ProcessedFolder, err)
+		}
+		return nil
+	}
+	flags := []interface{}{imap.SeenFlag}
+	if err := c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil); err != nil {
+		return fmt.Errorf("error flagging message %d. %v", uid, err)
+	}
+	return nil
+}
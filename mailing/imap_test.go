@@ -0,0 +1,200 @@
+package mailing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+)
+
+// Starts an IMAP server backed by memory, with a "username" user whose INBOX holds one seen message
+func startTestIMAPServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	go s.Serve(listener)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return listener.Addr().String()
+}
+
+func appendTestMessage(t *testing.T, address string, mailbox string, message string) {
+	c, err := client.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Append(mailbox, nil, time.Now(), bytes.NewBufferString(message)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mailboxStatus(t *testing.T, address string, mailbox string) *imap.MailboxStatus {
+	c, err := client.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	status, err := c.Status(mailbox, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestIMAPPoller(t *testing.T) {
+	const forwarded = "Return-Path: <SRS0=HHH=TT=bank.tld=alerts@forwarder.tld>\r\n" +
+		"Delivered-To: payments@go-transact.tld\r\n" + TEST_MESSAGE
+
+	for _, action := range IMAPActions {
+		t.Run(action, func(t *testing.T) {
+			address := startTestIMAPServer(t)
+			appendTestMessage(t, address, "INBOX", forwarded)
+
+			received := make(chan *ReceivedMail, 10)
+			poller := &IMAPPoller{
+				Name:            "test",
+				Address:         address,
+				Username:        "username",
+				Password:        "password",
+				Insecure:        true,
+				ProcessedAction: action,
+				ProcessedFolder: "INBOX",
+				PollInterval:    50 * time.Millisecond,
+				Server: &MailServer{
+					SenderResolver: &SenderResolver{Sources: []string{SENDER_SRS}},
+					Handler: func(mail *ReceivedMail) error {
+						received <- mail
+						return nil
+					},
+				},
+			}
+			if action == IMAP_ACTION_MOVE {
+				poller.Folder = "Alerts"
+				appendTestMessage(t, address, "INBOX", TEST_MESSAGE)
+				c, err := client.Dial(address)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.Login("username", "password")
+				c.Create("Alerts")
+				c.Logout()
+				appendTestMessage(t, address, "Alerts", forwarded)
+			}
+
+			go poller.Start()
+
+			select {
+			case mail := <-received:
+				if mail.Sender != "alerts@bank.tld" || mail.Subject != "Credit" || len(mail.To) != 1 || mail.To[0] != "payments@go-transact.tld" {
+					t.Errorf("message was not processed like SMTP mail: sender %s, subject %s, to %v", mail.Sender, mail.Subject, mail.To)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("message was not fetched")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if err := poller.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case mail := <-received:
+				t.Fatalf("message %s was processed twice or a seen message was fetched", mail.Subject)
+			default:
+			}
+
+			switch action {
+			case IMAP_ACTION_FLAG:
+				if status := mailboxStatus(t, address, "INBOX"); status.Unseen != 0 {
+					t.Errorf("processed message was not flagged, %d unseen", status.Unseen)
+				}
+			case IMAP_ACTION_MOVE:
+				if status := mailboxStatus(t, address, "Alerts"); status.Messages != 0 {
+					t.Errorf("processed message was not moved, %d left", status.Messages)
+				}
+			}
+		})
+	}
+}
+
+func TestIMAPHandlerFailure(t *testing.T) {
+	address := startTestIMAPServer(t)
+	appendTestMessage(t, address, "INBOX", TEST_MESSAGE)
+
+	calls := make(chan int, 10)
+	count := 0
+	poller := &IMAPPoller{
+		Name:         "test",
+		Address:      address,
+		Username:     "username",
+		Password:     "password",
+		Insecure:     true,
+		PollInterval: 50 * time.Millisecond,
+		Server: &MailServer{
+			Handler: func(mail *ReceivedMail) error {
+				count++
+				calls <- count
+				if count == 1 {
+					return fmt.Errorf("database is locked")
+				}
+				return nil
+			},
+		},
+	}
+	go poller.Start()
+
+	for _, expected := range []int{1, 2} {
+		select {
+		case call := <-calls:
+			if call != expected {
+				t.Fatalf("handler call %d, expected %d", call, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message the handler failed on was not fetched again")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := poller.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Error("stored message was fetched again")
+	}
+	if status := mailboxStatus(t, address, "INBOX"); status.Unseen != 0 {
+		t.Errorf("stored message was not flagged, %d unseen", status.Unseen)
+	}
+}
+
+func TestIMAPRequiresTLS(t *testing.T) {
+	poller := &IMAPPoller{Name: "test", Address: startTestIMAPServer(t), Username: "username", Password: "password"}
+	if c, err := poller.connect(); err == nil {
+		c.Logout()
+		t.Fatal("logged in without TLS")
+	}
+	poller.Insecure = true
+	c, err := poller.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Logout()
+}
@@ -0,0 +1,129 @@
+package mailing
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const RATE_WINDOW = time.Minute
+
+// Resource limits shared by every server of a daemon. Zero values disable the corresponding limit
+type Limits struct {
+	// Largest message accepted, in bytes. Advertised with the SIZE extension
+	MaxMessageSize int `yaml:"maxMessageSize"`
+	// Concurrent SMTP sessions across all listeners
+	MaxSessions int `yaml:"maxSessions"`
+	// New connections accepted from a single IP address per minute
+	ConnectionsPerMinute int `yaml:"connectionsPerMinute"`
+	// Messages accepted from a single IP address per minute
+	MessagesPerMinute int `yaml:"messagesPerMinute"`
+}
+
+// Enforces Limits. May be shared by several servers, the limits then apply to them together
+type Limiter struct {
+	Limits
+
+	sessions    int32
+	once        sync.Once
+	connections *rateLimiter
+	messages    *rateLimiter
+}
+
+func (l *Limiter) init() {
+	l.once.Do(func() {
+		l.connections = newRateLimiter(l.ConnectionsPerMinute, RATE_WINDOW)
+		l.messages = newRateLimiter(l.MessagesPerMinute, RATE_WINDOW)
+	})
+}
+
+// Reserves a session slot. The slot must be released with endSession if true is returned
+func (l *Limiter) beginSession() bool {
+	if l == nil {
+		return true
+	}
+	if n := atomic.AddInt32(&l.sessions, 1); l.MaxSessions > 0 && int(n) > l.MaxSessions {
+		atomic.AddInt32(&l.sessions, -1)
+		return false
+	}
+	return true
+}
+
+func (l *Limiter) endSession() {
+	if l != nil {
+		atomic.AddInt32(&l.sessions, -1)
+	}
+}
+
+func (l *Limiter) allowConnection(remoteAddr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	l.init()
+	ip := remoteIP(remoteAddr)
+	// Local clients, i.e, on a Unix socket, are not rate limited
+	if ip == nil {
+		return true
+	}
+	return l.connections.allow(ip.String(), time.Now())
+}
+
+func (l *Limiter) allowMessage(remoteAddr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	l.init()
+	ip := remoteIP(remoteAddr)
+	if ip == nil {
+		return true
+	}
+	return l.messages.allow(ip.String(), time.Now())
+}
+
+// Fixed window counter per key
+type rateLimiter struct {
+	limit     int
+	window    time.Duration
+	mu        sync.Mutex
+	counters  map[string]*rateCounter
+	lastPurge time.Time
+}
+
+type rateCounter struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, counters: map[string]*rateCounter{}}
+}
+
+func (r *rateLimiter) allow(key string, now time.Time) bool {
+	if r.limit <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Forget addresses that have been quiet for a whole window so the map does not grow forever
+	if now.Sub(r.lastPurge) > r.window {
+		for k, c := range r.counters {
+			if now.Sub(c.start) > r.window {
+				delete(r.counters, k)
+			}
+		}
+		r.lastPurge = now
+	}
+
+	counter, ok := r.counters[key]
+	if !ok || now.Sub(counter.start) > r.window {
+		counter = &rateCounter{start: now}
+		r.counters[key] = counter
+	}
+	if counter.count >= r.limit {
+		return false
+	}
+	counter.count++
+	return true
+}
@@ -0,0 +1,83 @@
+package mailing
+
+import (
+	"context"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var (
+		limiter = newRateLimiter(2, time.Minute)
+		now     = time.Now()
+	)
+	if !limiter.allow("192.0.2.1", now) || !limiter.allow("192.0.2.1", now) {
+		t.Fatal("requests within the limit were refused")
+	}
+	if limiter.allow("192.0.2.1", now) {
+		t.Fatal("request over the limit was allowed")
+	}
+	if !limiter.allow("192.0.2.2", now) {
+		t.Fatal("limit was applied across addresses")
+	}
+	if !limiter.allow("192.0.2.1", now.Add(2*time.Minute)) {
+		t.Fatal("limit was not reset after the window")
+	}
+	if len(limiter.counters) != 1 {
+		t.Errorf("expected stale counters to be purged, have %d", len(limiter.counters))
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var ms = &MailServer{
+		Limiter: &Limiter{Limits: Limits{MaxMessageSize: 512, MessagesPerMinute: 1}},
+	}
+	received := startTestServer(t, ms)
+	defer ms.Shutdown(context.Background())
+
+	send := func(message string) error {
+		client, err := smtp.Dial(TEST_SERVER_ADDRESS)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if err := client.Mail("alerts@bank.tld"); err != nil {
+			return err
+		}
+		if err := client.Rcpt("payments@go-transact.tld"); err != nil {
+			return err
+		}
+		w, err := client.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(message)); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	err := send(TEST_MESSAGE + strings.Repeat("x", 1024) + "\r\n")
+	if err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Fatalf("expected oversized message to be refused with 552, got %v", err)
+	}
+
+	if err := send(TEST_MESSAGE); err != nil {
+		t.Fatal(err)
+	}
+	err = send(TEST_MESSAGE)
+	if err == nil || !strings.HasPrefix(err.Error(), "4") {
+		t.Fatalf("expected a temporary failure once the message rate is exceeded, got %v", err)
+	}
+	if ms.Stats().ThrottledMessages != 1 {
+		t.Errorf("expected 1 throttled message, got %d", ms.Stats().ThrottledMessages)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message was not handed to the handler")
+	}
+}
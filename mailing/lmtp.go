@@ -0,0 +1,283 @@
+package mailing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/SharkFourSix/go-transact/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PROTOCOL_SMTP = "smtp"
+	// Local Mail Transfer Protocol (RFC 2033), i.e, for delivery from Postfix
+	PROTOCOL_LMTP = "lmtp"
+
+	NETWORK_TCP  = "tcp"
+	NETWORK_UNIX = "unix"
+)
+
+var (
+	Protocols = []string{PROTOCOL_SMTP, PROTOCOL_LMTP}
+
+	lmtpMailFromRegex = regexp.MustCompile(`(?i)^FROM:\s*<([^>]*)>(.*)$`)
+	lmtpRcptToRegex   = regexp.MustCompile(`(?i)^TO:\s*<([^>]+)>`)
+	lmtpSizeRegex     = regexp.MustCompile(`(?i)\bSIZE=(\d+)`)
+)
+
+func (ms *MailServer) lmtp() bool {
+	return strings.EqualFold(ms.Protocol, PROTOCOL_LMTP)
+}
+
+func (ms *MailServer) network() string {
+	if utils.IsStringEmpty(ms.Network) {
+		return NETWORK_TCP
+	}
+	return strings.ToLower(ms.Network)
+}
+
+func (ms *MailServer) maxMessageSize() int {
+	if ms.Limiter == nil {
+		return 0
+	}
+	return ms.Limiter.MaxMessageSize
+}
+
+func (ms *MailServer) listenLMTP() error {
+	if utils.IsStringEmpty(ms.Address) {
+		return fmt.Errorf("LMTP requires an address")
+	}
+	if ms.network() == NETWORK_UNIX {
+		// A socket left behind by a previous run would make the bind fail
+		if info, err := os.Stat(ms.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(ms.Address)
+		}
+	}
+	listener, err := net.Listen(ms.network(), ms.Address)
+	if err != nil {
+		return fmt.Errorf("failed to start LMTP deamon. %v", err)
+	}
+	ms.listeners = append(ms.listeners, &sessionListener{Listener: listener, ms: ms})
+	return nil
+}
+
+func (ms *MailServer) serveLMTP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		ms.lmtpWg.Add(1)
+		ms.lmtpConns.Store(conn, struct{}{})
+		go func() {
+			defer ms.lmtpWg.Done()
+			defer ms.lmtpConns.Delete(conn)
+			defer conn.Close()
+			ms.serveLMTPSession(conn)
+		}()
+	}
+}
+
+// Stops accepting connections and waits for open sessions. Idle sessions are closed right away,
+// messages being processed are finished first.
+func (ms *MailServer) shutdownLMTP(ctx context.Context) error {
+	atomic.StoreInt32(&ms.shutdown, 1)
+	ms.closeListeners()
+	ms.lmtpConns.Range(func(conn, _ interface{}) bool {
+		conn.(net.Conn).SetReadDeadline(time.Now())
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ms.lmtpWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ms *MailServer) serveLMTPSession(conn net.Conn) {
+	var (
+		text     = textproto.NewConn(conn)
+		origin   = conn.RemoteAddr()
+		hostname = ms.hostname()
+		greeted  bool
+		from     string
+		gotFrom  bool
+		to       []string
+	)
+	if origin == nil || utils.IsStringEmpty(origin.String()) || origin.String() == "@" {
+		origin = stringAddr("unix:" + ms.Address)
+	}
+
+	reply := func(format string, args ...interface{}) {
+		conn.SetWriteDeadline(time.Now().Add(SESSION_TIMEOUT))
+		text.PrintfLine(format, args...)
+	}
+	reset := func() {
+		from, gotFrom, to = "", false, nil
+	}
+
+	reply("220 %s %s LMTP Service Ready", hostname, APPLICATION_NAME)
+	for {
+		// shutdownLMTP sets the flag before it expires the deadline, so a session busy with a command while the
+		// server shuts down sees the flag here instead of waiting for the next command
+		conn.SetReadDeadline(time.Now().Add(SESSION_TIMEOUT))
+		if atomic.LoadInt32(&ms.shutdown) != 0 {
+			reply("421 4.3.2 %s Service shutting down", hostname)
+			return
+		}
+		line, err := text.ReadLine()
+		if err != nil {
+			if atomic.LoadInt32(&ms.shutdown) != 0 {
+				reply("421 4.3.2 %s Service shutting down", hostname)
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				reply("421 4.4.2 %s Service closing transmission channel after timeout exceeded", hostname)
+			}
+			return
+		}
+
+		verb, args := line, ""
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			verb, args = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			greeted = true
+			reset()
+			reply("250-%s greets %s", hostname, args)
+			reply("250-PIPELINING")
+			reply("250-ENHANCEDSTATUSCODES")
+			if size := ms.maxMessageSize(); size > 0 {
+				reply("250-SIZE %d", size)
+			}
+			reply("250 8BITMIME")
+		case "HELO", "EHLO":
+			reply("500 5.5.1 This is an LMTP server, use LHLO")
+		case "MAIL":
+			match := lmtpMailFromRegex.FindStringSubmatch(args)
+			switch {
+			case !greeted:
+				reply("503 5.5.1 Bad sequence of commands (LHLO required before MAIL)")
+			case gotFrom:
+				reply("503 5.5.1 Bad sequence of commands (nested MAIL command)")
+			case match == nil:
+				reply("501 5.5.4 Syntax error in parameters or arguments (invalid FROM parameter)")
+			default:
+				if size := lmtpSizeRegex.FindStringSubmatch(match[2]); size != nil && ms.maxMessageSize() > 0 {
+					if n, err := strconv.Atoi(size[1]); err == nil && n > ms.maxMessageSize() {
+						reply("552 5.3.4 Message size exceeds fixed maximum message size")
+						break
+					}
+				}
+				from, gotFrom = match[1], true
+				reply("250 2.1.0 Ok")
+			}
+		case "RCPT":
+			match := lmtpRcptToRegex.FindStringSubmatch(args)
+			switch {
+			case !gotFrom:
+				reply("503 5.5.1 Bad sequence of commands (MAIL required before RCPT)")
+			case match == nil:
+				reply("501 5.5.4 Syntax error in parameters or arguments (invalid TO parameter)")
+			case !ms.acceptRecipient(origin, from, match[1]):
+				reply("550 5.1.1 <%s> Requested action not taken: mailbox unavailable", match[1])
+			default:
+				to = append(to, match[1])
+				reply("250 2.1.5 Ok")
+			}
+		case "DATA":
+			if !gotFrom || len(to) == 0 {
+				reply("503 5.5.1 Bad sequence of commands (MAIL & RCPT required before DATA)")
+				break
+			}
+			reply("354 Start mail input; end with <CRLF>.<CRLF>")
+			data, err := ms.readLMTPData(text)
+			if err != nil {
+				if _, ok := err.(net.Error); ok {
+					return
+				}
+				for _, rcpt := range to {
+					reply("552 5.3.4 <%s> %s", rcpt, err.Error())
+				}
+				reset()
+				break
+			}
+
+			received := fmt.Sprintf("Received: from %s by %s (%s) with LMTP;\r\n\t%s\r\n",
+				origin.String(), hostname, APPLICATION_NAME, time.Now().Format(time.RFC1123Z))
+			err = ms.deliver(origin, from, to, append([]byte(received), data...))
+			if err != nil {
+				log.Debugf("%s: LMTP delivery failed. %s", origin.String(), err.Error())
+			}
+			// One reply per recipient. The message is processed once, so they all share the outcome
+			for _, rcpt := range to {
+				if err != nil {
+					reply("451 4.3.5 <%s> Unable to process mail", rcpt)
+				} else {
+					reply("250 2.0.0 <%s> Ok: queued", rcpt)
+				}
+			}
+			reset()
+		case "RSET":
+			reset()
+			reply("250 2.0.0 Ok")
+		case "NOOP":
+			reply("250 2.0.0 Ok")
+		case "VRFY":
+			reply("252 2.5.0 Cannot VRFY user, but will accept message and attempt delivery")
+		case "QUIT":
+			reply("221 2.0.0 %s Service closing transmission channel", hostname)
+			return
+		default:
+			reply("500 5.5.2 Syntax error, command unrecognized")
+		}
+	}
+}
+
+// Reads the dot terminated message. Oversized messages are read to the end and refused
+func (ms *MailServer) readLMTPData(text *textproto.Conn) ([]byte, error) {
+	reader := text.DotReader()
+	limit := ms.maxMessageSize()
+	if limit <= 0 {
+		data, err := ioutil.ReadAll(reader)
+		return toCRLF(data), err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Message size exceeds fixed maximum message size")
+	}
+	return toCRLF(data), nil
+}
+
+func (ms *MailServer) hostname() string {
+	if ms.server != nil && !utils.IsStringEmpty(ms.server.Hostname) {
+		return ms.server.Hostname
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "localhost"
+}
@@ -0,0 +1,154 @@
+package mailing
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLMTP(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "lmtp.sock")
+	received := make(chan *ReceivedMail, 10)
+
+	ms := &MailServer{
+		Protocol: PROTOCOL_LMTP,
+		Network:  NETWORK_UNIX,
+		Address:  socket,
+		Handler: func(mail *ReceivedMail) error {
+			received <- mail
+			return nil
+		},
+		SrcAddrVerifier: func(remoteAddr net.Addr, from string, to string) bool {
+			return strings.Split(to, "@")[0] == "payments"
+		},
+	}
+	if err := ms.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go ms.Serve()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	expect := func(command string, code int) string {
+		t.Helper()
+		if command != "" {
+			if err := text.PrintfLine("%s", command); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, message, err := text.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		return message
+	}
+
+	expect("", 220)
+	expect("HELO client", 500)
+	expect("LHLO client", 250)
+	expect("MAIL FROM:<alerts@bank.tld>", 250)
+	expect("RCPT TO:<payments@go-transact.tld>", 250)
+	expect("RCPT TO:<unknown@go-transact.tld>", 550)
+	expect("RCPT TO:<payments@other.tld>", 250)
+	expect("DATA", 354)
+
+	w := text.DotWriter()
+	w.Write([]byte(TEST_MESSAGE))
+	w.Close()
+
+	// One reply for each accepted recipient
+	if message := expect("", 250); !strings.Contains(message, "payments@go-transact.tld") {
+		t.Errorf("unexpected reply %s", message)
+	}
+	if message := expect("", 250); !strings.Contains(message, "payments@other.tld") {
+		t.Errorf("unexpected reply %s", message)
+	}
+
+	select {
+	case mail := <-received:
+		if mail.From != "alerts@bank.tld" || len(mail.To) != 2 {
+			t.Errorf("unexpected mail from %s to %v", mail.From, mail.To)
+		}
+		if mail.Subject != "Credit" {
+			t.Errorf("unexpected subject %s", mail.Subject)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mail was not handled")
+	}
+
+	// Idle sessions are told the server is going away
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ms.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect("", 421)
+}
+
+func TestLMTPShutdownDuringCommand(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "lmtp.sock")
+	verifying := make(chan struct{})
+	release := make(chan struct{})
+	ms := &MailServer{
+		Protocol: PROTOCOL_LMTP,
+		Network:  NETWORK_UNIX,
+		Address:  socket,
+		Handler:  func(mail *ReceivedMail) error { return nil },
+		SrcAddrVerifier: func(remoteAddr net.Addr, from string, to string) bool {
+			close(verifying)
+			<-release
+			return true
+		},
+	}
+	if err := ms.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go ms.Serve()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := textproto.NewConn(conn)
+	defer text.Close()
+	for _, command := range []string{"LHLO client", "MAIL FROM:<alerts@bank.tld>", "RCPT TO:<payments@go-transact.tld>"} {
+		if err := text.PrintfLine("%s", command); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The server shuts down while the session is busy with RCPT
+	<-verifying
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- ms.Shutdown(ctx)
+	}()
+	for atomic.LoadInt32(&ms.shutdown) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	// Without the check the session waits for the next command until SESSION_TIMEOUT
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, code := range []int{220, 250, 250, 250, 421} {
+		if _, _, err := text.ReadResponse(code); err != nil {
+			t.Fatalf("expected %d. %v", code, err)
+		}
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("session kept the server from shutting down. %v", err)
+	}
+}
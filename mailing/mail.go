@@ -3,10 +3,14 @@ package mailing
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/mail"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/SharkFourSix/go-transact/utils"
@@ -16,20 +20,102 @@ import (
 
 const (
 	APPLICATION_NAME = "go-transact-smtpd"
+	DEFAULT_ADDRESS  = ":25"
+	SESSION_TIMEOUT  = 5 * time.Minute
 )
 
-type EmailReceivedHandler func(ip net.Addr, from string, to []string, subject string, data string)
+// Mail accepted by the server along with everything learned while receiving it
+type ReceivedMail struct {
+	RemoteAddr net.Addr
+	// Envelope sender (MAIL FROM)
+	From string
+	// Original sender, as determined by the server's SenderResolver. Same as From if there is none
+	Sender string
+	// Source Sender was taken from, see SenderSources
+	SenderSource string
+	// Envelope recipients (RCPT TO)
+	To      []string
+	Subject string
+	Body    string
+	// Complete message as received, including headers
+	Raw []byte
+	// Message forwarded as an attachment, when Sender, Subject and Body were taken from it
+	Attached []byte
+	// Negotiated TLS version, i.e, "TLS 1.3". Empty if the connection was not encrypted
+	TLSVersion string
+	// Sender authentication results. Nil when verification is disabled
+	Verification *Verification
+	// Called with the handler's result once it has returned, i.e, to remove the spooled copy
+	done func(err error)
+}
+
+// Signals that the mail has been processed. A non-nil err keeps the spooled copy so the mail is processed again
+func (m *ReceivedMail) finish(err error) {
+	if m.done != nil {
+		m.done(err)
+	}
+}
+
+// Processes received mail. Returning an error, i.e, when the mail could not be stored, keeps the spooled copy
+// so the mail is processed again after a restart
+type EmailReceivedHandler func(mail *ReceivedMail) error
 type SourceAddressVerier func(remoteAddr net.Addr, from string, to string) bool
 
 type MailServer struct {
-	Address         string
-	Handler         EmailReceivedHandler
+	// Must be the first field for 64-bit alignment of the atomic counters
+	stats Stats
+	// Used in logs to tell listeners apart
+	Name string
+	// Protocol spoken by the server, see Protocols. Default = smtp
+	Protocol string
+	// Network of Address, "tcp" or "unix". Default = tcp
+	Network string
+	Address string
+	// Address only accepts TLS connections, i.e, port 465
+	ImplicitTLS bool
+	// Mailboxes accepted by this server, see MatchMailbox. Empty = all mailboxes accepted by SrcAddrVerifier
+	Mailboxes []string
+	// Called with every accepted mail. Ignored when Pool is set
+	Handler EmailReceivedHandler
+	// Processes accepted mail. Mail is handed to Handler in a new goroutine if nil. May be shared by several servers
+	Pool            *WorkerPool
 	SrcAddrVerifier SourceAddressVerier
 	UseTLS          bool
+	// STARTTLS policy, see TLSPolicies. Overrides UseTLS when set
+	TLSPolicy string
+	// Address of an additional listener accepting TLS connections only, i.e, ":465"
+	ImplicitTLSAddress string
+	// Minimum TLS version, i.e, "1.2"
+	TLSMinVersion string
+	// Allowed cipher suites for TLS 1.2 and lower. Empty = Go defaults
+	TLSCipherSuites []string
 	CertificateFile string
 	KeyFile         string
 	KeyPassphrase   string
-	server          *smtpd.Server
+	// SMTP AUTH mechanisms to offer. Authentication is disabled if empty
+	AuthMechanisms []string
+	// Require clients to authenticate before MAIL FROM and RCPT TO
+	AuthRequired bool
+	// Offer PLAIN and LOGIN over connections that are not using TLS
+	AllowInsecureAuth bool
+	Credentials       []Credential
+	// Verifies DKIM, SPF and DMARC of received mail. Verification is disabled if nil
+	Verifier *Verifier
+	// Determines the original sender of forwarded mail. The envelope sender is used if nil
+	SenderResolver *SenderResolver
+	// Durable storage written before mail is acknowledged. Mail is only kept in memory if nil
+	Spool Spool
+	// Size, session and rate limits. Nil disables all limits. May be shared by several servers
+	Limiter *Limiter
+	// Networks allowed to connect. Nil allows everyone
+	Allowlist *Allowlist
+	server    *smtpd.Server
+	listeners []net.Listener
+	// Open LMTP connections, smtpd keeps track of its own
+	lmtpConns sync.Map
+	lmtpWg    sync.WaitGroup
+	sessions  sync.Map
+	shutdown  int32
 }
 
 // Any mail that does not match a defined template will be treated as spam
@@ -43,47 +129,156 @@ type SpamMail struct {
 }
 
 type TransactionEmail struct {
-	ID         string `gorm:"primaryKey"`
-	CreatedAt  time.Time
-	Body       string
-	IpAddress  string
-	Subject    string
-	From       string
-	Recipients string
+	ID           string `gorm:"primaryKey"`
+	CreatedAt    time.Time
+	Body         string
+	IpAddress    string
+	Subject      string
+	From         string
+	Sender       string
+	SenderSource string
+	Recipients   string
+	DkimResult   string
+	DkimDomains  string
+	SpfResult    string
+	DmarcResult  string
+	TlsVersion   string
 }
 
-func (ms *MailServer) Start() error {
-	handler := func(origin net.Addr, from string, to []string, data []byte) error {
-		msg, err := mail.ReadMessage(bytes.NewReader(data))
+// Parses a message and determines its sender and authentication results
+func (ms *MailServer) receive(origin net.Addr, from string, to []string, data []byte, tlsVersion string) (*ReceivedMail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
 
-		if err != nil {
-			log.Errorf("error reading email from address %s. %s", origin.String(), err.Error())
-			return err
+	if err != nil {
+		log.Errorf("error reading email from address %s. %s", origin.String(), err.Error())
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		log.Errorf("error reading email from address %s. %s", origin.String(), err.Error())
+		return nil, err
+	}
+
+	received := &ReceivedMail{
+		RemoteAddr:   origin,
+		From:         from,
+		Sender:       from,
+		SenderSource: SENDER_ENVELOPE,
+		To:           to,
+		Subject:      msg.Header.Get("Subject"),
+		Body:         string(body[:]),
+		Raw:          data,
+		TLSVersion:   tlsVersion,
+	}
+
+	if ms.SenderResolver != nil {
+		ms.SenderResolver.Resolve(received, msg.Header)
+	}
+
+	if ms.Verifier != nil {
+		if received.Attached != nil {
+			// The forwarder's signatures say nothing about the attached message, verify its own instead
+			attached, err := mail.ReadMessage(bytes.NewReader(received.Attached))
+			if err == nil {
+				received.Verification = ms.Verifier.Verify(origin, "", received.Attached, attached.Header)
+			}
+		} else {
+			received.Verification = ms.Verifier.Verify(origin, from, data, msg.Header)
 		}
+	}
+	return received, nil
+}
 
-		body, err := ioutil.ReadAll(msg.Body)
-		if err != nil {
-			log.Errorf("error reading email from address %s. %s", origin.String(), err.Error())
-			return err
+// Hands the mail to the handler and waits for it to return
+func (ms *MailServer) handle(received *ReceivedMail) error {
+	if ms.Pool != nil {
+		return runHandler(ms.Pool.Handler, received)
+	}
+	return runHandler(ms.Handler, received)
+}
+
+// Runs the handler, turning a panic into an error
+func runHandler(handler EmailReceivedHandler, received *ReceivedMail) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked. %v", r)
 		}
+	}()
+	return handler(received)
+}
 
-		message := string(body[:])
-		subject := msg.Header.Get("Subject")
+// Remote address of mail that did not arrive over an SMTP connection, i.e, spooled or fetched mail.
+// Handlers only use its string form
+type stringAddr string
 
-		go ms.Handler(origin, from, to, subject, message)
+func (a stringAddr) Network() string {
+	return "tcp"
+}
 
+func (a stringAddr) String() string {
+	return string(a)
+}
+
+// Accepts a message for processing. Returning an error makes the client retry later
+func (ms *MailServer) deliver(origin net.Addr, from string, to []string, data []byte) error {
+	if !ms.Limiter.allowMessage(origin) {
+		atomic.AddUint64(&ms.stats.ThrottledMessages, 1)
+		log.Warnf("%s: message from %s rejected, message rate exceeded", origin.String(), from)
+		return fmt.Errorf("message rate exceeded")
+	}
+
+	received, err := ms.receive(origin, from, to, data, utils.TLSVersionName(ms.session(origin).tlsVersion))
+	if err != nil {
+		return err
+	}
+
+	if ms.Spool != nil {
+		if err := ms.spool(received); err != nil {
+			log.Errorf("%s: failed to spool message from %s. %s", origin.String(), from, err.Error())
+			return err
+		}
+	}
+
+	if ms.Pool == nil {
+		go func() {
+			err := runHandler(ms.Handler, received)
+			if err != nil {
+				log.Errorf("%s: failed to process mail from %s. %s", origin.String(), received.Sender, err.Error())
+			}
+			received.finish(err)
+		}()
 		return nil
 	}
+	if !ms.Pool.Submit(received) {
+		atomic.AddUint64(&ms.stats.DeferredMessages, 1)
+		log.Warnf("%s: message from %s deferred, processing queue is full", origin.String(), from)
+		// The sender will retry, do not process the spooled copy as well
+		received.finish(nil)
+		return fmt.Errorf("processing queue is full")
+	}
+	return nil
+}
 
-	authHandler := func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
-		return false, fmt.Errorf("not supported")
+// Decides whether mail from the sender may be delivered to the recipient
+func (ms *MailServer) acceptRecipient(remoteAddr net.Addr, from string, to string) bool {
+	if !ms.acceptsMailbox(remoteAddr, to) || !ms.authorizeRecipient(remoteAddr, to) {
+		return false
 	}
+	return ms.SrcAddrVerifier(remoteAddr, from, to)
+}
 
-	handlerRcpt := func(remoteAddr net.Addr, from string, to string) bool {
-		return ms.SrcAddrVerifier(remoteAddr, from, to)
+// Start Binds the listeners and serves SMTP until the server is shut down
+func (ms *MailServer) Start() error {
+	if err := ms.Listen(); err != nil {
+		return err
 	}
+	return ms.Serve()
+}
 
-	if ms.Handler == nil {
+// Listen Configures the server and binds its listeners without accepting connections yet
+func (ms *MailServer) Listen() error {
+	if ms.Handler == nil && ms.Pool == nil {
 		panic(fmt.Errorf("a handler is required"))
 	}
 
@@ -91,34 +286,110 @@ func (ms *MailServer) Start() error {
 		panic(fmt.Errorf("a source address verifier handler is required"))
 	}
 
+	if ms.lmtp() {
+		return ms.listenLMTP()
+	}
+
 	var err error
 	ms.server = &smtpd.Server{
 		Addr:        ms.Address,
 		Appname:     APPLICATION_NAME,
-		Handler:     handler,
-		HandlerRcpt: handlerRcpt,
-		AuthHandler: authHandler,
+		Handler:     ms.deliver,
+		HandlerRcpt: ms.acceptRecipient,
+		Timeout:     SESSION_TIMEOUT,
+	}
+	if ms.Limiter != nil {
+		ms.server.MaxSize = ms.Limiter.MaxMessageSize
 	}
 
-	if ms.UseTLS {
-		if utils.IsStringEmpty(ms.CertificateFile) || utils.IsStringEmpty(ms.KeyFile) {
-			return fmt.Errorf("certificate or key file missing")
+	if len(ms.AuthMechanisms) > 0 {
+		if len(ms.Credentials) == 0 {
+			return fmt.Errorf("authentication enabled without credentials")
 		}
-		if utils.IsStringEmpty(ms.KeyPassphrase) {
-			err = ms.server.ConfigureTLS(ms.CertificateFile, ms.KeyFile)
-		} else {
-			err = ms.server.ConfigureTLSWithPassphrase(ms.CertificateFile, ms.KeyFile, ms.KeyPassphrase)
+		ms.server.AuthHandler = ms.authenticate
+		ms.server.AuthMechs = ms.authMechanisms()
+		ms.server.AuthRequired = ms.AuthRequired
+	} else if ms.AuthRequired {
+		return fmt.Errorf("authentication required but no mechanisms enabled")
+	}
+
+	if utils.IsStringEmpty(ms.server.Addr) {
+		ms.server.Addr = DEFAULT_ADDRESS
+	}
+	if ms.server.Hostname, err = os.Hostname(); err != nil {
+		return fmt.Errorf("error resolving hostname. %v", err)
+	}
+
+	tlsConfig, err := ms.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", ms.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to start SMTP deamon. %v", err)
+	}
+	if ms.ImplicitTLS {
+		if tlsConfig == nil {
+			listener.Close()
+			return fmt.Errorf("implicit TLS listener %s requires a certificate", ms.server.Addr)
 		}
+		ms.listeners = append(ms.listeners, tls.NewListener(&sessionListener{Listener: listener, ms: ms}, tlsConfig))
+	} else {
+		ms.listeners = append(ms.listeners, &sessionListener{Listener: listener, ms: ms})
+	}
+
+	if !utils.IsStringEmpty(ms.ImplicitTLSAddress) {
+		listener, err := net.Listen("tcp", ms.ImplicitTLSAddress)
 		if err != nil {
-			return fmt.Errorf("error configuring TLS. %v", err)
+			ms.closeListeners()
+			return fmt.Errorf("failed to start SMTP deamon. %v", err)
 		}
+		// Sessions must wrap the raw connection so smtpd sees a *tls.Conn
+		ms.listeners = append(ms.listeners, tls.NewListener(&sessionListener{Listener: listener, ms: ms}, tlsConfig))
 	}
-	if err = ms.server.ListenAndServe(); err != nil {
+
+	return nil
+}
+
+// Serve Accepts connections on the listeners bound by Listen until the server is shut down
+func (ms *MailServer) Serve() error {
+	errc := make(chan error, len(ms.listeners))
+	for _, listener := range ms.listeners {
+		go func(listener net.Listener) {
+			if ms.lmtp() {
+				errc <- ms.serveLMTP(listener)
+			} else {
+				errc <- ms.server.Serve(listener)
+			}
+		}(listener)
+	}
+	if err := <-errc; err != nil {
+		if atomic.LoadInt32(&ms.shutdown) != 0 {
+			return nil
+		}
+		ms.closeListeners()
 		return fmt.Errorf("failed to start SMTP deamon. %v", err)
 	}
 	return nil
 }
 
+func (ms *MailServer) closeListeners() {
+	for _, listener := range ms.listeners {
+		listener.Close()
+	}
+}
+
 func (ms *MailServer) Shutdown(ctx context.Context) error {
-	return ms.server.Shutdown(ctx)
+	if ms.lmtp() {
+		return ms.shutdownLMTP(ctx)
+	}
+	if ms.server == nil {
+		return nil
+	}
+	atomic.StoreInt32(&ms.shutdown, 1)
+	err := ms.server.Shutdown(ctx)
+	// smtpd only checks for shutdown between connections, close the listeners to stop accepting immediately
+	ms.closeListeners()
+	return err
 }
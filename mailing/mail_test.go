@@ -0,0 +1,300 @@
+package mailing
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_SERVER_ADDRESS       = "127.0.0.1:45925"
+	TEST_IMPLICIT_TLS_ADDRESS = "127.0.0.1:45926"
+	TEST_MESSAGE              = "From: alerts@bank.tld\r\nTo: payments@go-transact.tld\r\nSubject: Credit\r\n\r\nHello\r\n"
+)
+
+// Starts a mail server accepting the "payments" and "refunds" mailboxes and waits until it is listening
+func startTestServer(t *testing.T, ms *MailServer) chan *ReceivedMail {
+	received := make(chan *ReceivedMail, 10)
+
+	ms.Address = TEST_SERVER_ADDRESS
+	ms.Handler = func(mail *ReceivedMail) error {
+		received <- mail
+		return nil
+	}
+	ms.SrcAddrVerifier = func(remoteAddr net.Addr, from string, to string) bool {
+		mailbox := strings.Split(to, "@")[0]
+		return mailbox == "payments" || mailbox == "refunds"
+	}
+
+	go func() {
+		if err := ms.Start(); err != nil {
+			t.Log(err)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", TEST_SERVER_ADDRESS); err == nil {
+			conn.Close()
+			return received
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("mail server did not start")
+	return nil
+}
+
+func sendTestMessage(client *smtp.Client, to string) error {
+	if err := client.Mail("alerts@bank.tld"); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(TEST_MESSAGE)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func TestAuthentication(t *testing.T) {
+	var ms = &MailServer{
+		AuthMechanisms:    []string{AUTH_PLAIN, AUTH_CRAM_MD5},
+		AuthRequired:      true,
+		AllowInsecureAuth: true,
+		Credentials: []Credential{
+			{
+				Username: "relay",
+				// bcrypt hash of "s3cret"
+				PasswordHash: "$2a$04$kpqJMv5pp3jtBDU/v2aXPe1HbXwQTKRAXh6o1.sn9SoduNU0T/LL2",
+				Secret:       "cram-s3cret",
+				Mailboxes:    []string{"payments"},
+			},
+		},
+	}
+	received := startTestServer(t, ms)
+	defer ms.Shutdown(context.Background())
+
+	send := func(auth smtp.Auth, to string) error {
+		client, err := smtp.Dial(TEST_SERVER_ADDRESS)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if auth != nil {
+			if err := client.Auth(auth); err != nil {
+				return err
+			}
+		}
+		return sendTestMessage(client, to)
+	}
+
+	if err := send(nil, "payments@go-transact.tld"); err == nil {
+		t.Fatal("unauthenticated client was accepted")
+	}
+
+	if err := send(smtp.PlainAuth("", "relay", "wrong", "127.0.0.1"), "payments@go-transact.tld"); err == nil {
+		t.Fatal("wrong password was accepted")
+	}
+
+	if err := send(smtp.PlainAuth("", "relay", "s3cret", "127.0.0.1"), "refunds@go-transact.tld"); err == nil {
+		t.Fatal("credential delivered to a mailbox it is not allowed to use")
+	}
+
+	if err := send(smtp.PlainAuth("", "relay", "s3cret", "127.0.0.1"), "payments@go-transact.tld"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := send(smtp.CRAMMD5Auth("relay", "cram-s3cret"), "payments@go-transact.tld"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("message was not handed to the handler")
+		}
+	}
+}
+
+// Writes a self signed certificate for 127.0.0.1 and returns the certificate and key file paths
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-transact test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSPolicy(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	var ms = &MailServer{
+		TLSPolicy:          TLS_POLICY_REQUIRED,
+		ImplicitTLSAddress: TEST_IMPLICIT_TLS_ADDRESS,
+		TLSMinVersion:      "1.2",
+		CertificateFile:    certFile,
+		KeyFile:            keyFile,
+	}
+	received := startTestServer(t, ms)
+	defer ms.Shutdown(context.Background())
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+
+	client, err := smtp.Dial(TEST_SERVER_ADDRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Mail("alerts@bank.tld"); err == nil || !strings.HasPrefix(err.Error(), "530") {
+		t.Fatalf("MAIL FROM accepted before STARTTLS: %v", err)
+	}
+	if err := client.StartTLS(tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendTestMessage(client, "payments@go-transact.tld"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tls.Dial("tcp", TEST_IMPLICIT_TLS_ADDRESS, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = smtp.NewClient(conn, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendTestMessage(client, "payments@go-transact.tld"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"TLS 1.2", "TLS 1.3"} {
+		select {
+		case mail := <-received:
+			if mail.TLSVersion != expected {
+				t.Errorf("expected %s to be recorded, got '%s'", expected, mail.TLSVersion)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message was not handed to the handler")
+		}
+	}
+
+	if _, err := tls.Dial("tcp", TEST_IMPLICIT_TLS_ADDRESS, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}); err == nil {
+		t.Error("TLS 1.1 handshake succeeded below the minimum version")
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	var (
+		received = make(chan *ReceivedMail, 10)
+		handler  = func(mail *ReceivedMail) error {
+			received <- mail
+			return nil
+		}
+		verifier = func(remoteAddr net.Addr, from string, to string) bool {
+			return true
+		}
+		daemon = &Daemon{Servers: []*MailServer{
+			{Name: "public", Address: TEST_SERVER_ADDRESS, Mailboxes: []string{"payments"}, Handler: handler, SrcAddrVerifier: verifier},
+			{Name: "internal", Address: TEST_IMPLICIT_TLS_ADDRESS, Handler: handler, SrcAddrVerifier: verifier},
+		}}
+	)
+
+	go func() {
+		if err := daemon.Start(); err != nil {
+			t.Log(err)
+		}
+	}()
+	defer daemon.Shutdown(context.Background())
+
+	send := func(address string, to string) error {
+		var (
+			client *smtp.Client
+			err    error
+		)
+		for i := 0; i < 50; i++ {
+			if client, err = smtp.Dial(address); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		return sendTestMessage(client, to)
+	}
+
+	if err := send(TEST_SERVER_ADDRESS, "refunds@go-transact.tld"); err == nil {
+		t.Fatal("listener accepted a mailbox it is not configured for")
+	}
+	if err := send(TEST_SERVER_ADDRESS, "payments@go-transact.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(TEST_IMPLICIT_TLS_ADDRESS, "refunds@go-transact.tld"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("message was not handed to the handler")
+		}
+	}
+
+	// A listener that cannot bind must not leave the others running
+	failing := &Daemon{Servers: []*MailServer{
+		{Name: "free", Address: "127.0.0.1:45927", Handler: handler, SrcAddrVerifier: verifier},
+		{Name: "taken", Address: TEST_SERVER_ADDRESS, Handler: handler, SrcAddrVerifier: verifier},
+	}}
+	if err := failing.Start(); err == nil {
+		t.Fatal("daemon started with an address already in use")
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1:45927"); err == nil {
+		conn.Close()
+		t.Fatal("listener was left open after a failed start")
+	}
+}
@@ -0,0 +1,98 @@
+package mailing
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Splits an address into its local part and domain, both lower case. The domain is empty if there is none
+func splitAddress(address string) (string, string) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[:i], address[i+1:]
+	}
+	return address, ""
+}
+
+// Removes the +tag from a plus-addressed local part, i.e, payments+nbm becomes payments
+func baseMailbox(local string) string {
+	if i := strings.Index(local, "+"); i > 0 {
+		return local[:i]
+	}
+	return local
+}
+
+// MatchMailbox Checks a recipient address against a mailbox pattern.
+//
+//	The pattern is a local part, i.e, payments, or a full address, i.e, payments@go-transact.tld, and either part
+//	may use the wildcards of path.Match (*, ? and [...]). A pattern without a domain matches any domain.
+//	Plus-addressed recipients, i.e, payments+nbm, also match the pattern of their base mailbox.
+func MatchMailbox(pattern string, address string) bool {
+	patternLocal, patternDomain := splitAddress(pattern)
+	local, domain := splitAddress(address)
+
+	if patternDomain != "" && !MatchDomain(patternDomain, domain) {
+		return false
+	}
+	if ok, _ := path.Match(patternLocal, local); ok {
+		return true
+	}
+	if base := baseMailbox(local); base != local {
+		ok, _ := path.Match(patternLocal, base)
+		return ok
+	}
+	return false
+}
+
+// MatchAnyMailbox Checks a recipient address against a list of mailbox patterns, see MatchMailbox
+func MatchAnyMailbox(patterns []string, address string) bool {
+	for _, pattern := range patterns {
+		if MatchMailbox(pattern, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchDomain Checks a domain against a pattern such as go-transact.tld or *.go-transact.tld, ignoring case
+func MatchDomain(pattern string, domain string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(domain))
+	return ok
+}
+
+// MatchAnyDomain Checks the domain of a recipient address against a list of domain patterns, see MatchDomain
+func MatchAnyDomain(patterns []string, address string) bool {
+	_, domain := splitAddress(address)
+	for _, pattern := range patterns {
+		if MatchDomain(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateMailboxPattern Checks that a mailbox pattern is well formed
+func ValidateMailboxPattern(pattern string) error {
+	local, domain := splitAddress(pattern)
+	if local == "" {
+		return fmt.Errorf("mailbox '%s' has no local part", pattern)
+	}
+	if strings.Count(pattern, "@") > 1 {
+		return fmt.Errorf("mailbox '%s' contains more than one @", pattern)
+	}
+	if strings.Contains(pattern, "@") && domain == "" {
+		return fmt.Errorf("mailbox '%s' has an empty domain", pattern)
+	}
+	for _, part := range []string{local, domain} {
+		if _, err := path.Match(part, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s'. %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// IsMailboxPattern Reports whether a mailbox uses wildcards
+func IsMailboxPattern(mailbox string) bool {
+	return strings.ContainsAny(mailbox, "*?[")
+}
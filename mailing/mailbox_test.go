@@ -0,0 +1,43 @@
+package mailing
+
+import "testing"
+
+func TestMatchMailbox(t *testing.T) {
+	cases := []struct {
+		pattern string
+		address string
+		match   bool
+	}{
+		{"payments", "payments@go-transact.tld", true},
+		{"payments", "Payments@other.tld", true},
+		{"payments", "refunds@go-transact.tld", false},
+		{"payments", "payments+nbm@go-transact.tld", true},
+		{"payments+nbm", "payments+nbm@go-transact.tld", true},
+		{"payments+nbm", "payments+fdh@go-transact.tld", false},
+		{"payments+nbm", "payments@go-transact.tld", false},
+		{"pay*", "payments@go-transact.tld", true},
+		{"alerts-?", "alerts-1@go-transact.tld", true},
+		{"payments@go-transact.tld", "payments@go-transact.tld", true},
+		{"payments@go-transact.tld", "payments@other.tld", false},
+		{"*@*.go-transact.tld", "anything@mw.go-transact.tld", true},
+		{"*@*.go-transact.tld", "anything@go-transact.tld", false},
+	}
+	for _, c := range cases {
+		if got := MatchMailbox(c.pattern, c.address); got != c.match {
+			t.Errorf("MatchMailbox(%s, %s) = %t, expected %t", c.pattern, c.address, got, c.match)
+		}
+	}
+
+	if !MatchAnyDomain([]string{"other.tld", "*.go-transact.tld"}, "payments@MW.go-transact.tld") {
+		t.Error("domain did not match")
+	}
+	if MatchAnyDomain([]string{"go-transact.tld"}, "payments@other.tld") {
+		t.Error("unexpected domain match")
+	}
+
+	for _, pattern := range []string{"", "@go-transact.tld", "a@b@c", "payments@", "pay[ments"} {
+		if err := ValidateMailboxPattern(pattern); err == nil {
+			t.Errorf("pattern '%s' was accepted", pattern)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package mailing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_WORKERS    = 4
+	DEFAULT_QUEUE_SIZE = 100
+)
+
+// Processes received mail with a fixed number of goroutines. Mail is queued until a worker is free;
+// when the queue is full, servers refuse new mail with a temporary failure so the sender retries later.
+type WorkerPool struct {
+	Workers   int
+	QueueSize int
+	Handler   EmailReceivedHandler
+
+	queue   chan *ReceivedMail
+	wg      sync.WaitGroup
+	mu      sync.RWMutex
+	started bool
+	closed  bool
+	pending int64
+}
+
+// Start Starts the workers. Must be called before mail is submitted
+func (p *WorkerPool) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.started {
+		return
+	}
+	if p.Handler == nil {
+		panic(fmt.Errorf("a handler is required"))
+	}
+	workers, size := p.Workers, p.QueueSize
+	if workers <= 0 {
+		workers = DEFAULT_WORKERS
+	}
+	if size <= 0 {
+		size = DEFAULT_QUEUE_SIZE
+	}
+	p.queue = make(chan *ReceivedMail, size)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	p.started = true
+}
+
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	for received := range p.queue {
+		p.handle(received)
+		atomic.AddInt64(&p.pending, -1)
+	}
+}
+
+func (p *WorkerPool) handle(received *ReceivedMail) {
+	err := runHandler(p.Handler, received)
+	if err != nil {
+		log.Errorf("%s: failed to process mail from %s. %s", received.RemoteAddr.String(), received.Sender, err.Error())
+	}
+	received.finish(err)
+}
+
+// Submit Queues the mail without blocking. Returns false if the queue is full or the pool is shut down
+func (p *WorkerPool) Submit(received *ReceivedMail) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.started || p.closed {
+		return false
+	}
+	select {
+	case p.queue <- received:
+		atomic.AddInt64(&p.pending, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+// Pending Returns the number of queued and in-flight messages
+func (p *WorkerPool) Pending() int64 {
+	return atomic.LoadInt64(&p.pending)
+}
+
+// Shutdown Stops accepting mail and waits for queued and in-flight mail to be processed.
+// Returns an error if the context expires first.
+func (p *WorkerPool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.started || p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d messages were not processed. %v", p.Pending(), ctx.Err())
+	}
+}
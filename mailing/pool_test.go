@@ -0,0 +1,102 @@
+package mailing
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	var (
+		release   = make(chan struct{})
+		processed = make(chan *ReceivedMail, 10)
+		pool      = &WorkerPool{
+			Workers:   1,
+			QueueSize: 1,
+			Handler: func(mail *ReceivedMail) error {
+				<-release
+				processed <- mail
+				return nil
+			},
+		}
+		mail = &ReceivedMail{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 25}}
+	)
+
+	if pool.Submit(mail) {
+		t.Fatal("mail was accepted before the pool was started")
+	}
+	pool.Start()
+
+	if !pool.Submit(mail) {
+		t.Fatal("mail was refused by an idle pool")
+	}
+	// Wait for the worker to pick up the first mail so the second one sits in the queue
+	for i := 0; i < 50 && len(pool.queue) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !pool.Submit(mail) {
+		t.Fatal("mail was refused while the queue had room")
+	}
+	if pool.Submit(mail) {
+		t.Fatal("mail was accepted while the queue was full")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pool.Shutdown(ctx); err == nil {
+		t.Fatal("shutdown returned before queued mail was processed")
+	}
+	if pool.Submit(mail) {
+		t.Fatal("mail was accepted after shutdown")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-processed:
+		case <-time.After(time.Second):
+			t.Fatal("queued mail was not drained")
+		}
+	}
+	if pool.Pending() != 0 {
+		t.Errorf("expected no pending mail, have %d", pool.Pending())
+	}
+}
+
+func TestWorkerPoolBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	var ms = &MailServer{
+		Pool: &WorkerPool{
+			Workers:   1,
+			QueueSize: 1,
+			Handler: func(mail *ReceivedMail) error {
+				<-release
+				return nil
+			},
+		},
+	}
+	ms.Pool.Start()
+	startTestServer(t, ms)
+	defer ms.Shutdown(context.Background())
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		var client *smtp.Client
+		if client, err = smtp.Dial(TEST_SERVER_ADDRESS); err != nil {
+			t.Fatal(err)
+		}
+		err = sendTestMessage(client, "payments@go-transact.tld")
+		client.Close()
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "4") {
+		t.Fatalf("expected a temporary failure once the queue is full, got %v", err)
+	}
+	if ms.Stats().DeferredMessages != 1 {
+		t.Errorf("expected 1 deferred message, got %d", ms.Stats().DeferredMessages)
+	}
+}
@@ -0,0 +1,211 @@
+package mailing
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Envelope sender (MAIL FROM)
+	SENDER_ENVELOPE = "envelope"
+	// From header
+	SENDER_FROM = "from"
+	// X-Original-From header, added by some forwarding services
+	SENDER_X_ORIGINAL_FROM = "x-original-from"
+	// Reply-To header
+	SENDER_REPLY_TO = "reply-to"
+	// Original address encoded in a Sender Rewriting Scheme envelope sender
+	SENDER_SRS = "srs"
+	// Envelope sender recorded by the last trusted ARC sealer
+	SENDER_ARC = "arc"
+	// From header of a message forwarded as a message/rfc822 attachment
+	SENDER_ATTACHED = "attached"
+
+	MAX_MIME_DEPTH = 5
+)
+
+// Sources that can be used to resolve the sender
+var SenderSources = []string{SENDER_ENVELOPE, SENDER_FROM, SENDER_X_ORIGINAL_FROM, SENDER_REPLY_TO, SENDER_SRS, SENDER_ARC, SENDER_ATTACHED}
+
+// Determines the original sender of forwarded mail by trying each source in order.
+// The first source that yields an address wins.
+type SenderResolver struct {
+	Sources []string
+	// Domains whose ARC seals are trusted, i.e, google.com
+	TrustedArcSealers []string
+	// Used to fetch ARC sealer keys
+	Resolver Resolver
+}
+
+// Resolve Sets the sender of the mail. When the sender is taken from an attached message,
+// the subject and body are replaced with those of the attached message.
+func (r *SenderResolver) Resolve(received *ReceivedMail, header mail.Header) {
+	for _, source := range r.Sources {
+		var (
+			sender string
+			err    error
+		)
+		switch strings.ToLower(source) {
+		case SENDER_ENVELOPE:
+			sender = received.From
+		case SENDER_FROM:
+			sender, err = headerAddress(header, "From")
+		case SENDER_X_ORIGINAL_FROM:
+			sender, err = headerAddress(header, "X-Original-From")
+		case SENDER_REPLY_TO:
+			sender, err = headerAddress(header, "Reply-To")
+		case SENDER_SRS:
+			sender, err = DecodeSRS(received.From)
+		case SENDER_ARC:
+			verifier := &Verifier{Resolver: r.Resolver}
+			sender, err = verifier.ArcOriginalSender(received.Raw, r.TrustedArcSealers)
+		case SENDER_ATTACHED:
+			var attached *mail.Message
+			if attached, received.Attached, err = findAttachedMessage(header, bytes.NewReader(bodyOf(received.Raw)), 0); err == nil {
+				if sender, err = headerAddress(attached.Header, "From"); err == nil {
+					if body, readErr := ioutil.ReadAll(attached.Body); readErr == nil {
+						received.Subject = attached.Header.Get("Subject")
+						received.Body = string(body)
+					} else {
+						err = readErr
+					}
+				}
+			}
+			if err != nil {
+				received.Attached = nil
+			}
+		}
+
+		if err != nil {
+			log.Debugf("%s: could not resolve sender from %s. %s", received.RemoteAddr.String(), source, err.Error())
+			continue
+		}
+		if len(sender) > 0 {
+			received.Sender = sender
+			received.SenderSource = strings.ToLower(source)
+			log.Debugf("%s: resolved sender %s from %s", received.RemoteAddr.String(), sender, received.SenderSource)
+			return
+		}
+	}
+	log.Debugf("%s: no sender source matched, using envelope sender %s", received.RemoteAddr.String(), received.From)
+	received.Sender = received.From
+	received.SenderSource = SENDER_ENVELOPE
+}
+
+func headerAddress(header mail.Header, name string) (string, error) {
+	if len(header.Get(name)) == 0 {
+		return "", nil
+	}
+	addresses, err := header.AddressList(name)
+	if err != nil {
+		return "", err
+	}
+	if len(addresses) == 0 {
+		return "", nil
+	}
+	return addresses[0].Address, nil
+}
+
+// DecodeSRS Recovers the original address from an SRS0 or SRS1 rewritten address.
+// Hashes and timestamps are not checked since the forwarder's secret is unknown.
+// Returns an empty string if the address is not SRS rewritten.
+func DecodeSRS(address string) (string, error) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return "", nil
+	}
+	local := address[:at]
+	if len(local) < 5 {
+		return "", nil
+	}
+
+	var rest string
+	switch strings.ToUpper(local[:4]) {
+	case "SRS0":
+		// SRS0=HHH=TT=domain=local
+		rest = local[5:]
+	case "SRS1":
+		// SRS1=HHH=first-forwarder==HHH=TT=domain=local
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 || !strings.HasPrefix(parts[2], "=") {
+			return "", fmt.Errorf("malformed SRS1 address %s", address)
+		}
+		rest = parts[2][1:]
+	default:
+		return "", nil
+	}
+	if !strings.ContainsRune("=+-", rune(local[4])) {
+		return "", fmt.Errorf("malformed SRS address %s", address)
+	}
+
+	parts := strings.SplitN(rest, "=", 4)
+	if len(parts) != 4 || len(parts[2]) == 0 || len(parts[3]) == 0 {
+		return "", fmt.Errorf("malformed SRS address %s", address)
+	}
+	return parts[3] + "@" + parts[2], nil
+}
+
+func bodyOf(raw []byte) []byte {
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[i+4:]
+	}
+	return nil
+}
+
+// Looks for the first message/rfc822 part in a (possibly nested) multipart body.
+// Returns the parsed message and its raw bytes.
+func findAttachedMessage(header mail.Header, body io.Reader, depth int) (*mail.Message, []byte, error) {
+	if depth > MAX_MIME_DEPTH {
+		return nil, nil, fmt.Errorf("MIME structure too deep")
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("no attached message. %v", err)
+	}
+
+	if mediaType == "message/rfc822" {
+		raw, err := ioutil.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+		if err != nil {
+			return nil, nil, err
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		return msg, raw, err
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, nil, fmt.Errorf("no attached message in %s", mediaType)
+	}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("no attached message")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if msg, raw, err := findAttachedMessage(mail.Header(part.Header), part, depth+1); err == nil {
+			return msg, raw, nil
+		}
+	}
+}
+
+func decodeTransferEncoding(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
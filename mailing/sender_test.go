@@ -0,0 +1,179 @@
+package mailing
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const (
+	FORWARDED_MESSAGE = "From: Me <me@forwarder.tld>\r\n" +
+		"To: payments@go-transact.tld\r\n" +
+		"Subject: Fwd: Credit alert\r\n" +
+		"X-Original-From: Alerts <alerts@bank.tld>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached\r\n" +
+		"--outer\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		BANK_MESSAGE +
+		"--outer--\r\n"
+)
+
+func resolveSender(t *testing.T, resolver *SenderResolver, envelope string, raw string) *ReceivedMail {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := &ReceivedMail{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 25},
+		From:       envelope,
+		Raw:        []byte(raw),
+	}
+	resolver.Resolve(received, msg.Header)
+	return received
+}
+
+func TestDecodeSRS(t *testing.T) {
+	var cases = map[string]string{
+		"SRS0=HHH=TT=bank.tld=alerts@forwarder.tld":             "alerts@bank.tld",
+		"SRS0+HHH=TT=bank.tld=first=last@forwarder.tld":         "first=last@bank.tld",
+		"SRS1=HHH=first.tld==HHH=TT=bank.tld=alerts@second.tld": "alerts@bank.tld",
+		"alerts@bank.tld": "",
+		"bounces+SRS0=HHH=TT=bank.tld=alerts@forwarder.tld": "",
+	}
+	for address, expected := range cases {
+		decoded, err := DecodeSRS(address)
+		if err != nil {
+			t.Errorf("%s: %s", address, err.Error())
+		}
+		if decoded != expected {
+			t.Errorf("%s: expected '%s', got '%s'", address, expected, decoded)
+		}
+	}
+	if _, err := DecodeSRS("SRS0=HHH=bank.tld@forwarder.tld"); err == nil {
+		t.Error("malformed SRS address was decoded")
+	}
+}
+
+func TestResolveSender(t *testing.T) {
+	resolver := &SenderResolver{Sources: []string{SENDER_SRS, SENDER_ATTACHED, SENDER_X_ORIGINAL_FROM, SENDER_ENVELOPE}}
+
+	received := resolveSender(t, resolver, "SRS0=HHH=TT=bank.tld=alerts@forwarder.tld", FORWARDED_MESSAGE)
+	if received.Sender != "alerts@bank.tld" || received.SenderSource != SENDER_SRS {
+		t.Errorf("expected sender from SRS, got %s from %s", received.Sender, received.SenderSource)
+	}
+
+	received = resolveSender(t, resolver, "me@forwarder.tld", FORWARDED_MESSAGE)
+	if received.Sender != "alerts@bank.tld" || received.SenderSource != SENDER_ATTACHED {
+		t.Errorf("expected sender from attached message, got %s from %s", received.Sender, received.SenderSource)
+	}
+	if received.Subject != "Credit alert" || !strings.Contains(received.Body, "MWK20,000.00") {
+		t.Errorf("subject and body were not taken from the attached message: %s", received.Subject)
+	}
+	if strings.TrimSpace(string(received.Attached)) != strings.TrimSpace(BANK_MESSAGE) {
+		t.Errorf("attached message was not recorded")
+	}
+
+	resolver.Sources = []string{SENDER_X_ORIGINAL_FROM}
+	received = resolveSender(t, resolver, "me@forwarder.tld", FORWARDED_MESSAGE)
+	if received.Sender != "alerts@bank.tld" || received.SenderSource != SENDER_X_ORIGINAL_FROM {
+		t.Errorf("expected sender from X-Original-From, got %s from %s", received.Sender, received.SenderSource)
+	}
+
+	resolver.Sources = []string{SENDER_REPLY_TO}
+	received = resolveSender(t, resolver, "me@forwarder.tld", FORWARDED_MESSAGE)
+	if received.Sender != "me@forwarder.tld" || received.SenderSource != SENDER_ENVELOPE {
+		t.Errorf("expected fallback to the envelope sender, got %s from %s", received.Sender, received.SenderSource)
+	}
+}
+
+// Adds ARC set i, signed by forwarder.tld, on top of the message
+func addArcSet(t *testing.T, key ed25519.PrivateKey, message string, i int, cv string) string {
+	sign := func(hashed []byte) string {
+		signature, err := key.Sign(rand.Reader, hashed, crypto.Hash(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(signature)
+	}
+	fields := parseHeaderFields([]byte(message))
+	chain, err := arcSets(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyHash := sha256.Sum256(canonicalizeBody([]byte(message[strings.Index(message, "\r\n\r\n")+4:]), true))
+
+	aar := headerField{Name: "ARC-Authentication-Results", Value: fmt.Sprintf(" i=%d; mx.forwarder.tld; spf=pass smtp.mailfrom=alerts@bank.tld; dkim=pass header.d=bank.tld", i)}
+	ams := headerField{Name: "ARC-Message-Signature", Value: fmt.Sprintf(" i=%d; a=ed25519-sha256; c=relaxed/relaxed; d=forwarder.tld; s=arc; h=from:to:subject; bh=%s; b=",
+		i, base64.StdEncoding.EncodeToString(bodyHash[:]))}
+	ams.Value += sign(messageSignatureHash(fields, ams, true))
+	seal := headerField{Name: "ARC-Seal", Value: fmt.Sprintf(" i=%d; a=ed25519-sha256; cv=%s; d=forwarder.tld; s=arc; b=", i, cv)}
+	seal.Value += sign(arcSealHash(append(chain, &arcSet{authenticationResults: aar, messageSignature: ams, seal: seal})))
+
+	return seal.Name + ":" + seal.Value + "\r\n" + ams.Name + ":" + ams.Value + "\r\n" + aar.Name + ":" + aar.Value + "\r\n" + message
+}
+
+func TestResolveArcSender(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &SenderResolver{
+		Sources:           []string{SENDER_ARC},
+		TrustedArcSealers: []string{"forwarder.tld"},
+		Resolver: stubResolver{
+			"arc._domainkey.forwarder.tld": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(publicKey)},
+		},
+	}
+
+	sealed := addArcSet(t, privateKey, BANK_MESSAGE, 1, "none")
+	received := resolveSender(t, resolver, "SRS0=HHH=TT=bank.tld=alerts@forwarder.tld", sealed)
+	if received.Sender != "alerts@bank.tld" || received.SenderSource != SENDER_ARC {
+		t.Errorf("expected sender from ARC, got %s from %s", received.Sender, received.SenderSource)
+	}
+
+	resealed := addArcSet(t, privateKey, sealed, 2, "pass")
+	received = resolveSender(t, resolver, "SRS0=HHH=TT=bank.tld=alerts@forwarder.tld", resealed)
+	if received.Sender != "alerts@bank.tld" || received.SenderSource != SENDER_ARC {
+		t.Errorf("expected sender from a chain of 2, got %s from %s", received.Sender, received.SenderSource)
+	}
+
+	// The first seal is broken, the second one is valid
+	brokenSeal := regexp.MustCompile(`(ARC-Seal: i=1;[^\r]*b=)[^\r]*`).ReplaceAllString(sealed, "${1}"+base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize)))
+	cases := []struct {
+		name    string
+		message string
+	}{
+		{"tampered ARC results", strings.Replace(sealed, "smtp.mailfrom=alerts@bank.tld", "smtp.mailfrom=alerts@forged.tld", 1)},
+		{"ARC sets copied onto a forged body", strings.Replace(sealed, "MWK20,000.00", "MWK90,000.00", 1)},
+		{"forged body under a chain of 2", strings.Replace(resealed, "MWK20,000.00", "MWK90,000.00", 1)},
+		{"tampered signed header", strings.Replace(sealed, "Subject: Credit alert", "Subject: Credit alerts", 1)},
+		{"broken earlier seal", addArcSet(t, privateKey, brokenSeal, 2, "pass")},
+	}
+	for _, c := range cases {
+		received = resolveSender(t, resolver, "me@forwarder.tld", c.message)
+		if received.SenderSource == SENDER_ARC {
+			t.Errorf("%s: ARC sender was trusted", c.name)
+		}
+	}
+
+	resolver.TrustedArcSealers = []string{"other.tld"}
+	received = resolveSender(t, resolver, "me@forwarder.tld", sealed)
+	if received.SenderSource == SENDER_ARC {
+		t.Error("seal from an untrusted sealer was trusted")
+	}
+}
@@ -0,0 +1,76 @@
+package mailing
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// State kept for the lifetime of a single SMTP connection.
+//
+//	smtpd callbacks only receive the remote address, so sessions are looked up by it.
+type session struct {
+	// Name of the credential used to authenticate, empty if the client has not authenticated
+	username string
+	// Negotiated TLS version, 0 if the connection is not encrypted
+	tlsVersion uint16
+}
+
+// Wraps the SMTP listener so that per connection state can be created on accept and released on close
+type sessionListener struct {
+	net.Listener
+	ms *MailServer
+}
+
+type sessionConn struct {
+	net.Conn
+	ms   *MailServer
+	once sync.Once
+}
+
+func (l *sessionListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.ms.Allowlist.Allows(conn.RemoteAddr()) {
+			atomic.AddUint64(&l.ms.stats.RejectedConnections, 1)
+			log.Warnf("%s: connection rejected, address not in allowlist", conn.RemoteAddr().String())
+			go rejectConnection(conn, "554 5.7.1 Access denied")
+			continue
+		}
+		if !l.ms.Limiter.allowConnection(conn.RemoteAddr()) {
+			atomic.AddUint64(&l.ms.stats.ThrottledConnections, 1)
+			log.Warnf("%s: connection rejected, connection rate exceeded", conn.RemoteAddr().String())
+			go rejectConnection(conn, "421 4.7.0 Too many connections from your address, try again later")
+			continue
+		}
+		if !l.ms.Limiter.beginSession() {
+			atomic.AddUint64(&l.ms.stats.ThrottledConnections, 1)
+			log.Warnf("%s: connection rejected, too many concurrent sessions", conn.RemoteAddr().String())
+			go rejectConnection(conn, "421 4.7.0 Too many concurrent sessions, try again later")
+			continue
+		}
+		l.ms.sessions.Store(conn.RemoteAddr().String(), &session{})
+		return &sessionConn{Conn: conn, ms: l.ms}, nil
+	}
+}
+
+func (c *sessionConn) Close() error {
+	c.once.Do(func() {
+		c.ms.sessions.Delete(c.RemoteAddr().String())
+		c.ms.Limiter.endSession()
+	})
+	return c.Conn.Close()
+}
+
+// Returns the session for the given remote address. Never returns nil.
+func (ms *MailServer) session(remoteAddr net.Addr) *session {
+	if s, ok := ms.sessions.Load(remoteAddr.String()); ok {
+		return s.(*session)
+	}
+	return &session{}
+}
@@ -0,0 +1,228 @@
+package mailing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twinj/uuid"
+
+	"github.com/SharkFourSix/go-transact/persistence"
+)
+
+// Accepted mail that has not been processed yet. Holds everything needed to process it again after a restart
+type SpooledMail struct {
+	ID         string    `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Listener   string    `json:"listener"`
+	RemoteAddr string    `json:"remoteAddr"`
+	From       string    `json:"from"`
+	Recipients string    `json:"recipients"`
+	TlsVersion string    `json:"tlsVersion"`
+	Raw        []byte    `json:"raw"`
+	// Failed attempts at processing the mail, including runs that crashed
+	Attempts int `gorm:"default:0" json:"attempts"`
+	// Set after MAX_SPOOL_ATTEMPTS failed attempts. The mail is kept for inspection but no longer processed
+	Failed bool `gorm:"default:false" json:"failed"`
+}
+
+// Attempts after which spooled mail is moved aside, so a message crashing the handler does not crash every startup
+const MAX_SPOOL_ATTEMPTS = 3
+
+// Durable storage for accepted mail. Store must not return before the mail is safely written
+type Spool interface {
+	// Writes the mail, replacing a stored mail with the same ID
+	Store(mail *SpooledMail) error
+	Remove(id string) error
+	// Mail stored but not removed, oldest first. Failed mail is left out
+	Pending() ([]*SpooledMail, error)
+}
+
+// Writes the mail to the spool and arranges for it to be removed once processed
+func (ms *MailServer) spool(received *ReceivedMail) error {
+	spooled := &SpooledMail{
+		ID:         uuid.NewV4().String(),
+		CreatedAt:  time.Now(),
+		Listener:   ms.Name,
+		RemoteAddr: received.RemoteAddr.String(),
+		From:       received.From,
+		Recipients: strings.Join(received.To, ","),
+		TlsVersion: received.TLSVersion,
+		Raw:        received.Raw,
+	}
+	if err := ms.Spool.Store(spooled); err != nil {
+		return err
+	}
+	received.done = func(err error) {
+		if err == nil {
+			unspool(ms.Spool, spooled.ID)
+		} else {
+			spooled.Attempts++
+			keepSpooled(ms.Spool, spooled)
+		}
+	}
+	return nil
+}
+
+// Saves the attempts of mail that failed to be processed. It is processed again on restart, or moved aside once
+// MAX_SPOOL_ATTEMPTS is reached
+func keepSpooled(spool Spool, spooled *SpooledMail) {
+	if spooled.Attempts >= MAX_SPOOL_ATTEMPTS {
+		spooled.Failed = true
+		log.Errorf("spooled mail %s from %s failed %d times and was moved aside", spooled.ID, spooled.From, spooled.Attempts)
+	}
+	if err := spool.Store(spooled); err != nil {
+		log.Errorf("failed to update spooled mail %s. %s", spooled.ID, err.Error())
+	}
+}
+
+func unspool(spool Spool, id string) {
+	if err := spool.Remove(id); err != nil {
+		log.Errorf("failed to remove spooled mail %s. It will be processed again on restart. %s", id, err.Error())
+	}
+}
+
+// Processes spooled mail synchronously and removes it from the spool once processed. The attempt is counted
+// before the mail is processed, so mail that crashes the process is moved aside after MAX_SPOOL_ATTEMPTS restarts
+func (ms *MailServer) recover(spool Spool, spooled *SpooledMail) {
+	var to []string
+	if len(spooled.Recipients) > 0 {
+		to = strings.Split(spooled.Recipients, ",")
+	}
+	received, err := ms.receive(stringAddr(spooled.RemoteAddr), spooled.From, to, spooled.Raw, spooled.TlsVersion)
+	if err != nil {
+		log.Errorf("discarding unreadable spooled mail %s. %s", spooled.ID, err.Error())
+		unspool(spool, spooled.ID)
+		return
+	}
+	if spooled.Attempts >= MAX_SPOOL_ATTEMPTS {
+		keepSpooled(spool, spooled)
+		return
+	}
+	spooled.Attempts++
+	if err := spool.Store(spooled); err != nil {
+		log.Errorf("failed to update spooled mail %s. %s", spooled.ID, err.Error())
+	}
+	if err := ms.handle(received); err != nil {
+		log.Errorf("failed to process spooled mail %s. %s", spooled.ID, err.Error())
+		if spooled.Attempts >= MAX_SPOOL_ATTEMPTS {
+			keepSpooled(spool, spooled)
+		}
+		return
+	}
+	unspool(spool, spooled.ID)
+}
+
+// Stores each mail as a JSON file in a directory
+type DirectorySpool struct {
+	Dir string
+}
+
+// NewDirectorySpool Creates the spool directory if it does not exist
+func NewDirectorySpool(dir string) (*DirectorySpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating spool directory %s. %v", dir, err)
+	}
+	return &DirectorySpool{Dir: dir}, nil
+}
+
+func (s *DirectorySpool) path(id string) string {
+	return filepath.Join(s.Dir, id+".json")
+}
+
+// Store Writes the mail to a temporary file, syncs it and renames it into place
+func (s *DirectorySpool) Store(mail *SpooledMail) error {
+	data, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(mail.ID)); err != nil {
+		return err
+	}
+	return syncDir(s.Dir)
+}
+
+func (s *DirectorySpool) Remove(id string) error {
+	return os.Remove(s.path(id))
+}
+
+func (s *DirectorySpool) Pending() ([]*SpooledMail, error) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var pending []*SpooledMail
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var mail SpooledMail
+		if err := json.Unmarshal(data, &mail); err != nil {
+			log.Errorf("skipping corrupt spool file %s. %s", file, err.Error())
+			continue
+		}
+		if !mail.Failed {
+			pending = append(pending, &mail)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+	return pending, nil
+}
+
+// Keeps accepted mail in the database until it has been processed. Requires SpooledMail to be migrated
+type DatabaseSpool struct{}
+
+func (DatabaseSpool) Store(mail *SpooledMail) error {
+	return persistence.Update(mail)
+}
+
+func (DatabaseSpool) Remove(id string) error {
+	_, err := persistence.Delete(&SpooledMail{}, "id = ?", id)
+	return err
+}
+
+func (DatabaseSpool) Pending() ([]*SpooledMail, error) {
+	var pending []*SpooledMail
+	if err := persistence.Find(&pending, "failed = ?", false); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+	return pending, nil
+}
+
+// Makes a rename durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
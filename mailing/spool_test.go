@@ -0,0 +1,157 @@
+package mailing
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpool(t *testing.T) {
+	spool, err := NewDirectorySpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		release  = make(chan struct{})
+		received = make(chan *ReceivedMail, 1)
+		ms       = &MailServer{
+			Spool: spool,
+			Pool: &WorkerPool{Handler: func(mail *ReceivedMail) error {
+				<-release
+				received <- mail
+				return nil
+			}},
+		}
+	)
+	ms.Pool.Start()
+	startTestServer(t, ms)
+	defer ms.Shutdown(context.Background())
+
+	client, err := smtp.Dial(TEST_SERVER_ADDRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := sendTestMessage(client, "payments@go-transact.tld"); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := spool.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].From != "alerts@bank.tld" || pending[0].Recipients != "payments@go-transact.tld" {
+		t.Fatalf("expected the acknowledged message to be spooled, have %+v", pending)
+	}
+
+	close(release)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message was not handed to the handler")
+	}
+	for i := 0; i < 50; i++ {
+		if pending, _ = spool.Pending(); len(pending) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(pending) != 0 {
+		t.Fatal("processed message was not removed from the spool")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	spool, err := NewDirectorySpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"second", "first"} {
+		if err := spool.Store(&SpooledMail{
+			ID:         id,
+			CreatedAt:  time.Now().Add(time.Duration(-i) * time.Minute),
+			Listener:   "relay",
+			RemoteAddr: "192.0.2.10:25",
+			From:       "alerts@bank.tld",
+			Recipients: "payments@go-transact.tld",
+			Raw:        []byte(TEST_MESSAGE),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var handled []*ReceivedMail
+	handler := func(name string) EmailReceivedHandler {
+		return func(mail *ReceivedMail) error {
+			if name != "relay" {
+				t.Errorf("spooled mail was handled by listener %s", name)
+			}
+			handled = append(handled, mail)
+			return nil
+		}
+	}
+	daemon := &Daemon{Servers: []*MailServer{
+		{Name: "public", Handler: handler("public")},
+		{Name: "relay", Handler: handler("relay")},
+	}}
+
+	recovered, err := daemon.Recover(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered != 2 || len(handled) != 2 {
+		t.Fatalf("expected 2 recovered mails, recovered %d and handled %d", recovered, len(handled))
+	}
+	if handled[0].Subject != "Credit" || handled[0].RemoteAddr.String() != "192.0.2.10:25" || handled[0].To[0] != "payments@go-transact.tld" {
+		t.Errorf("spooled mail was not restored: %+v", handled[0])
+	}
+	if pending, _ := spool.Pending(); len(pending) != 0 {
+		t.Errorf("recovered mail was left in the spool")
+	}
+}
+
+func TestPoisonMail(t *testing.T) {
+	spool, err := NewDirectorySpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash := func(mail *ReceivedMail) error {
+		panic("unexpected content")
+	}
+	ms := &MailServer{Name: "relay", Spool: spool, Handler: crash}
+	received, err := ms.receive(&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 25}, "alerts@bank.tld",
+		[]string{"payments@go-transact.tld"}, []byte(TEST_MESSAGE), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.spool(received); err != nil {
+		t.Fatal(err)
+	}
+	(&WorkerPool{Handler: crash}).handle(received)
+
+	daemon := &Daemon{Servers: []*MailServer{ms}}
+	for attempt := 1; attempt < MAX_SPOOL_ATTEMPTS; attempt++ {
+		pending, err := spool.Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 1 || pending[0].Attempts != attempt {
+			t.Fatalf("expected the failed mail to be kept after %d attempts, have %+v", attempt, pending)
+		}
+		if _, err := daemon.Recover(spool); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pending, _ := spool.Pending(); len(pending) != 0 {
+		t.Errorf("mail failing %d times is still processed", MAX_SPOOL_ATTEMPTS)
+	}
+	files, _ := filepath.Glob(filepath.Join(spool.Dir, "*.json"))
+	if len(files) != 1 {
+		t.Errorf("failed mail was not kept for inspection")
+	}
+}
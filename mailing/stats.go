@@ -0,0 +1,40 @@
+package mailing
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Counters kept by the mail server for monitoring
+type Stats struct {
+	// Connections refused because the remote address is not in the server allowlist
+	RejectedConnections uint64
+	// Connections refused because of the session limit or the connection rate limit
+	ThrottledConnections uint64
+	// Messages refused with a temporary failure because of the message rate limit
+	ThrottledMessages uint64
+	// Messages refused with a temporary failure because the processing queue was full
+	DeferredMessages uint64
+}
+
+// Stats Returns a snapshot of the server counters
+func (ms *MailServer) Stats() Stats {
+	return Stats{
+		RejectedConnections:  atomic.LoadUint64(&ms.stats.RejectedConnections),
+		ThrottledConnections: atomic.LoadUint64(&ms.stats.ThrottledConnections),
+		ThrottledMessages:    atomic.LoadUint64(&ms.stats.ThrottledMessages),
+		DeferredMessages:     atomic.LoadUint64(&ms.stats.DeferredMessages),
+	}
+}
+
+// Sends a final reply and closes the connection without starting an SMTP session
+func rejectConnection(conn net.Conn, reply string) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(reply + "\r\n")); err != nil {
+		log.Debugf("%s: error writing rejection. %s", conn.RemoteAddr().String(), err.Error())
+	}
+}
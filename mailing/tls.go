@@ -0,0 +1,102 @@
+package mailing
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+const (
+	// STARTTLS is not offered
+	TLS_POLICY_NONE = "none"
+	// STARTTLS is offered but not required
+	TLS_POLICY_OPTIONAL = "optional"
+	// STARTTLS must be issued before MAIL FROM
+	TLS_POLICY_REQUIRED = "required"
+)
+
+var TLSPolicies = []string{TLS_POLICY_NONE, TLS_POLICY_OPTIONAL, TLS_POLICY_REQUIRED}
+
+// ParseCipherSuites Converts cipher suite names, i.e, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, to their IDs.
+// Insecure suites are rejected.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if strings.EqualFold(suite.Name, name) {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unsupported cipher suite '%s'", name)
+		}
+	}
+	return ids, nil
+}
+
+// Effective TLS policy. UseTLS is kept for older configurations and means optional STARTTLS
+func (ms *MailServer) tlsPolicy() string {
+	if !utils.IsStringEmpty(ms.TLSPolicy) {
+		return strings.ToLower(ms.TLSPolicy)
+	}
+	if ms.UseTLS {
+		return TLS_POLICY_OPTIONAL
+	}
+	return TLS_POLICY_NONE
+}
+
+// Loads the certificate and builds the TLS configuration shared by STARTTLS and implicit TLS listeners.
+// Returns nil if TLS is not used at all.
+func (ms *MailServer) tlsConfig() (*tls.Config, error) {
+	policy := ms.tlsPolicy()
+	if policy == TLS_POLICY_NONE && !ms.ImplicitTLS && utils.IsStringEmpty(ms.ImplicitTLSAddress) {
+		return nil, nil
+	}
+
+	var err error
+	if utils.IsStringEmpty(ms.CertificateFile) || utils.IsStringEmpty(ms.KeyFile) {
+		return nil, fmt.Errorf("certificate or key file missing")
+	}
+	if utils.IsStringEmpty(ms.KeyPassphrase) {
+		err = ms.server.ConfigureTLS(ms.CertificateFile, ms.KeyFile)
+	} else {
+		err = ms.server.ConfigureTLSWithPassphrase(ms.CertificateFile, ms.KeyFile, ms.KeyPassphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error configuring TLS. %v", err)
+	}
+	config := ms.server.TLSConfig
+
+	if config.MinVersion, err = utils.ParseTLSVersion(ms.TLSMinVersion); err != nil {
+		return nil, err
+	}
+	if config.CipherSuites, err = ParseCipherSuites(ms.TLSCipherSuites); err != nil {
+		return nil, err
+	}
+
+	// Record the negotiated version on the session so it can be stored with the mail
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		remoteAddr := hello.Conn.RemoteAddr()
+		sessionConfig := config.Clone()
+		sessionConfig.GetConfigForClient = nil
+		sessionConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			ms.session(remoteAddr).tlsVersion = state.Version
+			return nil
+		}
+		return sessionConfig, nil
+	}
+
+	switch policy {
+	case TLS_POLICY_NONE:
+		// Only used by the implicit TLS listener
+		ms.server.TLSConfig = nil
+	case TLS_POLICY_REQUIRED:
+		ms.server.TLSRequired = true
+	}
+	return config, nil
+}
@@ -0,0 +1,251 @@
+package mailing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/SharkFourSix/go-transact/transaction"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+const (
+	RESULT_PASS      = "pass"
+	RESULT_FAIL      = "fail"
+	RESULT_NONE      = "none"
+	RESULT_TEMPERROR = "temperror"
+	RESULT_PERMERROR = "permerror"
+
+	VERIFICATION_TIMEOUT = 10 * time.Second
+)
+
+// DNS lookups needed to verify senders. Satisfied by *net.Resolver, can be replaced with a stub for testing.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// NewResolver Returns a resolver sending all queries to the given DNS server (host:port).
+// The system resolver is returned if server is empty.
+func NewResolver(server string) Resolver {
+	if utils.IsStringEmpty(server) {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Results of the sender authentication checks performed on a received email
+type Verification struct {
+	// Domain of the From header, the identity DMARC protects
+	FromDomain string
+	// Overall DKIM result. pass if at least one signature verified
+	Dkim string
+	// Domains (d=) of the signatures that verified
+	DkimDomains []string
+	// SPF result for the envelope sender
+	Spf string
+	// DMARC result for FromDomain. none if the domain does not publish a policy
+	Dmarc string
+	// Policy (p=) published by FromDomain
+	DmarcPolicy string
+}
+
+// Checks DKIM signatures, SPF and DMARC alignment of received mail
+type Verifier struct {
+	Resolver Resolver
+	Timeout  time.Duration
+}
+
+func (v *Verifier) resolver() Resolver {
+	if v.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return v.Resolver
+}
+
+// Verify Runs all checks. Never returns nil, failures are reported in the results.
+func (v *Verifier) Verify(remoteAddr net.Addr, mailFrom string, raw []byte, header mail.Header) *Verification {
+	timeout := v.Timeout
+	if timeout == 0 {
+		timeout = VERIFICATION_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	lookupTXT := func(domain string) ([]string, error) {
+		return v.resolver().LookupTXT(ctx, domain)
+	}
+
+	result := &Verification{
+		Dkim:  RESULT_NONE,
+		Spf:   RESULT_NONE,
+		Dmarc: RESULT_NONE,
+	}
+
+	if from, err := mail.ParseAddress(header.Get("From")); err == nil {
+		result.FromDomain = domainOf(from.Address)
+	}
+
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+	if err != nil {
+		log.Debugf("%s: DKIM verification error. %s", remoteAddr.String(), err.Error())
+		result.Dkim = RESULT_PERMERROR
+	}
+	for _, verification := range verifications {
+		switch {
+		case verification.Err == nil:
+			result.Dkim = RESULT_PASS
+			result.DkimDomains = append(result.DkimDomains, strings.ToLower(verification.Domain))
+		case result.Dkim == RESULT_PASS:
+		case dkim.IsTempFail(verification.Err):
+			result.Dkim = RESULT_TEMPERROR
+		case dkim.IsPermFail(verification.Err):
+			result.Dkim = RESULT_PERMERROR
+		default:
+			result.Dkim = RESULT_FAIL
+		}
+	}
+
+	if ip := remoteIP(remoteAddr); ip != nil && !utils.IsStringEmpty(mailFrom) {
+		spfResult, err := spf.CheckHostWithSender(ip, "", mailFrom, spf.WithContext(ctx), spf.WithResolver(v.resolver()))
+		if err != nil {
+			log.Debugf("%s: SPF check for %s. %s", remoteAddr.String(), mailFrom, err.Error())
+		}
+		result.Spf = string(spfResult)
+	}
+
+	if !utils.IsStringEmpty(result.FromDomain) {
+		result.Dmarc, result.DmarcPolicy = v.dmarc(result, domainOf(mailFrom), lookupTXT)
+	}
+
+	log.Debugf("%s: verification of %s [dkim=%s, spf=%s, dmarc=%s]", remoteAddr.String(), mailFrom, result.Dkim, result.Spf, result.Dmarc)
+	return result
+}
+
+func (v *Verifier) dmarc(result *Verification, mailFromDomain string, lookupTXT func(string) ([]string, error)) (string, string) {
+	options := &dmarc.LookupOptions{LookupTXT: lookupTXT}
+	record, err := dmarc.LookupWithOptions(result.FromDomain, options)
+	if errors.Is(err, dmarc.ErrNoPolicy) {
+		if orgDomain := organizationalDomain(result.FromDomain); orgDomain != result.FromDomain {
+			record, err = dmarc.LookupWithOptions(orgDomain, options)
+		}
+	}
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		return RESULT_NONE, ""
+	case dmarc.IsTempFail(err):
+		return RESULT_TEMPERROR, ""
+	case err != nil:
+		return RESULT_PERMERROR, ""
+	}
+
+	for _, domain := range result.DkimDomains {
+		if aligned(result.FromDomain, domain, record.DKIMAlignment) {
+			return RESULT_PASS, string(record.Policy)
+		}
+	}
+	if result.Spf == string(spf.Pass) && aligned(result.FromDomain, mailFromDomain, record.SPFAlignment) {
+		return RESULT_PASS, string(record.Policy)
+	}
+	return RESULT_FAIL, string(record.Policy)
+}
+
+// CheckPolicy Returns an error describing the first requirement of the template's policy the results do not satisfy.
+// email is the template's sender address. DKIM and DMARC only vouch for the domains they were checked for, so the
+// From header and the signatures must belong to its domain. v is nil when verification is disabled
+func CheckPolicy(p *transaction.VerificationPolicy, v *Verification, email string) error {
+	if p.IsEmpty() {
+		return nil
+	}
+	if v == nil {
+		return fmt.Errorf("sender verification is disabled")
+	}
+	requireDkim := p.RequireDkim || !utils.IsStringEmpty(p.DkimDomain)
+	domain := domainOf(email)
+	if (requireDkim || p.RequireDmarc) && (utils.IsStringEmpty(domain) || !strings.EqualFold(v.FromDomain, domain)) {
+		return fmt.Errorf("From header domain %s does not match %s", v.FromDomain, email)
+	}
+	if requireDkim {
+		if v.Dkim != RESULT_PASS {
+			return fmt.Errorf("DKIM %s", v.Dkim)
+		}
+		signer := p.DkimDomain
+		if utils.IsStringEmpty(signer) {
+			signer = organizationalDomain(domain)
+		}
+		signed := false
+		for _, d := range v.DkimDomains {
+			signed = signed || isSubdomain(d, signer)
+		}
+		if !signed {
+			return fmt.Errorf("no valid DKIM signature from %s. Signed by [%s]", signer, strings.Join(v.DkimDomains, ", "))
+		}
+	}
+	if p.RequireSpf && v.Spf != RESULT_PASS {
+		return fmt.Errorf("SPF %s", v.Spf)
+	}
+	if p.RequireDmarc && v.Dmarc != RESULT_PASS {
+		return fmt.Errorf("DMARC %s", v.Dmarc)
+	}
+	return nil
+}
+
+func domainOf(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return strings.ToLower(address[i+1:])
+	}
+	return ""
+}
+
+func organizationalDomain(domain string) string {
+	if orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return orgDomain
+	}
+	return domain
+}
+
+// Identifier alignment as defined in RFC 7489 section 3.1
+func aligned(fromDomain string, domain string, mode dmarc.AlignmentMode) bool {
+	if utils.IsStringEmpty(domain) {
+		return false
+	}
+	if mode == dmarc.AlignmentStrict {
+		return strings.EqualFold(fromDomain, domain)
+	}
+	return strings.EqualFold(organizationalDomain(fromDomain), organizationalDomain(domain))
+}
+
+func isSubdomain(domain string, parent string) bool {
+	domain, parent = strings.ToLower(domain), strings.ToLower(strings.TrimSuffix(parent, "."))
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
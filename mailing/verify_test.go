@@ -0,0 +1,151 @@
+package mailing
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+
+	"github.com/SharkFourSix/go-transact/transaction"
+)
+
+const (
+	BANK_MESSAGE = "From: Alerts <alerts@bank.tld>\r\n" +
+		"To: payments@go-transact.tld\r\n" +
+		"Subject: Credit alert\r\n" +
+		"\r\n" +
+		"Your account has been credited with MWK20,000.00 on 20220505.\r\n"
+)
+
+// Resolver answering TXT queries from a map. Everything else does not exist.
+type stubResolver map[string][]string
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r[strings.TrimSuffix(name, ".")]; ok {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, notFound(name)
+}
+
+func (r stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, notFound(host)
+}
+
+func (r stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, notFound(addr)
+}
+
+func TestVerification(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signed bytes.Buffer
+	err = dkim.Sign(&signed, strings.NewReader(BANK_MESSAGE), &dkim.SignOptions{
+		Domain:   "bank.tld",
+		Selector: "alerts",
+		Signer:   privateKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := &Verifier{
+		Resolver: stubResolver{
+			"alerts._domainkey.bank.tld": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(publicKey)},
+			"bank.tld":                   {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"_dmarc.bank.tld":            {"v=DMARC1; p=reject"},
+		},
+	}
+	policy := &transaction.VerificationPolicy{DkimDomain: "bank.tld", RequireDmarc: true}
+
+	verify := func(raw []byte, ip string) *Verification {
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return verifier.Verify(&net.TCPAddr{IP: net.ParseIP(ip), Port: 25}, "alerts@bank.tld", raw, msg.Header)
+	}
+
+	genuine := verify(signed.Bytes(), "192.0.2.10")
+	if genuine.Dkim != RESULT_PASS || genuine.Spf != RESULT_PASS || genuine.Dmarc != RESULT_PASS {
+		t.Fatalf("genuine alert did not verify: %+v", genuine)
+	}
+	if genuine.DmarcPolicy != "reject" {
+		t.Errorf("expected DMARC policy reject, got %s", genuine.DmarcPolicy)
+	}
+	if err := CheckPolicy(policy, genuine, "alerts@bank.tld"); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := verify([]byte(BANK_MESSAGE), "198.51.100.7")
+	if forged.Dkim != RESULT_NONE || forged.Spf != RESULT_FAIL || forged.Dmarc != RESULT_FAIL {
+		t.Fatalf("forged alert verified: %+v", forged)
+	}
+	if err := CheckPolicy(policy, forged, "alerts@bank.tld"); err == nil {
+		t.Fatal("forged alert satisfied the policy")
+	}
+
+	tampered := bytes.Replace(signed.Bytes(), []byte("20,000.00"), []byte("90,000.00"), 1)
+	if result := verify(tampered, "192.0.2.10"); result.Dkim != RESULT_FAIL {
+		t.Fatalf("tampered alert passed DKIM: %+v", result)
+	}
+
+	if err := CheckPolicy(&transaction.VerificationPolicy{DkimDomain: "otherbank.tld"}, genuine, "alerts@bank.tld"); err == nil {
+		t.Fatal("signature from bank.tld satisfied a policy for otherbank.tld")
+	}
+
+	// Valid signatures from a domain other than the template's
+	sign := func(message string, domain string) []byte {
+		var signed bytes.Buffer
+		err := dkim.Sign(&signed, strings.NewReader(message), &dkim.SignOptions{
+			Domain:   domain,
+			Selector: "alerts",
+			Signer:   privateKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed.Bytes()
+	}
+	verifier.Resolver = stubResolver{
+		"alerts._domainkey.bank.tld": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(publicKey)},
+		"alerts._domainkey.evil.tld": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(publicKey)},
+		"_dmarc.evil.tld":            {"v=DMARC1; p=reject"},
+	}
+	resigned := verify(sign(BANK_MESSAGE, "evil.tld"), "198.51.100.7")
+	if resigned.Dkim != RESULT_PASS {
+		t.Fatalf("signature from evil.tld did not verify: %+v", resigned)
+	}
+	if err := CheckPolicy(&transaction.VerificationPolicy{RequireDkim: true}, resigned, "alerts@bank.tld"); err == nil {
+		t.Error("signature from evil.tld satisfied requireDkim for alerts@bank.tld")
+	}
+	evil := verify(sign(strings.Replace(BANK_MESSAGE, "bank.tld", "evil.tld", 1), "evil.tld"), "198.51.100.7")
+	if evil.Dkim != RESULT_PASS || evil.Dmarc != RESULT_PASS {
+		t.Fatalf("alert from evil.tld did not verify: %+v", evil)
+	}
+	for _, policy := range []transaction.VerificationPolicy{{RequireDkim: true}, {RequireDmarc: true}} {
+		if err := CheckPolicy(&policy, evil, "alerts@bank.tld"); err == nil {
+			t.Errorf("alert from evil.tld satisfied %+v for alerts@bank.tld", policy)
+		}
+	}
+	if err := CheckPolicy(&transaction.VerificationPolicy{RequireDkim: true}, genuine, "alerts@bank.tld"); err != nil {
+		t.Error(err)
+	}
+}
@@ -12,12 +12,14 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/twinj/uuid"
 
+	"github.com/SharkFourSix/go-transact/api"
 	"github.com/SharkFourSix/go-transact/config"
 	"github.com/SharkFourSix/go-transact/mailing"
 	"github.com/SharkFourSix/go-transact/messaging"
 	"github.com/SharkFourSix/go-transact/persistence"
+	"github.com/SharkFourSix/go-transact/reconciliation"
+	"github.com/SharkFourSix/go-transact/sms"
 	"github.com/SharkFourSix/go-transact/transaction"
 	"github.com/SharkFourSix/go-transact/utils"
 	"github.com/devfacet/gocmd"
@@ -28,6 +30,8 @@ const (
 	VERSION      = "1.0"
 	DESCRIPTION  = "Bank transaction notification to action service"
 	BUSY_TIMEOUT = 5000
+	// Used when server.workers.shutdownTimeout is not set
+	SHUTDOWN_TIMEOUT = 30 * time.Second
 )
 
 func main() {
@@ -36,13 +40,48 @@ func main() {
 		Version    bool   `short:"v" long:"version" description:"Display version"`
 		Help       bool   `short:"h" long:"help" description:"Show help"`
 		Verbose    bool   `short:"x" long:"verbose" description:"Set verbose to on"`
-		ConfigFile string `short:"c" long:"config-file" description:"Path to configuration file"`
+		ConfigFile string `short:"c" long:"config-file" description:"Path to configuration file" global:"true"`
+		Config     struct {
+			Validate     struct{} `command:"validate" description:"Validate the configuration file and report all problems found"`
+			TestTemplate struct {
+				Template string `long:"template" description:"Name of the template to parse the message with"`
+				Message  string `long:"message" description:"File containing the email body or SMS text"`
+			} `command:"test-template" description:"Parse a sample message and preview the callback, without storing or sending anything"`
+		} `command:"config" description:"Configuration commands"`
+		Import struct {
+			Maildir   string `long:"maildir" description:"Maildir directory to import"`
+			Mbox      string `long:"mbox" description:"mbox file to import"`
+			DryRun    bool   `long:"dry-run" description:"Match and parse messages without storing anything or sending callbacks"`
+			StoreOnly bool   `long:"store-only" description:"Store messages and transactions without sending callbacks"`
+		} `command:"import" description:"Process historical mail from a Maildir or mbox export"`
+		Notifications struct {
+			List struct {
+				Resolved bool `long:"resolved" description:"Include resolved notifications"`
+			} `command:"list" description:"List failed callbacks in the dead-letter queue"`
+			Show struct {
+				Id string `long:"id" description:"ID of the notification"`
+			} `command:"show" description:"Show a notification and all attempts at sending it"`
+			Replay struct {
+				Id  string `long:"id" description:"ID of the notification to replay"`
+				All bool   `long:"all" description:"Replay every notification in the dead-letter queue"`
+				Url string `long:"url" description:"Send to this url instead of the url of the last attempt"`
+			} `command:"replay" description:"Send dead letters again"`
+			Resolve struct {
+				Id   string `long:"id" description:"ID of the notification to resolve"`
+				Note string `long:"note" description:"Why the notification is resolved without being sent"`
+			} `command:"resolve" description:"Take a notification out of the dead-letter queue without sending it"`
+		} `command:"notifications" description:"Dead-letter queue of failed callbacks"`
 	}{}
 
 	var (
 		verbose    bool
 		configFile string
-		mailServer *mailing.MailServer
+		command    string
+		daemon     = &mailing.Daemon{}
+		pollers    []*mailing.IMAPPoller
+		webhook    *sms.Webhook
+		apiServer  *api.Server
+		retrier    *messaging.Retrier
 		exitStatus int = 1
 	)
 
@@ -64,6 +103,29 @@ func main() {
 		return nil
 	})
 
+	_, _ = gocmd.HandleFlag("Config.Validate", func(cmd *gocmd.Cmd, args []string) error {
+		command = "config validate"
+		return nil
+	})
+
+	_, _ = gocmd.HandleFlag("Config.TestTemplate", func(cmd *gocmd.Cmd, args []string) error {
+		command = "config test-template"
+		return nil
+	})
+
+	_, _ = gocmd.HandleFlag("Import", func(cmd *gocmd.Cmd, args []string) error {
+		command = "import"
+		return nil
+	})
+
+	for _, name := range []string{"List", "Show", "Replay", "Resolve"} {
+		name := name
+		_, _ = gocmd.HandleFlag("Notifications."+name, func(cmd *gocmd.Cmd, args []string) error {
+			command = "notifications " + strings.ToLower(name)
+			return nil
+		})
+	}
+
 	_, _ = gocmd.New(gocmd.Options{
 		Name:        NAME,
 		Description: DESCRIPTION,
@@ -89,6 +151,17 @@ func main() {
 		return
 	}
 
+	if command == "config validate" {
+		fmt.Printf("configuration file %s is valid\n", configFile)
+		exitStatus = 0
+		return
+	}
+
+	if command == "config test-template" {
+		exitStatus = testTemplate(flags.Config.TestTemplate.Template, flags.Config.TestTemplate.Message)
+		return
+	}
+
 	log.Debug("Opening database")
 	if err := persistence.Initialize(BUSY_TIMEOUT); err != nil {
 		log.Errorf("Error initializing database. %s\n", err.Error())
@@ -98,119 +171,230 @@ func main() {
 
 	log.Debug("Applying migrations")
 	if err := persistence.Migrate(&transaction.Transaction{}, &messaging.TransactionNotification{},
-		&mailing.SpamMail{}, &mailing.TransactionEmail{}); err != nil {
+		&messaging.NotificationAttempt{}, &mailing.SpamMail{}, &mailing.TransactionEmail{}, &mailing.SpooledMail{}, &sms.ReceivedSms{},
+		&reconciliation.ExpectedPayment{}, &reconciliation.ReceivedTotal{}); err != nil {
 		log.Errorf("Error running database migrations. %s\n", err.Error())
 		return
 	}
 
+	if err := messaging.ConfigureEndpoints(config.GetConfiguration().Callback.EndpointOptions); err != nil {
+		log.Errorf("Error configuring callback url. %s", err.Error())
+		return
+	}
+
+	switch command {
+	case "notifications list":
+		exitStatus = listDeadLetters(flags.Notifications.List.Resolved)
+		return
+	case "notifications show":
+		exitStatus = showNotification(flags.Notifications.Show.Id)
+		return
+	case "notifications replay":
+		exitStatus = replayDeadLetters(flags.Notifications.Replay.Id, flags.Notifications.Replay.All, flags.Notifications.Replay.Url)
+		return
+	case "notifications resolve":
+		exitStatus = resolveDeadLetter(flags.Notifications.Resolve.Id, flags.Notifications.Resolve.Note)
+		return
+	}
+
 	mailboxVerifier := func(remoteAddr net.Addr, from string, to string) bool {
-		parts := strings.Split(to, "@")
-		if len(parts) <= 1 {
+		if !strings.Contains(to, "@") {
 			log.Debugf("rejected host %s because of malformed mailbox name.", remoteAddr.String())
 			return false
 		}
-		exists := config.MailBoxExists(parts[0])
-		log.Debugf("%s: mailbox exists %s: %t", remoteAddr.String(), parts[0], exists)
+		exists := config.MailBoxExists(to)
+		log.Debugf("%s: mailbox exists %s: %t", remoteAddr.String(), to, exists)
 		return exists
 	}
 
-	handler := func(ip net.Addr, from string, to []string, subject string, data string) {
-		log.Debugf("Got email from ip %s, sender %s", ip.String(), from)
+	handler := func(received *mailing.ReceivedMail) error {
+		_, _, err := processMail(received, processOptions{})
+		return err
+	}
+
+	var (
+		resolver       = mailing.NewResolver(config.GetConfiguration().Server.Verification.DnsServer)
+		verifier       *mailing.Verifier
+		senderResolver *mailing.SenderResolver
+	)
+	if config.GetConfiguration().Server.Verification.Enabled {
+		verifier = &mailing.Verifier{Resolver: resolver}
+	}
+	if len(config.GetConfiguration().Server.SenderResolution.Sources) > 0 {
+		senderResolver = &mailing.SenderResolver{
+			Sources:           config.GetConfiguration().Server.SenderResolution.Sources,
+			TrustedArcSealers: config.GetConfiguration().Server.SenderResolution.TrustedArcSealers,
+			Resolver:          resolver,
+		}
+	}
+
+	if command == "import" {
+		exitStatus = importMail(flags.Import.Maildir, flags.Import.Mbox, processOptions{
+			dryRun:    flags.Import.DryRun,
+			storeOnly: flags.Import.StoreOnly,
+		}, &mailing.MailServer{
+			Verifier:       verifier,
+			SenderResolver: senderResolver,
+		})
+		return
+	}
 
-		template := config.GetTemplateByEmail(from)
+	limiter := &mailing.Limiter{Limits: config.GetConfiguration().Server.Limits.Limits}
 
-		if template == nil {
-			log.Warnf("sender %s did not match any template. Email will be stored in spam", from)
-			spam := mailing.SpamMail{
-				ID:        uuid.NewV4().String(),
-				Body:      data,
-				Email:     from,
-				Subject:   subject,
-				IpAddress: ip.String(),
-				CreatedAt: time.Now(),
-			}
-			if err := persistence.Save(&spam); err != nil {
-				log.Errorf("failed to save spam mail from %s, %s", ip.String(), from)
-			}
+	workers := config.GetConfiguration().Server.Workers
+	pool := &mailing.WorkerPool{
+		Workers:   workers.Count,
+		QueueSize: workers.QueueSize,
+		Handler:   handler,
+	}
+	pool.Start()
+
+	var spool mailing.Spool
+	switch strings.ToLower(config.GetConfiguration().Server.Spool.Type) {
+	case config.SPOOL_DATABASE:
+		spool = mailing.DatabaseSpool{}
+	case config.SPOOL_DIRECTORY:
+		if spool, err = mailing.NewDirectorySpool(config.GetConfiguration().Server.Spool.Directory); err != nil {
+			log.Error(err)
 			return
 		}
+	}
+
+	for _, source := range config.GetConfiguration().Imap {
+		pollers = append(pollers, &mailing.IMAPPoller{
+			Name:            source.Name,
+			Address:         source.Address,
+			TLS:             source.Tls,
+			Insecure:        source.Insecure,
+			Username:        source.Username,
+			Password:        source.Password,
+			Folder:          source.Folder,
+			ProcessedAction: source.ProcessedAction,
+			ProcessedFolder: source.ProcessedFolder,
+			PollInterval:    source.PollInterval,
+			Idle:            source.Idle,
+			Server: &mailing.MailServer{
+				Name:           source.Name,
+				Verifier:       verifier,
+				SenderResolver: senderResolver,
+				Pool:           pool,
+			},
+		})
+	}
 
-		email := mailing.TransactionEmail{
-			ID:         uuid.NewV4().String(),
-			CreatedAt:  time.Now(),
-			Body:       data,
-			IpAddress:  ip.String(),
-			Subject:    subject,
-			From:       from,
-			Recipients: strings.Join(to, ","),
+	if smsConfig := config.GetConfiguration().Sms; smsConfig.Enabled {
+		webhook = &sms.Webhook{
+			Address: smsConfig.Address,
+			Path:    smsConfig.Path,
+			Token:   smsConfig.Token,
+			Handler: processSms,
 		}
+	}
 
-		log.Debugf("saving transaction email [server=%s, sender=%s]", ip.String(), from)
-		if err := persistence.Save(&email); err != nil {
-			log.Errorf("failed to save mail from [server=%s, sender=%s] for template %s. %s",
-				from, ip.String(), template.TemplateName, err.Error())
+	if apiConfig := config.GetConfiguration().Api; apiConfig.Enabled {
+		references := config.GetConfiguration().References
+		apiServer = &api.Server{
+			Address:    apiConfig.Address,
+			Token:      apiConfig.Token,
+			References: &references,
 		}
+	}
 
-		log.Debugf("parsing transaaction from %s using template %s.", from, template.TemplateName)
-		transaction, err := transaction.ParseTransaction(data, template)
+	for _, listener := range config.GetListeners() {
+		if config.GetConfiguration().Server.Disabled {
+			break
+		}
+		allowlist, err := mailing.NewAllowlist(listener.AllowedNetworks)
 		if err != nil {
-			log.Errorf("failed to parse transaction. %s", err.Error())
+			log.Errorf("Error reading allowlist of listener %s. %s", listener.Name, err.Error())
 			return
 		}
+		daemon.Servers = append(daemon.Servers, &mailing.MailServer{
+			Name:               listener.Name,
+			Protocol:           listener.Protocol,
+			Network:            listener.Network,
+			Address:            listener.Address,
+			ImplicitTLS:        listener.ImplicitTls,
+			Mailboxes:          listener.Mailboxes,
+			UseTLS:             listener.UseTls,
+			TLSPolicy:          listener.TlsPolicy,
+			ImplicitTLSAddress: listener.ImplicitTlsAddress,
+			TLSMinVersion:      listener.TlsMinVersion,
+			TLSCipherSuites:    listener.TlsCipherSuites,
+			CertificateFile:    listener.CertificateFile,
+			KeyFile:            listener.KeyFile,
+			KeyPassphrase:      listener.KeyPassphrase,
+			AuthMechanisms:     listener.Auth.Mechanisms,
+			AuthRequired:       listener.Auth.Required,
+			AllowInsecureAuth:  listener.Auth.AllowInsecure,
+			Credentials:        listener.Auth.Credentials,
+			Limiter:            limiter,
+			Allowlist:          allowlist,
+			Verifier:           verifier,
+			SenderResolver:     senderResolver,
+			Pool:               pool,
+			Spool:              spool,
+			SrcAddrVerifier:    mailboxVerifier,
+		})
+	}
 
-		if err := persistence.Save(transaction); err != nil {
-			log.Errorf("failed to save transaction. %s", err.Error())
-		}
-
-		callback := messaging.NotificationData{
-			CreatedAt:              time.Now(),
-			TemplateName:           transaction.TemplateName,
-			Date:                   transaction.Date,
-			Amount:                 transaction.Amount,
-			Currency:               transaction.Currency,
-			AccountNumber:          transaction.AccountNumber,
-			VendorReferenceId:      transaction.VendorReferenceId,
-			TransactionReferenceId: transaction.TransactionReferenceId,
+	if spool != nil && len(daemon.Servers) > 0 {
+		recovered, err := daemon.Recover(spool)
+		if err != nil {
+			log.Error(err)
+			return
 		}
-		notificationLog := messaging.TransactionNotification{
-			FromEmail:    from,
-			Sent:         false,
-			CreatedAt:    time.Now(),
-			ID:           uuid.NewV4().String(),
-			TemplateName: transaction.TemplateName,
-			Url:          config.GetConfiguration().Callback.ForwardURL,
+		if recovered > 0 {
+			log.Infof("recovered %d spooled mails", recovered)
 		}
+	}
 
-		if err := notificationLog.Post(config.GetConfiguration().Callback.ForwardToken, &callback); err != nil {
-			log.Errorf("failure posting notification for transaction from %s. %s", from, err.Error())
-		}
+	exitChannel := make(chan int)
 
-		if err := persistence.Save(&callback); err != nil {
-			log.Errorf("failure saving notification. %s. response was %s", err.Error(), notificationLog.StatusText)
-		}
+	if len(daemon.Servers) > 0 {
+		go func() {
+			log.Debug("starting mail server...")
+			if err := daemon.Start(); err != nil {
+				exitChannel <- 1
+				log.Error(err)
+			}
+		}()
 	}
 
-	mailServer = &mailing.MailServer{
-		Address:         config.GetConfiguration().Server.Address,
-		UseTLS:          config.GetConfiguration().Server.UseTls,
-		CertificateFile: config.GetConfiguration().Server.CertificateFile,
-		KeyFile:         config.GetConfiguration().Server.KeyFile,
-		KeyPassphrase:   config.GetConfiguration().Server.KeyPassphrase,
-		Handler:         handler,
-		SrcAddrVerifier: mailboxVerifier,
+	for _, poller := range pollers {
+		go func(poller *mailing.IMAPPoller) {
+			log.Debugf("starting IMAP poller %s...", poller.Name)
+			if err := poller.Start(); err != nil {
+				exitChannel <- 1
+				log.Error(err)
+			}
+		}(poller)
 	}
 
-	exitChannel := make(chan int)
+	if webhook != nil {
+		go func() {
+			log.Debug("starting SMS webhook...")
+			if err := webhook.Start(); err != nil {
+				exitChannel <- 1
+				log.Error(err)
+			}
+		}()
+	}
 
-	go func() {
-		log.Debug("starting mail server...")
-		defer func() {
-			log.Info("shutting down daemon...")
-			if err := mailServer.Shutdown(context.Background()); err != nil {
-				log.Errorf("error during server shutdown %s", err.Error())
+	if apiServer != nil {
+		go func() {
+			log.Debug("starting API...")
+			if err := apiServer.Start(); err != nil {
+				exitChannel <- 1
+				log.Error(err)
 			}
 		}()
-		if err := mailServer.Start(); err != nil {
+	}
+
+	retrier = &messaging.Retrier{Token: config.GetConfiguration().Callback.ForwardToken}
+	go func() {
+		log.Debug("starting notification retrier...")
+		if err := retrier.Start(); err != nil {
 			exitChannel <- 1
 			log.Error(err)
 		}
@@ -233,4 +417,43 @@ func main() {
 	log.Debug("Up and running. Waiting for signals")
 
 	exitStatus = <-exitChannel
+
+	// Stop accepting mail, then let the workers finish before the deferred database cleanup runs
+	shutdownTimeout := workers.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = SHUTDOWN_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	log.Info("shutting down daemon...")
+	if err := daemon.Shutdown(ctx); err != nil {
+		log.Errorf("error during server shutdown %s", err.Error())
+	}
+	for _, poller := range pollers {
+		if err := poller.Shutdown(ctx); err != nil {
+			log.Errorf("error during IMAP poller shutdown %s", err.Error())
+		}
+	}
+	if webhook != nil {
+		if err := webhook.Shutdown(ctx); err != nil {
+			log.Errorf("error during SMS webhook shutdown %s", err.Error())
+		}
+	}
+	if apiServer != nil {
+		if err := apiServer.Shutdown(ctx); err != nil {
+			log.Errorf("error during API shutdown %s", err.Error())
+		}
+	}
+	log.Infof("waiting for %d queued messages to be processed...", pool.Pending())
+	if err := pool.Shutdown(ctx); err != nil {
+		log.Errorf("error draining processing queue. %s", err.Error())
+	}
+	if err := retrier.Shutdown(ctx); err != nil {
+		log.Errorf("error during notification retrier shutdown %s", err.Error())
+	}
+
+	stats := daemon.Stats()
+	log.Infof("rejected connections: %d, throttled connections: %d, throttled messages: %d, deferred messages: %d",
+		stats.RejectedConnections, stats.ThrottledConnections, stats.ThrottledMessages, stats.DeferredMessages)
 }
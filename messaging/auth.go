@@ -0,0 +1,147 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+const (
+	// HTTP basic authentication with Username and Password
+	AUTH_BASIC = "basic"
+	// OAuth2 client credentials grant. The access token is sent as a bearer token
+	AUTH_OAUTH2 = "oauth2"
+
+	// Used when CallbackAuth.RefreshBefore is not set
+	DEFAULT_TOKEN_REFRESH_BEFORE = time.Minute
+	// Used when the token response does not state when the token expires
+	DEFAULT_TOKEN_LIFETIME = 5 * time.Minute
+)
+
+var AuthTypes = []string{AUTH_BASIC, AUTH_OAUTH2}
+
+// Authentication of callback requests, in addition to the X-Go-Transact-Token header
+type CallbackAuth struct {
+	// AUTH_BASIC or AUTH_OAUTH2. Empty = none
+	Type     string `yaml:"type"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Token endpoint of the authorization server. The client ID and secret are sent with basic authentication
+	TokenUrl     string   `yaml:"tokenUrl"`
+	ClientId     string   `yaml:"clientId"`
+	ClientSecret string   `yaml:"clientSecret"`
+	Scopes       []string `yaml:"scopes"`
+	// Required by some authorization servers, i.e, Auth0
+	Audience string `yaml:"audience"`
+	// How long before it expires a token is replaced. Default = DEFAULT_TOKEN_REFRESH_BEFORE
+	RefreshBefore time.Duration `yaml:"refreshBefore"`
+	// TLS settings of TokenUrl. The TLS settings of the callback url do not apply, empty = system defaults
+	Tls ClientTLS `yaml:"tls"`
+}
+
+// Access token cached by an endpoint
+type accessToken struct {
+	lock  sync.Mutex
+	value string
+	// Before expiry, see CallbackAuth.RefreshBefore
+	refreshAt time.Time
+}
+
+// Adds the authentication of the endpoint to the request
+func (e *endpoint) authorize(request *http.Request) error {
+	auth := e.options.Auth
+	switch auth.Type {
+	case AUTH_BASIC:
+		request.SetBasicAuth(auth.Username, auth.Password)
+	case AUTH_OAUTH2:
+		token, err := e.token()
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// Returns the cached access token, or requests a new one if it is about to expire
+func (e *endpoint) token() (string, error) {
+	e.accessToken.lock.Lock()
+	defer e.accessToken.lock.Unlock()
+
+	if !utils.IsStringEmpty(e.accessToken.value) && time.Now().Before(e.accessToken.refreshAt) {
+		return e.accessToken.value, nil
+	}
+
+	auth := e.options.Auth
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(auth.Scopes) > 0 {
+		form.Set("scope", strings.Join(auth.Scopes, " "))
+	}
+	if !utils.IsStringEmpty(auth.Audience) {
+		form.Set("audience", auth.Audience)
+	}
+	request, err := http.NewRequest(http.MethodPost, auth.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failure creating token request %s", err)
+	}
+	request.SetBasicAuth(url.QueryEscape(auth.ClientId), url.QueryEscape(auth.ClientSecret))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("User-Agent", fmt.Sprintf("%s/%d", USER_AGENT_STRING, USER_AGENT_VERSION))
+
+	response, err := e.tokenClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failure requesting access token from %s. %s", auth.TokenUrl, err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return "", fmt.Errorf("failure reading access token from %s. %s", auth.TokenUrl, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint %s returned %d", auth.TokenUrl, response.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("invalid token response from %s. %s", auth.TokenUrl, err)
+	}
+	if utils.IsStringEmpty(token.AccessToken) || (!utils.IsStringEmpty(token.TokenType) && !strings.EqualFold(token.TokenType, "bearer")) {
+		return "", fmt.Errorf("token endpoint %s did not return a bearer token", auth.TokenUrl)
+	}
+
+	lifetime := DEFAULT_TOKEN_LIFETIME
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	// Short lived tokens are used for half of their lifetime
+	refreshBefore := auth.RefreshBefore
+	if refreshBefore <= 0 {
+		refreshBefore = DEFAULT_TOKEN_REFRESH_BEFORE
+	}
+	if refreshBefore > lifetime/2 {
+		refreshBefore = lifetime / 2
+	}
+	e.accessToken.value = token.AccessToken
+	e.accessToken.refreshAt = time.Now().Add(lifetime - refreshBefore)
+	return token.AccessToken, nil
+}
+
+// Drops the cached access token, i.e, when it was rejected before it expired
+func (e *endpoint) invalidateToken() {
+	e.accessToken.lock.Lock()
+	defer e.accessToken.lock.Unlock()
+	e.accessToken.value = ""
+}
@@ -0,0 +1,222 @@
+package messaging
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallbackAuth(t *testing.T) {
+	var tokens, rejected, tokenDown int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&tokenDown) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "client" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("scope") != "payments:write" || r.FormValue("audience") != "vendor" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n := atomic.AddInt32(&tokens, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token-" + string(rune('0'+n)),
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("/oauth2", func(w http.ResponseWriter, r *http.Request) {
+		// The first token is revoked after one use
+		if r.Header.Get("Authorization") == "Bearer token-1" && atomic.AddInt32(&rejected, 1) > 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token-1" && r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	mux.HandleFunc("/bearer", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer token-") {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/basic", func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "vendor" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	mux.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "key" || r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	defer ConfigureEndpoints(EndpointOptions{})
+
+	post := func(path string) error {
+		notification := NewTransactionNotification()
+		notification.Url = server.URL + path
+		return notification.Post("token12345", &NotificationData{})
+	}
+
+	options := EndpointOptions{Auth: CallbackAuth{
+		Type:         AUTH_OAUTH2,
+		TokenUrl:     server.URL + "/token",
+		ClientId:     "client",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"payments:write"},
+		Audience:     "vendor",
+	}}
+	ConfigureEndpoints(options)
+	if err := post("/oauth2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := post("/oauth2"); err == nil {
+		t.Fatal("revoked token was accepted")
+	}
+	if tokens != 1 {
+		t.Fatalf("token requested %d times, expected the token to be cached", tokens)
+	}
+	// The rejected token is replaced
+	if err := post("/oauth2"); err != nil {
+		t.Fatal(err)
+	}
+	if tokens != 2 {
+		t.Fatalf("token requested %d times after it was rejected, expected 2", tokens)
+	}
+
+	options.Auth.ClientSecret = "wrong"
+	ConfigureEndpoints(options)
+	if err := post("/oauth2"); err == nil {
+		t.Error("callback was sent without a token")
+	}
+
+	// Failed token requests give the slot back and do not count against the breaker
+	options.Auth.ClientSecret = "s3cret"
+	options.MaxConcurrent = 1
+	options.Timeout = 100 * time.Millisecond
+	options.CircuitBreaker.Enabled = true
+	options.CircuitBreaker.FailureThreshold = 1
+	options.CircuitBreaker.OpenDuration = time.Hour
+	ConfigureEndpoints(options)
+	atomic.StoreInt32(&tokenDown, 1)
+	for i := 0; i < 2; i++ {
+		if err := post("/bearer"); err == nil || errors.Is(err, ErrEndpointBusy) || errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("expected the token request to fail, got %v", err)
+		}
+	}
+	atomic.StoreInt32(&tokenDown, 0)
+	if err := post("/bearer"); err != nil {
+		t.Fatal(err)
+	}
+	// No token is requested while the breaker is open
+	if err := post("/down"); err == nil {
+		t.Fatal("callback to a failing url was sent")
+	}
+	getEndpoint(server.URL + "/down").invalidateToken()
+	requested := atomic.LoadInt32(&tokens)
+	if err := post("/down"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected the breaker to be open, got %v", err)
+	}
+	if atomic.LoadInt32(&tokens) != requested {
+		t.Error("token was requested while the breaker was open")
+	}
+
+	ConfigureEndpoints(EndpointOptions{Auth: CallbackAuth{Type: AUTH_BASIC, Username: "vendor", Password: "pass"}})
+	if err := post("/basic"); err != nil {
+		t.Error(err)
+	}
+
+	ConfigureEndpoints(EndpointOptions{Headers: map[string]string{"X-Api-Key": "key"}})
+	if err := post("/headers"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenServerTLS(t *testing.T) {
+	// The token server has a certificate of its own CA, unrelated to the CA of the callback url
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "auth.vendor.tld"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "expires_in": 3600})
+	}))
+	tokenServer.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	tokenServer.StartTLS()
+	defer tokenServer.Close()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	defer ConfigureEndpoints(EndpointOptions{})
+
+	callbackTls := ClientTLS{CaFile: writePEM(t, "callback.pem", "CERTIFICATE", server.Certificate().Raw)}
+	tokenTls := ClientTLS{CaFile: writePEM(t, "token.pem", "CERTIFICATE", der)}
+	auth := CallbackAuth{Type: AUTH_OAUTH2, TokenUrl: tokenServer.URL, ClientId: "client", ClientSecret: "s3cret"}
+	cases := []struct {
+		name     string
+		tls      ClientTLS
+		tokenTls ClientTLS
+		success  bool
+	}{
+		{"token server CA", callbackTls, tokenTls, true},
+		// callback.tls does not apply to the token url
+		{"callback CA only", callbackTls, ClientTLS{}, false},
+		{"token server CA only", ClientTLS{}, tokenTls, false},
+	}
+	for _, c := range cases {
+		auth.Tls = c.tokenTls
+		if err := ConfigureEndpoints(EndpointOptions{Tls: c.tls, Auth: auth}); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		notification := NewTransactionNotification()
+		notification.Url = server.URL
+		err := notification.Post("token12345", &NotificationData{})
+		if c.success && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !c.success && err == nil {
+			t.Errorf("%s: callback was accepted", c.name)
+		}
+	}
+}
@@ -10,28 +10,51 @@ import (
 	"time"
 
 	"github.com/twinj/uuid"
+
+	"github.com/SharkFourSix/go-transact/reconciliation"
 )
 
 const (
 	USER_AGENT_VERSION           = 1
 	USER_AGENT_STRING            = "go-transact"
 	HTTP_REQUEST_TIMEOUT_SECONDS = 15
+
+	// A transaction was parsed. Replaced by the reconciliation event, if any
+	EVENT_TRANSACTION_RECEIVED = "transaction.received"
 )
 
 type TransactionNotification struct {
 	ID        string `gorm:"primaryKey"`
 	CreatedAt time.Time
-	Url       string
-	Data      string
+	// Url of the last attempt
+	Url  string
+	Data string
+	// Request headers in addition to the defaults, as JSON. Sent again on replay
+	Headers string
 	// True = Successfully sent, False = Failure sending
 	Sent         bool
 	StatusText   string
 	ResponseText string
 	FromEmail    string
 	TemplateName string
+	// NOTIFICATION_SENT, NOTIFICATION_PENDING, NOTIFICATION_DEAD_LETTER or NOTIFICATION_RESOLVED. Empty for
+	// notifications stored before the dead-letter queue, see DeadLetters
+	State    string `gorm:"index"`
+	Attempts int
+	// When a pending notification is retried
+	NextAttemptAt *time.Time `gorm:"index"`
+	// Set when a dead letter is resolved without being sent
+	ResolvedAt     *time.Time
+	ResolutionNote string
+
+	// The last send was refused by the endpoint's circuit breaker or concurrency limit, see Store
+	deferred bool
 }
 
 type NotificationData struct {
+	// EVENT_TRANSACTION_RECEIVED, EVENT_TRANSACTION_DUPLICATE, reconciliation.EVENT_PARTIAL_PAYMENT or
+	// reconciliation.EVENT_FULLY_PAID
+	Event                  string
 	CreatedAt              time.Time
 	TemplateName           string
 	Date                   string
@@ -40,6 +63,8 @@ type NotificationData struct {
 	AccountNumber          string
 	VendorReferenceId      string
 	TransactionReferenceId string
+	// Match against the expected payments. Nil when reconciliation is disabled
+	Reconciliation *reconciliation.Match `gorm:"-"`
 }
 
 func NewTransactionNotification() *TransactionNotification {
@@ -52,6 +77,11 @@ func NewTransactionNotification() *TransactionNotification {
 // Post Attempt to send this notification to the specified callback url.
 // 	The notification will automatically be updated with status results and response data.
 func (n *TransactionNotification) Post(token string, data *NotificationData) error {
+	return n.post(token, data, nil)
+}
+
+// Sends data as JSON. headers are added to the request and may replace the default Content-Type
+func (n *TransactionNotification) post(token string, data interface{}, headers map[string]string) error {
 	var err error
 	var body []byte
 
@@ -61,13 +91,31 @@ func (n *TransactionNotification) Post(token string, data *NotificationData) err
 		n.ResponseText = response
 	}
 
-	if body, err = json.Marshal(&data); err != nil {
+	if body, err = json.Marshal(data); err != nil {
 		err = fmt.Errorf("failure serializing request data %s", err)
 		setStatus(false, err.Error(), "")
 		return err
 	}
+	return n.send(token, body, headers)
+}
+
+// Sends body as is. headers are added to the request and may replace the default Content-Type
+func (n *TransactionNotification) send(token string, body []byte, headers map[string]string) error {
+	var err error
+
+	setStatus := func(sent bool, status string, response string) {
+		n.Sent = sent
+		n.StatusText = status
+		n.ResponseText = response
+	}
 
+	n.deferred = false
 	n.Data = string(body[:])
+	n.Headers = ""
+	if len(headers) > 0 {
+		encoded, _ := json.Marshal(headers)
+		n.Headers = string(encoded)
+	}
 
 	request, err := http.NewRequest("POST", n.Url, bytes.NewBuffer(body))
 	if err != nil {
@@ -77,24 +125,50 @@ func (n *TransactionNotification) Post(token string, data *NotificationData) err
 	}
 
 	request.Header.Set("X-Go-Transact-Token", token)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(IDEMPOTENCY_KEY_HEADER, n.ID)
+	endpoint := getEndpoint(n.Url)
+	for name, value := range endpoint.options.Headers {
+		request.Header.Set(name, value)
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
 	request.Header.Set("Date", time.Now().UTC().String())
 	request.Header.Set("User-Agent", fmt.Sprintf("%s/%d", USER_AGENT_STRING, USER_AGENT_VERSION))
 
-	client := &http.Client{
-		Timeout:       time.Second * HTTP_REQUEST_TIMEOUT_SECONDS,
-		CheckRedirect: http.DefaultClient.CheckRedirect,
+	// Nothing is sent, not even a token request, while the breaker is open or the endpoint is busy
+	done, cancel, err := endpoint.acquire()
+	if err != nil {
+		n.deferred = true
+		err = fmt.Errorf("callback to %s not sent. %w", n.Url, err)
+		setStatus(false, err.Error(), "")
+		return err
+	}
+	if err := endpoint.authorize(request); err != nil {
+		cancel()
+		err = fmt.Errorf("callback to %s not sent. %s", n.Url, err)
+		setStatus(false, err.Error(), "")
+		return err
 	}
 
-	response, err := client.Do(request)
+	response, err := endpoint.client.Do(request)
 	if err != nil {
+		done(true)
 		err = fmt.Errorf("failure sending request to %s. %s", n.Url, err)
 		setStatus(false, err.Error(), "")
 		return err
 	}
 	defer response.Body.Close()
+	// Only server errors count against the breaker, the endpoint is up if it rejects a request
+	done(response.StatusCode >= http.StatusInternalServerError)
+	if response.StatusCode == http.StatusUnauthorized {
+		endpoint.invalidateToken()
+	}
 
-	if response.StatusCode == 200 {
-		setStatus(true, "Callback posted", "200 OK")
+	// Any 2xx is accepted, i.e, 202 from queueing receivers such as Knative brokers
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		setStatus(true, "Callback posted", response.Status)
 		return nil
 	} else {
 		err = fmt.Errorf("server returned %d", response.StatusCode)
@@ -0,0 +1,66 @@
+package messaging
+
+import (
+	"net/url"
+	"time"
+)
+
+const (
+	CLOUDEVENTS_SPEC_VERSION = "1.0"
+	// The whole event is the body, with Content-Type application/cloudevents+json
+	CLOUDEVENTS_STRUCTURED = "structured"
+	// The data is the body and the attributes are sent in ce-* headers
+	CLOUDEVENTS_BINARY = "binary"
+	// Prepended to the event to form the CloudEvents type, i.e, go-transact.transaction.received
+	CLOUDEVENTS_TYPE_PREFIX = "go-transact."
+)
+
+var CloudEventsModes = []string{CLOUDEVENTS_STRUCTURED, CLOUDEVENTS_BINARY}
+
+// Event posted in CLOUDEVENTS_STRUCTURED mode
+type CloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// Returns the CloudEvents source of the notification, /<template>/<mailbox or SMS sender>
+func (n *TransactionNotification) source() string {
+	return "/" + url.PathEscape(n.TemplateName) + "/" + url.PathEscape(n.FromEmail)
+}
+
+// PostCloudEvent Sends the event as a CloudEvent identified by the notification ID, in CLOUDEVENTS_STRUCTURED
+// or CLOUDEVENTS_BINARY mode. subject is optional, i.e, the vendor reference
+func (n *TransactionNotification) PostCloudEvent(token string, mode string, event string, subject string, data interface{}) error {
+	cloudEvent := &CloudEvent{
+		SpecVersion:     CLOUDEVENTS_SPEC_VERSION,
+		ID:              n.ID,
+		Source:          n.source(),
+		Type:            CLOUDEVENTS_TYPE_PREFIX + event,
+		Subject:         subject,
+		Time:            n.CreatedAt.UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+	if mode != CLOUDEVENTS_BINARY {
+		return n.post(token, cloudEvent, map[string]string{"Content-Type": "application/cloudevents+json"})
+	}
+
+	headers := map[string]string{
+		"Content-Type":   cloudEvent.DataContentType,
+		"ce-specversion": cloudEvent.SpecVersion,
+		"ce-id":          cloudEvent.ID,
+		"ce-source":      cloudEvent.Source,
+		"ce-type":        cloudEvent.Type,
+		"ce-time":        cloudEvent.Time.Format(time.RFC3339Nano),
+	}
+	if subject != "" {
+		headers["ce-subject"] = subject
+	}
+	return n.post(token, data, headers)
+}
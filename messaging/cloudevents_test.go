@@ -0,0 +1,72 @@
+package messaging
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPostCloudEvent(t *testing.T) {
+	var (
+		header   http.Header
+		received map[string]interface{}
+		status   = http.StatusOK
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		received = nil
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	notification := NewTransactionNotification()
+	notification.Url = server.URL
+	notification.TemplateName = "National Bank"
+	notification.FromEmail = "alerts@bank.tld"
+	data := &TransactionData{TransactionId: "9b1d6f", VendorReferenceId: "VRIF0XA65FE2"}
+	source := "/National%20Bank/alerts@bank.tld"
+
+	if err := notification.PostCloudEvent("token12345", CLOUDEVENTS_STRUCTURED, EVENT_TRANSACTION_RECEIVED, data.VendorReferenceId, data); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Type") != "application/cloudevents+json" {
+		t.Errorf("unexpected content type %s", header.Get("Content-Type"))
+	}
+	if received["specversion"] != CLOUDEVENTS_SPEC_VERSION || received["id"] != notification.ID || received["source"] != source ||
+		received["type"] != "go-transact.transaction.received" || received["subject"] != data.VendorReferenceId {
+		t.Errorf("unexpected structured event %v", received)
+	}
+	if received["data"].(map[string]interface{})["transactionId"] != data.TransactionId {
+		t.Errorf("unexpected data %v", received["data"])
+	}
+
+	if err := notification.PostCloudEvent("token12345", CLOUDEVENTS_BINARY, EVENT_PARSE_FAILED, "", data); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Type") != "application/json" || header.Get("ce-specversion") != CLOUDEVENTS_SPEC_VERSION ||
+		header.Get("ce-id") != notification.ID || header.Get("ce-source") != source || header.Get("ce-type") != "go-transact.parse.failed" ||
+		header.Get("ce-time") == "" || header.Get("ce-subject") != "" {
+		t.Errorf("unexpected binary headers %v", header)
+	}
+	if received["transactionId"] != data.TransactionId {
+		t.Errorf("binary body is not the data. %v", received)
+	}
+
+	// Brokers such as Knative answer 202 Accepted, others 204 No Content
+	for _, status = range []int{http.StatusAccepted, http.StatusNoContent} {
+		if err := notification.PostCloudEvent("token12345", CLOUDEVENTS_BINARY, EVENT_TRANSACTION_RECEIVED, data.VendorReferenceId, data); err != nil {
+			t.Errorf("%d: %v", status, err)
+		}
+		if !notification.Sent {
+			t.Errorf("%d: notification was not marked sent", status)
+		}
+	}
+	status = http.StatusMultipleChoices
+	if err := notification.PostCloudEvent("token12345", CLOUDEVENTS_BINARY, EVENT_TRANSACTION_RECEIVED, data.VendorReferenceId, data); err == nil {
+		t.Error("300 was accepted")
+	}
+}
@@ -0,0 +1,160 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/twinj/uuid"
+
+	"github.com/SharkFourSix/go-transact/persistence"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+const (
+	NOTIFICATION_SENT = "sent"
+	// The callback failed and is retried at NextAttemptAt, see RetryOptions
+	NOTIFICATION_PENDING = "pending"
+	// The last attempt failed and the callback awaits a replay or a resolution
+	NOTIFICATION_DEAD_LETTER = "dead-letter"
+	// A dead letter that was dealt with without being sent, see ResolutionNote
+	NOTIFICATION_RESOLVED = "resolved"
+)
+
+// One attempt at sending a notification. Attempts are kept when the notification is replayed or resolved.
+// Requires NotificationAttempt to be migrated
+type NotificationAttempt struct {
+	ID             string `gorm:"primaryKey"`
+	CreatedAt      time.Time
+	NotificationId string `gorm:"index"`
+	Url            string
+	Sent           bool
+	StatusText     string
+	ResponseText   string
+}
+
+// Store Saves the notification and the outcome of its latest attempt. Notifications that were not sent are retried
+// with a backoff and moved to the dead-letter queue after the last attempt, see RetryOptions. Sends refused by the
+// circuit breaker or the concurrency limit are retried without counting as an attempt. Notifications without a body,
+// such as payloads that failed to render, cannot be retried and are moved to the dead-letter queue right away
+func (n *TransactionNotification) Store() error {
+	retry := retryOptions()
+	n.NextAttemptAt = nil
+	if n.deferred && !utils.IsStringEmpty(n.Data) {
+		next := time.Now().Add(retry.InitialBackoff)
+		n.State = NOTIFICATION_PENDING
+		n.NextAttemptAt = &next
+		return persistence.Update(n)
+	}
+
+	n.Attempts++
+	switch {
+	case n.Sent:
+		n.State = NOTIFICATION_SENT
+	case utils.IsStringEmpty(n.Data):
+		n.State = NOTIFICATION_DEAD_LETTER
+	case n.Attempts < retry.MaxAttempts:
+		next := time.Now().Add(retry.backoff(n.Attempts))
+		n.State = NOTIFICATION_PENDING
+		n.NextAttemptAt = &next
+	default:
+		n.State = NOTIFICATION_DEAD_LETTER
+	}
+	attempt := &NotificationAttempt{
+		ID:             uuid.NewV4().String(),
+		CreatedAt:      time.Now(),
+		NotificationId: n.ID,
+		Url:            n.Url,
+		Sent:           n.Sent,
+		StatusText:     n.StatusText,
+		ResponseText:   n.ResponseText,
+	}
+	if err := persistence.Save(attempt); err != nil {
+		return err
+	}
+	return persistence.Update(n)
+}
+
+// Replay Sends the stored body and headers again, to url if set or else to the url of the last attempt.
+// The idempotency key is unchanged. The attempt is stored
+func (n *TransactionNotification) Replay(token string, url string) error {
+	if n.State == NOTIFICATION_SENT || (utils.IsStringEmpty(n.State) && n.Sent) {
+		return fmt.Errorf("notification %s was already sent", n.ID)
+	}
+	var headers map[string]string
+	if !utils.IsStringEmpty(n.Headers) {
+		if err := json.Unmarshal([]byte(n.Headers), &headers); err != nil {
+			return fmt.Errorf("invalid headers of notification %s. %v", n.ID, err)
+		}
+	}
+	if utils.IsStringEmpty(n.Data) {
+		err := fmt.Errorf("notification %s has no body to send", n.ID)
+		n.Sent = false
+		n.StatusText = err.Error()
+		n.ResponseText = ""
+		if storeErr := n.Store(); storeErr != nil {
+			return fmt.Errorf("error saving attempt. %v", storeErr)
+		}
+		return err
+	}
+	if !utils.IsStringEmpty(url) {
+		n.Url = url
+	}
+	err := n.send(token, []byte(n.Data), headers)
+	if storeErr := n.Store(); storeErr != nil {
+		return fmt.Errorf("error saving attempt. %v", storeErr)
+	}
+	return err
+}
+
+// Resolve Takes the notification out of the dead-letter queue without sending it
+func (n *TransactionNotification) Resolve(note string) error {
+	if utils.IsStringEmpty(note) {
+		return fmt.Errorf("a note is required")
+	}
+	if n.State == NOTIFICATION_SENT || (utils.IsStringEmpty(n.State) && n.Sent) {
+		return fmt.Errorf("notification %s was sent", n.ID)
+	}
+	now := time.Now()
+	n.State = NOTIFICATION_RESOLVED
+	n.ResolvedAt = &now
+	n.ResolutionNote = note
+	return persistence.Update(n)
+}
+
+// History Returns the attempts at sending the notification, oldest first
+func (n *TransactionNotification) History() ([]NotificationAttempt, error) {
+	var attempts []NotificationAttempt
+	if err := persistence.Find(&attempts, "notification_id = ?", n.ID); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(attempts, func(i, j int) bool { return attempts[i].CreatedAt.Before(attempts[j].CreatedAt) })
+	return attempts, nil
+}
+
+// GetNotification Returns the notification with the id. Returns an error matched by persistence.IsNotFound if there is none
+func GetNotification(id string) (*TransactionNotification, error) {
+	var notification TransactionNotification
+	if err := persistence.First(&notification, "id = ?", id); err != nil {
+		return nil, err
+	}
+	return &notification, nil
+}
+
+// DeadLetters Returns the notifications in the dead-letter queue, oldest first. Notifications that failed before
+// the queue existed are included. Resolved notifications are included if resolved is true
+func DeadLetters(resolved bool) ([]TransactionNotification, error) {
+	query := "state = ? OR ((state IS NULL OR state = '') AND sent = ?)"
+	args := []interface{}{NOTIFICATION_DEAD_LETTER, false}
+	if resolved {
+		query = "state IN ? OR ((state IS NULL OR state = '') AND sent = ?)"
+		args[0] = []string{NOTIFICATION_DEAD_LETTER, NOTIFICATION_RESOLVED}
+	}
+	var notifications []TransactionNotification
+	if err := persistence.Find(&notifications, query, args...); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(notifications, func(i, j int) bool { return notifications[i].CreatedAt.Before(notifications[j].CreatedAt) })
+	return notifications, nil
+}
@@ -0,0 +1,225 @@
+package messaging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SharkFourSix/go-transact/persistence"
+)
+
+func TestDeadLetters(t *testing.T) {
+	if err := persistence.Initialize(5000); err != nil {
+		t.Fatal(err)
+	}
+	defer persistence.Cleanup()
+	if err := persistence.Migrate(&TransactionNotification{}, &NotificationAttempt{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var contentType string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/up", func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	// Failed callbacks go straight to the dead-letter queue
+	ConfigureEndpoints(EndpointOptions{Retry: RetryOptions{MaxAttempts: 1}})
+	defer ConfigureEndpoints(EndpointOptions{})
+
+	inQueue := func(id string, resolved bool) bool {
+		notifications, err := DeadLetters(resolved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range notifications {
+			if n.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	fail := func() *TransactionNotification {
+		notification := NewTransactionNotification()
+		notification.Url = server.URL + "/down"
+		if err := notification.post("token12345", &NotificationData{}, map[string]string{"Content-Type": "application/cloudevents+json"}); err == nil {
+			t.Fatal("callback to a failing url was sent")
+		}
+		if err := notification.Store(); err != nil {
+			t.Fatal(err)
+		}
+		if notification.State != NOTIFICATION_DEAD_LETTER || !inQueue(notification.ID, false) {
+			t.Fatalf("failed notification is %s, expected it in the dead-letter queue", notification.State)
+		}
+		return notification
+	}
+
+	replayed := fail()
+	if err := replayed.Replay("token12345", ""); err == nil {
+		t.Error("replay to the failing url was sent")
+	}
+	if err := replayed.Replay("token12345", server.URL+"/up"); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/cloudevents+json" {
+		t.Errorf("replay was sent with Content-Type %s, expected the original headers", contentType)
+	}
+	stored, err := GetNotification(replayed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.State != NOTIFICATION_SENT || stored.Attempts != 3 || inQueue(stored.ID, true) {
+		t.Errorf("replayed notification is %s after %d attempts, expected sent after 3", stored.State, stored.Attempts)
+	}
+	attempts, err := stored.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 3 || attempts[0].Sent || attempts[1].Sent || !attempts[2].Sent || attempts[2].Url != server.URL+"/up" {
+		t.Errorf("unexpected attempts %+v", attempts)
+	}
+	if err := stored.Replay("token12345", ""); err == nil {
+		t.Error("sent notification was replayed")
+	}
+
+	resolved := fail()
+	if err := resolved.Resolve(""); err == nil {
+		t.Error("notification was resolved without a note")
+	}
+	if err := resolved.Resolve("paid by bank transfer, confirmed manually"); err != nil {
+		t.Fatal(err)
+	}
+	if inQueue(resolved.ID, false) || !inQueue(resolved.ID, true) {
+		t.Error("resolved notification is still in the dead-letter queue")
+	}
+	if attempts, _ := resolved.History(); len(attempts) != 1 {
+		t.Errorf("resolved notification has %d attempts, expected 1", len(attempts))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	if err := persistence.Initialize(5000); err != nil {
+		t.Fatal(err)
+	}
+	defer persistence.Cleanup()
+	if err := persistence.Migrate(&TransactionNotification{}, &NotificationAttempt{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	defer ConfigureEndpoints(EndpointOptions{})
+
+	options := EndpointOptions{Retry: RetryOptions{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond}}
+	ConfigureEndpoints(options)
+	send := func(url string) *TransactionNotification {
+		notification := NewTransactionNotification()
+		notification.Url = server.URL + url
+		notification.Post("token12345", &NotificationData{})
+		if err := notification.Store(); err != nil {
+			t.Fatal(err)
+		}
+		return notification
+	}
+	state := func(n *TransactionNotification) (string, int) {
+		stored, err := GetNotification(n.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored.State, stored.Attempts
+	}
+
+	flaky, down := send("/flaky"), send("/down")
+	if flaky.State != NOTIFICATION_PENDING || flaky.NextAttemptAt == nil {
+		t.Fatalf("failed notification is %s, expected it to be retried", flaky.State)
+	}
+	retrier := &Retrier{Token: "token12345"}
+	if sent := retrier.Retry(); sent != 0 {
+		t.Errorf("%d notifications were retried before the backoff elapsed", sent)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if sent := retrier.Retry(); sent != 1 {
+		t.Errorf("%d notifications were sent on retry, expected 1", sent)
+	}
+	if s, attempts := state(flaky); s != NOTIFICATION_SENT || attempts != 2 {
+		t.Errorf("retried notification is %s after %d attempts, expected sent after 2", s, attempts)
+	}
+	if s, attempts := state(down); s != NOTIFICATION_PENDING || attempts != 2 {
+		t.Errorf("failing notification is %s after %d attempts, expected pending after 2", s, attempts)
+	}
+	// The backoff doubles
+	time.Sleep(40 * time.Millisecond)
+	retrier.Retry()
+	if s, attempts := state(down); s != NOTIFICATION_DEAD_LETTER || attempts != 3 {
+		t.Errorf("failing notification is %s after %d attempts, expected a dead letter after 3", s, attempts)
+	}
+
+	// Payloads that failed to render have no body to retry
+	payload, err := (&PayloadTemplate{Body: `{"reference": "{{.VendorReferenceId}}"}`}).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := SamplePayloadData()
+	data.VendorReferenceId = `INV"1`
+	unrendered := NewTransactionNotification()
+	unrendered.Url = server.URL + "/flaky"
+	if err := unrendered.PostPayload("token12345", payload, data); err == nil {
+		t.Fatal("invalid JSON was rendered")
+	}
+	if err := unrendered.Store(); err != nil {
+		t.Fatal(err)
+	}
+	if unrendered.State != NOTIFICATION_DEAD_LETTER || unrendered.Attempts != 1 {
+		t.Errorf("unrendered notification is %s after %d attempts, expected a dead letter after 1", unrendered.State, unrendered.Attempts)
+	}
+	if err := unrendered.Replay("token12345", ""); err == nil {
+		t.Error("notification without a body was replayed")
+	}
+	if s, _ := state(unrendered); s != NOTIFICATION_DEAD_LETTER {
+		t.Errorf("replayed notification without a body is %s, expected a dead letter", s)
+	}
+
+	// Sends refused by the circuit breaker are not attempts
+	options.CircuitBreaker.Enabled = true
+	options.CircuitBreaker.FailureThreshold = 1
+	options.CircuitBreaker.OpenDuration = time.Hour
+	ConfigureEndpoints(options)
+	send("/down")
+	deferred := send("/down")
+	if deferred.State != NOTIFICATION_PENDING || deferred.Attempts != 0 {
+		t.Errorf("deferred notification is %s after %d attempts, expected pending after 0", deferred.State, deferred.Attempts)
+	}
+	time.Sleep(20 * time.Millisecond)
+	retrier.Retry()
+	if s, attempts := state(deferred); s != NOTIFICATION_PENDING || attempts != 0 {
+		t.Errorf("deferred notification is %s after %d attempts, expected pending after 0", s, attempts)
+	}
+	if attempts, _ := deferred.History(); len(attempts) != 0 {
+		t.Errorf("deferred notification has %d attempts, expected none", len(attempts))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	options := RetryOptions{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}.withDefaults()
+	for attempts, expected := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if backoff := options.backoff(attempts); backoff != expected {
+			t.Errorf("backoff after %d attempts is %s, expected %s", attempts, backoff, expected)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package messaging
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half-open"
+
+	DEFAULT_FAILURE_THRESHOLD = 5
+	DEFAULT_OPEN_DURATION     = 30 * time.Second
+	DEFAULT_HALF_OPEN_PROBES  = 1
+)
+
+var (
+	// Returned without sending when the endpoint's circuit breaker is open
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+	// Returned without sending when no slot was freed within the timeout, see EndpointOptions.MaxConcurrent
+	ErrEndpointBusy = errors.New("too many callbacks in progress")
+)
+
+// Limits, TLS settings, authentication and retries applied to each callback endpoint, by url. Zero values use the defaults
+type EndpointOptions struct {
+	// Timeout of a callback request, and longest wait for a slot. Default = HTTP_REQUEST_TIMEOUT_SECONDS
+	Timeout time.Duration `yaml:"timeout"`
+	// Most callbacks in progress at once. 0 = unlimited
+	MaxConcurrent  int `yaml:"maxConcurrent"`
+	CircuitBreaker struct {
+		Enabled bool `yaml:"enabled"`
+		// Consecutive failures after which callbacks fail fast. Default = DEFAULT_FAILURE_THRESHOLD
+		FailureThreshold int `yaml:"failureThreshold"`
+		// How long callbacks fail fast before probes are let through. Default = DEFAULT_OPEN_DURATION
+		OpenDuration time.Duration `yaml:"openDuration"`
+		// Callbacks let through at once to probe the endpoint. Default = DEFAULT_HALF_OPEN_PROBES
+		HalfOpenProbes int `yaml:"halfOpenProbes"`
+	} `yaml:"circuitBreaker"`
+	Tls  ClientTLS    `yaml:"tls"`
+	Auth CallbackAuth `yaml:"auth"`
+	// Added to every callback request, i.e, an API key required by a gateway
+	Headers map[string]string `yaml:"headers"`
+	Retry   RetryOptions      `yaml:"retry"`
+}
+
+func (o EndpointOptions) withDefaults() EndpointOptions {
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second * HTTP_REQUEST_TIMEOUT_SECONDS
+	}
+	if o.CircuitBreaker.FailureThreshold <= 0 {
+		o.CircuitBreaker.FailureThreshold = DEFAULT_FAILURE_THRESHOLD
+	}
+	if o.CircuitBreaker.OpenDuration <= 0 {
+		o.CircuitBreaker.OpenDuration = DEFAULT_OPEN_DURATION
+	}
+	if o.CircuitBreaker.HalfOpenProbes <= 0 {
+		o.CircuitBreaker.HalfOpenProbes = DEFAULT_HALF_OPEN_PROBES
+	}
+	o.Retry = o.Retry.withDefaults()
+	return o
+}
+
+// Circuit breaker, concurrency limit and HTTP client of a callback url
+type endpoint struct {
+	url     string
+	options EndpointOptions
+	client  *http.Client
+	// Used by AUTH_OAUTH2. tokenClient has the TLS settings of the token url
+	accessToken accessToken
+	tokenClient *http.Client
+	// Buffered to MaxConcurrent. Nil = unlimited
+	slots chan struct{}
+
+	lock     sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+var (
+	endpointOptions = EndpointOptions{}.withDefaults()
+	// Nil = system defaults
+	endpointTLS   *tls.Config
+	tokenTLS      *tls.Config
+	endpointsLock sync.Mutex
+	endpoints     = map[string]*endpoint{}
+)
+
+// ConfigureEndpoints Sets the limits, TLS settings and authentication of callback endpoints. Breakers are reset
+func ConfigureEndpoints(options EndpointOptions) error {
+	tlsConfig, err := options.Tls.Config()
+	if err != nil {
+		return err
+	}
+	authTLSConfig, err := options.Auth.Tls.Config()
+	if err != nil {
+		return fmt.Errorf("auth: %v", err)
+	}
+	endpointsLock.Lock()
+	defer endpointsLock.Unlock()
+	endpointOptions = options.withDefaults()
+	endpointTLS = tlsConfig
+	tokenTLS = authTLSConfig
+	endpoints = map[string]*endpoint{}
+	return nil
+}
+
+func getEndpoint(url string) *endpoint {
+	endpointsLock.Lock()
+	defer endpointsLock.Unlock()
+	e, ok := endpoints[url]
+	if !ok {
+		e = &endpoint{url: url, options: endpointOptions, state: BREAKER_CLOSED}
+		e.client = newClient(e.options.Timeout, endpointTLS)
+		e.tokenClient = newClient(e.options.Timeout, tokenTLS)
+		if e.options.MaxConcurrent > 0 {
+			e.slots = make(chan struct{}, e.options.MaxConcurrent)
+		}
+		endpoints[url] = e
+	}
+	return e
+}
+
+// Returns an HTTP client with the TLS settings. Nil = system defaults
+func newClient(timeout time.Duration, tlsConfig *tls.Config) *http.Client {
+	client := &http.Client{
+		Timeout:       timeout,
+		CheckRedirect: http.DefaultClient.CheckRedirect,
+	}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig.Clone()
+		client.Transport = transport
+	}
+	return client
+}
+
+// EndpointState Returns the state of the circuit breaker of the url, see BREAKER_*
+func EndpointState(url string) string {
+	e := getEndpoint(url)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.state
+}
+
+// Reserves a callback to the endpoint. Fails fast if the breaker is open. done must be called with the outcome once
+// the callback completed, or cancel if the request was not sent
+func (e *endpoint) acquire() (done func(failed bool), cancel func(), err error) {
+	probe := false
+	if e.options.CircuitBreaker.Enabled {
+		e.lock.Lock()
+		if e.state == BREAKER_OPEN && time.Since(e.openedAt) >= e.options.CircuitBreaker.OpenDuration {
+			log.Infof("circuit breaker of %s is half-open, probing", e.url)
+			e.state = BREAKER_HALF_OPEN
+		}
+		switch {
+		case e.state == BREAKER_OPEN:
+			e.lock.Unlock()
+			return nil, nil, ErrCircuitOpen
+		case e.state == BREAKER_HALF_OPEN && e.probes >= e.options.CircuitBreaker.HalfOpenProbes:
+			e.lock.Unlock()
+			return nil, nil, ErrCircuitOpen
+		case e.state == BREAKER_HALF_OPEN:
+			e.probes++
+			probe = true
+		}
+		e.lock.Unlock()
+	}
+
+	if e.slots != nil {
+		timer := time.NewTimer(e.options.Timeout)
+		defer timer.Stop()
+		select {
+		case e.slots <- struct{}{}:
+		case <-timer.C:
+			e.releaseProbe(probe)
+			return nil, nil, ErrEndpointBusy
+		}
+	}
+
+	done = func(failed bool) {
+		if e.slots != nil {
+			<-e.slots
+		}
+		if e.options.CircuitBreaker.Enabled {
+			e.record(probe, failed)
+		}
+	}
+	cancel = func() {
+		if e.slots != nil {
+			<-e.slots
+		}
+		e.releaseProbe(probe)
+	}
+	return done, cancel, nil
+}
+
+// Gives back a half-open probe that did not send anything
+func (e *endpoint) releaseProbe(probe bool) {
+	if probe {
+		e.lock.Lock()
+		e.probes--
+		e.lock.Unlock()
+	}
+}
+
+func (e *endpoint) record(probe bool, failed bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if probe {
+		e.probes--
+	}
+	if !failed {
+		e.failures = 0
+		if e.state != BREAKER_CLOSED {
+			log.Infof("circuit breaker of %s closed", e.url)
+			e.state = BREAKER_CLOSED
+		}
+		return
+	}
+
+	e.failures++
+	if e.state == BREAKER_HALF_OPEN || (e.state == BREAKER_CLOSED && e.failures >= e.options.CircuitBreaker.FailureThreshold) {
+		log.Warnf("circuit breaker of %s opened after %d failures. Callbacks fail fast for %s",
+			e.url, e.failures, e.options.CircuitBreaker.OpenDuration)
+		e.state = BREAKER_OPEN
+		e.openedAt = time.Now()
+	}
+}
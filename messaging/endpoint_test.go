@@ -0,0 +1,117 @@
+package messaging
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		status   int32 = http.StatusInternalServerError
+		requests int32
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	options := EndpointOptions{}
+	options.CircuitBreaker.Enabled = true
+	options.CircuitBreaker.FailureThreshold = 2
+	options.CircuitBreaker.OpenDuration = 50 * time.Millisecond
+	if err := ConfigureEndpoints(options); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureEndpoints(EndpointOptions{})
+
+	post := func() error {
+		notification := NewTransactionNotification()
+		notification.Url = server.URL
+		return notification.Post("token12345", &NotificationData{})
+	}
+
+	post()
+	post()
+	if state := EndpointState(server.URL); state != BREAKER_OPEN {
+		t.Fatalf("expected breaker to open after 2 failures, got %s", state)
+	}
+	if err := post(); !errors.Is(err, ErrCircuitOpen) || atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("callback was sent while the breaker was open. %v", err)
+	}
+
+	// A failed probe opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	post()
+	if state := EndpointState(server.URL); state != BREAKER_OPEN || atomic.LoadInt32(&requests) != 3 {
+		t.Fatalf("expected a single failed probe, got %s after %d requests", state, requests)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err := post(); err != nil {
+		t.Fatal(err)
+	}
+	if state := EndpointState(server.URL); state != BREAKER_CLOSED {
+		t.Errorf("expected breaker to close after a successful probe, got %s", state)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		if current > atomic.LoadInt32(&maxInFlight) {
+			atomic.StoreInt32(&maxInFlight, current)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	if err := ConfigureEndpoints(EndpointOptions{MaxConcurrent: 1, Timeout: 100 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureEndpoints(EndpointOptions{})
+	post := func() error {
+		notification := NewTransactionNotification()
+		notification.Url = server.URL
+		return notification.Post("token12345", &NotificationData{})
+	}
+
+	// A callback waits for a slot no longer than the timeout
+	done, _, err := getEndpoint(server.URL).acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := post(); !errors.Is(err, ErrEndpointBusy) {
+		t.Errorf("expected the callback to be refused, got %v", err)
+	}
+	done(false)
+
+	// Callbacks wait for each other
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- post()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if most := atomic.LoadInt32(&maxInFlight); most != 1 {
+		t.Errorf("expected one callback in flight at a time, got %d", most)
+	}
+}
@@ -0,0 +1,130 @@
+package messaging
+
+import (
+	_ "embed"
+	"time"
+
+	"github.com/SharkFourSix/go-transact/reconciliation"
+	"github.com/SharkFourSix/go-transact/transaction"
+)
+
+const (
+	// Bare NotificationData, as sent by earlier versions
+	FORMAT_LEGACY = "legacy"
+	// Envelope with an event type, see Envelope
+	FORMAT_ENVELOPE = "envelope"
+	// CloudEvents 1.0 over HTTP, see PostCloudEvent
+	FORMAT_CLOUDEVENTS = "cloudevents"
+
+	// Incremented on breaking changes to the envelope or the data of its events
+	ENVELOPE_VERSION = 1
+	// Carries the notification ID, which is the same for retries of the same callback
+	IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+
+	// A transaction was received again, i.e, the alert was forwarded twice. Not reconciled again
+	EVENT_TRANSACTION_DUPLICATE = "transaction.duplicate"
+	// A message matched a template but the transaction could not be parsed
+	EVENT_PARSE_FAILED = "parse.failed"
+
+	SOURCE_EMAIL = "email"
+	SOURCE_SMS   = "sms"
+)
+
+var Formats = []string{FORMAT_LEGACY, FORMAT_ENVELOPE, FORMAT_CLOUDEVENTS}
+
+// JSON Schema of the envelope and the data of each event
+//
+//go:embed callback.v1.schema.json
+var Schema []byte
+
+// Body of callbacks posted in FORMAT_ENVELOPE
+type Envelope struct {
+	// EVENT_*, reconciliation.EVENT_PARTIAL_PAYMENT or reconciliation.EVENT_FULLY_PAID
+	Event string `json:"event"`
+	// ID of the TransactionNotification, also sent in IDEMPOTENCY_KEY_HEADER
+	ID         string    `json:"id"`
+	Version    int       `json:"version"`
+	OccurredAt time.Time `json:"occurredAt"`
+	// TransactionData or ParseFailedData, depending on Event
+	Data interface{} `json:"data"`
+}
+
+// Data of the transaction and payment events
+type TransactionData struct {
+	TransactionId string `json:"transactionId"`
+	TemplateName  string `json:"templateName"`
+	Date          string `json:"date"`
+	Amount        string `json:"amount"`
+	// Plain decimal, i.e, 5000.00. Empty if the amount could not be read
+	NormalizedAmount  string `json:"normalizedAmount,omitempty"`
+	Currency          string `json:"currency,omitempty"`
+	AccountNumber     string `json:"accountNumber,omitempty"`
+	VendorReferenceId string `json:"vendorReferenceId"`
+	// Vendor reference as written by the customer, when it had to be corrected
+	OriginalVendorReferenceId string `json:"originalVendorReferenceId,omitempty"`
+	TransactionReferenceId    string `json:"transactionReferenceId,omitempty"`
+	// ID of the transaction received first. Only set for EVENT_TRANSACTION_DUPLICATE
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+	// Nil when reconciliation is disabled
+	Reconciliation *ReconciliationData `json:"reconciliation,omitempty"`
+}
+
+// See reconciliation.Match
+type ReconciliationData struct {
+	Outcome           string `json:"outcome"`
+	ExpectedPaymentId string `json:"expectedPaymentId,omitempty"`
+	ExpectedAmount    string `json:"expectedAmount,omitempty"`
+	ExpectedCurrency  string `json:"expectedCurrency,omitempty"`
+	ReceivedAmount    string `json:"receivedAmount,omitempty"`
+	TotalReceived     string `json:"totalReceived,omitempty"`
+}
+
+// Data of EVENT_PARSE_FAILED
+type ParseFailedData struct {
+	TemplateName string `json:"templateName"`
+	// SOURCE_EMAIL or SOURCE_SMS
+	Source string `json:"source"`
+	// Email address or SMS sender ID
+	Sender string `json:"sender"`
+	// ID of the stored TransactionEmail or ReceivedSms
+	MessageId string `json:"messageId"`
+	Error     string `json:"error"`
+}
+
+// NewTransactionData Returns the event data of the transaction. match may be nil
+func NewTransactionData(t *transaction.Transaction, match *reconciliation.Match) *TransactionData {
+	data := &TransactionData{
+		TransactionId:             t.ID,
+		TemplateName:              t.TemplateName,
+		Date:                      t.Date,
+		Amount:                    t.Amount,
+		NormalizedAmount:          t.NormalizedAmount,
+		Currency:                  t.Currency,
+		AccountNumber:             t.AccountNumber,
+		VendorReferenceId:         t.VendorReferenceId,
+		OriginalVendorReferenceId: t.OriginalVendorReferenceId,
+		TransactionReferenceId:    t.TransactionReferenceId,
+	}
+	if match != nil {
+		data.Reconciliation = &ReconciliationData{
+			Outcome:           match.Outcome,
+			ExpectedPaymentId: match.ExpectedPaymentId,
+			ExpectedAmount:    match.ExpectedAmount,
+			ExpectedCurrency:  match.ExpectedCurrency,
+			ReceivedAmount:    match.ReceivedAmount,
+			TotalReceived:     match.TotalReceived,
+		}
+	}
+	return data
+}
+
+// PostEvent Sends the event wrapped in an Envelope identified by the notification ID
+func (n *TransactionNotification) PostEvent(token string, event string, data interface{}) error {
+	return n.post(token, &Envelope{
+		Event:      event,
+		ID:         n.ID,
+		Version:    ENVELOPE_VERSION,
+		OccurredAt: n.CreatedAt.UTC(),
+		Data:       data,
+	}, nil)
+}
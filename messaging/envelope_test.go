@@ -0,0 +1,74 @@
+package messaging
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SharkFourSix/go-transact/reconciliation"
+	"github.com/SharkFourSix/go-transact/transaction"
+)
+
+func TestPostEvent(t *testing.T) {
+	var (
+		header   http.Header
+		received map[string]interface{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	notification := NewTransactionNotification()
+	notification.Url = server.URL
+	tx := &transaction.Transaction{
+		ID:                "9b1d6f",
+		TemplateName:      "Test template",
+		Date:              "20210101",
+		Amount:            "50,342.00",
+		NormalizedAmount:  "50342.00",
+		VendorReferenceId: "VRIF0XA65FE2",
+	}
+	match := &reconciliation.Match{Outcome: reconciliation.MATCH_EXACT, Event: reconciliation.EVENT_FULLY_PAID}
+	if err := notification.PostEvent("token12345", match.Event, NewTransactionData(tx, match)); err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Get(IDEMPOTENCY_KEY_HEADER) != notification.ID {
+		t.Errorf("expected idempotency key %s, got %s", notification.ID, header.Get(IDEMPOTENCY_KEY_HEADER))
+	}
+	if received["event"] != reconciliation.EVENT_FULLY_PAID || received["id"] != notification.ID || received["version"] != float64(ENVELOPE_VERSION) {
+		t.Errorf("unexpected envelope %v", received)
+	}
+	if _, err := time.Parse(time.RFC3339, received["occurredAt"].(string)); err != nil {
+		t.Errorf("occurredAt is not RFC 3339. %v", err)
+	}
+	data := received["data"].(map[string]interface{})
+	if data["transactionId"] != tx.ID || data["reconciliation"].(map[string]interface{})["outcome"] != reconciliation.MATCH_EXACT {
+		t.Errorf("unexpected data %v", data)
+	}
+
+	// Every property the schema requires must be sent
+	var schema struct {
+		Required []string
+		Defs     map[string]struct{ Required []string } `json:"$defs"`
+	}
+	if err := json.Unmarshal(Schema, &schema); err != nil {
+		t.Fatalf("schema is not valid JSON. %v", err)
+	}
+	for _, property := range schema.Required {
+		if _, ok := received[property]; !ok {
+			t.Errorf("envelope is missing required property %s", property)
+		}
+	}
+	for _, property := range schema.Defs["transaction"].Required {
+		if _, ok := data[property]; !ok {
+			t.Errorf("transaction data is missing required property %s", property)
+		}
+	}
+}
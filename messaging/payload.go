@@ -0,0 +1,168 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/SharkFourSix/go-transact/reconciliation"
+	"github.com/SharkFourSix/go-transact/transaction"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+const DEFAULT_PAYLOAD_CONTENT_TYPE = "application/json"
+
+// Body, content type and headers of transaction callbacks, for receivers expecting a specific shape
+// such as chat webhooks. Replaces the callback format
+type PayloadTemplate struct {
+	// Default = application/json. Bodies of JSON content types must render to valid JSON
+	ContentType string `yaml:"contentType"`
+	// Values are templates
+	Headers map[string]string `yaml:"headers"`
+	// text/template rendered with PayloadData, i.e, {"text": "{{.Amount}} received for {{.VendorReferenceId}}"}
+	Body string `yaml:"body"`
+}
+
+// Fields available to payload templates, i.e, {{.Amount}}, {{.Event}} or {{.Transaction.NormalizedAmount}}.
+// Reconciliation is nil when reconciliation is disabled, use {{with .Reconciliation}}...{{end}}
+type PayloadData struct {
+	NotificationData
+	// ID of the TransactionNotification, also sent in IDEMPOTENCY_KEY_HEADER
+	NotificationId string
+	Transaction    *transaction.Transaction
+}
+
+// Compiled PayloadTemplate
+type Payload struct {
+	contentType string
+	headers     map[string]*template.Template
+	body        *template.Template
+}
+
+// Functions available to payload templates in addition to the text/template builtins
+var payloadFuncs = template.FuncMap{
+	// Quotes and escapes a value for use in JSON bodies, i.e, {"text": {{json .VendorReferenceId}}}
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// Compile Parses the templates and renders them with SamplePayloadData, with and without a reconciliation match,
+// so mistakes are found when the configuration is loaded rather than when a transaction arrives
+func (p *PayloadTemplate) Compile() (*Payload, error) {
+	if utils.IsStringEmpty(p.Body) {
+		return nil, fmt.Errorf("body is required")
+	}
+	payload := &Payload{
+		contentType: p.ContentType,
+		headers:     map[string]*template.Template{},
+	}
+	if utils.IsStringEmpty(payload.contentType) {
+		payload.contentType = DEFAULT_PAYLOAD_CONTENT_TYPE
+	}
+
+	var err error
+	if payload.body, err = template.New("body").Funcs(payloadFuncs).Option("missingkey=error").Parse(p.Body); err != nil {
+		return nil, fmt.Errorf("invalid body template. %v", err)
+	}
+	for name, value := range p.Headers {
+		if utils.IsStringEmpty(name) || strings.ContainsAny(name, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid header name '%s'", name)
+		}
+		if payload.headers[name], err = template.New(name).Funcs(payloadFuncs).Option("missingkey=error").Parse(value); err != nil {
+			return nil, fmt.Errorf("invalid template of header %s. %v", name, err)
+		}
+	}
+
+	sample := SamplePayloadData()
+	if _, _, err := payload.Render(sample); err != nil {
+		return nil, err
+	}
+	// Reconciliation is nil when reconciliation is disabled or the payment could not be looked up
+	sample.Reconciliation = nil
+	if _, _, err := payload.Render(sample); err != nil {
+		return nil, fmt.Errorf("%v. Reconciliation may be nil, use {{with .Reconciliation}}...{{end}}", err)
+	}
+	return payload, nil
+}
+
+// Render Returns the body and headers, including Content-Type, for the data
+func (p *Payload) Render(data *PayloadData) ([]byte, map[string]string, error) {
+	var body bytes.Buffer
+	if err := p.body.Execute(&body, data); err != nil {
+		return nil, nil, fmt.Errorf("error rendering body. %v", err)
+	}
+	if strings.Contains(p.contentType, "json") && !json.Valid(body.Bytes()) {
+		return nil, nil, fmt.Errorf("rendered body is not valid JSON: %s", body.String())
+	}
+
+	headers := map[string]string{"Content-Type": p.contentType}
+	for name, tpl := range p.headers {
+		var value strings.Builder
+		if err := tpl.Execute(&value, data); err != nil {
+			return nil, nil, fmt.Errorf("error rendering header %s. %v", name, err)
+		}
+		if strings.ContainsAny(value.String(), "\r\n") {
+			return nil, nil, fmt.Errorf("rendered header %s contains a line break", name)
+		}
+		headers[name] = value.String()
+	}
+	return body.Bytes(), headers, nil
+}
+
+// SamplePayloadData Returns made up data, to check and preview payload templates
+func SamplePayloadData() *PayloadData {
+	now := time.Now()
+	tx := &transaction.Transaction{
+		ID:                     "00000000-0000-0000-0000-000000000000",
+		CreatedAt:              now,
+		TemplateName:           "Sample Bank",
+		Date:                   now.Format("02/01/2006"),
+		Amount:                 "20,000.00",
+		NormalizedAmount:       "20000.00",
+		Currency:               "MWK",
+		AccountNumber:          "1001234567",
+		VendorReferenceId:      "INV-7K2P0Q9MX",
+		TransactionReferenceId: "FT22152XYZ01",
+	}
+	return &PayloadData{
+		NotificationData: NotificationData{
+			Event:                  EVENT_TRANSACTION_RECEIVED,
+			CreatedAt:              now,
+			TemplateName:           tx.TemplateName,
+			Date:                   tx.Date,
+			Amount:                 tx.Amount,
+			Currency:               tx.Currency,
+			AccountNumber:          tx.AccountNumber,
+			VendorReferenceId:      tx.VendorReferenceId,
+			TransactionReferenceId: tx.TransactionReferenceId,
+			Reconciliation: &reconciliation.Match{
+				Outcome:        reconciliation.MATCH_EXACT,
+				ExpectedAmount: "20000.00",
+				ReceivedAmount: "20000.00",
+				TotalReceived:  "20000.00",
+				Event:          reconciliation.EVENT_FULLY_PAID,
+			},
+		},
+		NotificationId: "00000000-0000-0000-0000-000000000000",
+		Transaction:    tx,
+	}
+}
+
+// PostPayload Sends the data rendered with the payload
+func (n *TransactionNotification) PostPayload(token string, payload *Payload, data *PayloadData) error {
+	data.NotificationId = n.ID
+	body, headers, err := payload.Render(data)
+	if err != nil {
+		n.Sent = false
+		n.StatusText = err.Error()
+		return err
+	}
+	return n.send(token, body, headers)
+}
@@ -0,0 +1,60 @@
+package messaging
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPayloadTemplate(t *testing.T) {
+	invalid := []PayloadTemplate{
+		{},
+		{Body: `{"text": {{.Amount}`},
+		{Body: `{"text": {{.Amount}}}`},
+		{Body: `{"text": {{json .Unknown}}}`},
+		{Body: `ok`, ContentType: "text/plain", Headers: map[string]string{"Bad Header": "x"}},
+		{Body: `{"outcome": {{json .Reconciliation.Outcome}}}`},
+		{Body: `ok`, ContentType: "text/plain", Headers: map[string]string{"X-Outcome": "{{.Reconciliation.Event}}"}},
+	}
+	for _, p := range invalid {
+		if _, err := p.Compile(); err == nil {
+			t.Errorf("invalid payload %+v was accepted", p)
+		}
+	}
+
+	payload, err := (&PayloadTemplate{
+		Headers: map[string]string{"X-Event": "{{.Event}}"},
+		Body:    `{"text": {{json (printf "%s %s for %s" .Currency .Amount .VendorReferenceId)}}{{with .Reconciliation}}, "outcome": {{json .Outcome}}{{end}}}`,
+	}).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		header http.Header
+		body   string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		raw, _ := ioutil.ReadAll(r.Body)
+		body = string(raw)
+	}))
+	defer server.Close()
+
+	notification := NewTransactionNotification()
+	notification.Url = server.URL
+	data := SamplePayloadData()
+	data.Reconciliation = nil
+	data.VendorReferenceId = `INV-"1"`
+	if err := notification.PostPayload("token12345", payload, data); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"text": "MWK 20,000.00 for INV-\"1\""}`; body != expected || notification.Data != expected {
+		t.Errorf("expected body %s, got %s", expected, body)
+	}
+	if header.Get("Content-Type") != DEFAULT_PAYLOAD_CONTENT_TYPE || header.Get("X-Event") != EVENT_TRANSACTION_RECEIVED ||
+		header.Get(IDEMPOTENCY_KEY_HEADER) != notification.ID {
+		t.Errorf("unexpected headers %v", header)
+	}
+}
@@ -0,0 +1,157 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SharkFourSix/go-transact/persistence"
+)
+
+const (
+	DEFAULT_MAX_ATTEMPTS    = 5
+	DEFAULT_INITIAL_BACKOFF = 30 * time.Second
+	DEFAULT_MAX_BACKOFF     = 30 * time.Minute
+	DEFAULT_RETRY_INTERVAL  = 10 * time.Second
+)
+
+// How failed callbacks are retried. Zero values use the defaults
+type RetryOptions struct {
+	// Attempts before a notification is moved to the dead-letter queue, including the first. 1 = no retries.
+	// Default = DEFAULT_MAX_ATTEMPTS
+	MaxAttempts int `yaml:"maxAttempts"`
+	// Wait before the first retry, doubled after every failed attempt. Default = DEFAULT_INITIAL_BACKOFF
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	// Longest wait between attempts. Default = DEFAULT_MAX_BACKOFF
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+	// How often pending notifications are looked for. Default = DEFAULT_RETRY_INTERVAL
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (o RetryOptions) withDefaults() RetryOptions {
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = DEFAULT_INITIAL_BACKOFF
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	if o.MaxBackoff < o.InitialBackoff {
+		o.MaxBackoff = o.InitialBackoff
+	}
+	if o.Interval <= 0 {
+		o.Interval = DEFAULT_RETRY_INTERVAL
+	}
+	return o
+}
+
+// Wait before the attempt following the given number of failed attempts
+func (o RetryOptions) backoff(attempts int) time.Duration {
+	backoff := o.InitialBackoff
+	for i := 1; i < attempts && backoff < o.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > o.MaxBackoff {
+		return o.MaxBackoff
+	}
+	return backoff
+}
+
+func retryOptions() RetryOptions {
+	endpointsLock.Lock()
+	defer endpointsLock.Unlock()
+	return endpointOptions.Retry
+}
+
+// PendingNotifications Returns the notifications awaiting a retry that is due at the time, earliest first
+func PendingNotifications(at time.Time) ([]TransactionNotification, error) {
+	var notifications []TransactionNotification
+	if err := persistence.Find(&notifications, "state = ? AND next_attempt_at <= ?", NOTIFICATION_PENDING, at); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(notifications, func(i, j int) bool {
+		return notifications[i].NextAttemptAt.Before(*notifications[j].NextAttemptAt)
+	})
+	return notifications, nil
+}
+
+// Sends pending notifications again once their backoff elapsed, until shut down
+type Retrier struct {
+	// Token of the callback url
+	Token string
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (r *Retrier) init() {
+	r.once.Do(func() {
+		r.stop = make(chan struct{})
+		r.done = make(chan struct{})
+	})
+}
+
+// Start Retries pending notifications every RetryOptions.Interval until the retrier is shut down
+func (r *Retrier) Start() error {
+	r.init()
+	defer close(r.done)
+	for {
+		r.Retry()
+		select {
+		case <-r.stop:
+			return nil
+		case <-time.After(retryOptions().Interval):
+		}
+	}
+}
+
+// Retry Sends the notifications whose retry is due. Returns the number of notifications sent
+func (r *Retrier) Retry() int {
+	r.init()
+	notifications, err := PendingNotifications(time.Now())
+	if err != nil {
+		log.Errorf("error listing pending notifications. %s", err.Error())
+		return 0
+	}
+	sent := 0
+	for i := range notifications {
+		select {
+		case <-r.stop:
+			return sent
+		default:
+		}
+		n := &notifications[i]
+		if err := n.Replay(r.Token, ""); err == nil {
+			sent++
+		} else if n.State == NOTIFICATION_DEAD_LETTER {
+			log.Errorf("notification %s moved to the dead-letter queue after %d attempts. %s", n.ID, n.Attempts, err.Error())
+		} else {
+			log.Warnf("notification %s not sent after %d attempts, retrying at %s. %s", n.ID, n.Attempts,
+				n.NextAttemptAt.Format(time.RFC3339), err.Error())
+		}
+	}
+	return sent
+}
+
+// Shutdown Stops retrying and waits for the notification being sent, if any
+func (r *Retrier) Shutdown(ctx context.Context) error {
+	r.init()
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("notification retrier did not stop. %v", ctx.Err())
+	}
+}
@@ -0,0 +1,63 @@
+package messaging
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+// TLS settings of callback requests, for endpoints behind a private CA or requiring client certificates
+type ClientTLS struct {
+	// Client certificate and key presented to endpoints requiring mutual TLS. PEM encoded
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// PEM bundle of the CAs the endpoint's certificate is verified against, instead of the system roots
+	CaFile string `yaml:"caFile"`
+	// Name the endpoint's certificate is verified against, instead of the host of the url
+	ServerName string `yaml:"serverName"`
+	// i.e, 1.2. Empty = library default
+	MinVersion string `yaml:"minVersion"`
+}
+
+// Configured Reports whether any setting differs from the system defaults
+func (c *ClientTLS) Configured() bool {
+	return *c != ClientTLS{}
+}
+
+// Config Loads the certificates. Returns nil if no settings are configured
+func (c *ClientTLS) Config() (*tls.Config, error) {
+	if !c.Configured() {
+		return nil, nil
+	}
+	minVersion, err := utils.ParseTLSVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: minVersion,
+	}
+
+	if !utils.IsStringEmpty(c.CertFile) || !utils.IsStringEmpty(c.KeyFile) {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate. %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if !utils.IsStringEmpty(c.CaFile) {
+		bundle, err := ioutil.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle. %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.CaFile)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,94 @@
+package messaging
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, file string, blockType string, der []byte) string {
+	file = filepath.Join(t.TempDir(), file)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestMutualTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-transact"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	server.TLS.ClientCAs.AddCert(clientCert)
+	server.StartTLS()
+	defer server.Close()
+	defer ConfigureEndpoints(EndpointOptions{})
+
+	clientTls := ClientTLS{
+		CertFile:   writePEM(t, "client.pem", "CERTIFICATE", der),
+		KeyFile:    writePEM(t, "client.key", "EC PRIVATE KEY", keyDer),
+		CaFile:     writePEM(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw),
+		MinVersion: "1.2",
+	}
+	cases := []struct {
+		name    string
+		tls     ClientTLS
+		success bool
+	}{
+		{"system defaults", ClientTLS{}, false},
+		{"no client certificate", ClientTLS{CaFile: clientTls.CaFile}, false},
+		{"mutual TLS", clientTls, true},
+		{"server name override", ClientTLS{CertFile: clientTls.CertFile, KeyFile: clientTls.KeyFile, CaFile: clientTls.CaFile, ServerName: "example.com"}, true},
+		{"wrong server name", ClientTLS{CertFile: clientTls.CertFile, KeyFile: clientTls.KeyFile, CaFile: clientTls.CaFile, ServerName: "bank.tld"}, false},
+	}
+	for _, c := range cases {
+		if err := ConfigureEndpoints(EndpointOptions{Tls: c.tls}); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		notification := NewTransactionNotification()
+		notification.Url = server.URL
+		err := notification.Post("token12345", &NotificationData{})
+		if c.success && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !c.success && err == nil {
+			t.Errorf("%s: callback was accepted", c.name)
+		}
+	}
+
+	if err := ConfigureEndpoints(EndpointOptions{Tls: ClientTLS{CaFile: clientTls.KeyFile}}); err == nil {
+		t.Error("CA bundle without certificates was accepted")
+	}
+}
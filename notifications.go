@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/SharkFourSix/go-transact/config"
+	"github.com/SharkFourSix/go-transact/messaging"
+	"github.com/SharkFourSix/go-transact/persistence"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+// Prints the notifications in the dead-letter queue. Returns the exit status.
+func listDeadLetters(resolved bool) int {
+	notifications, err := messaging.DeadLetters(resolved)
+	if err != nil {
+		fmt.Printf("error listing dead letters. %s\n", err.Error())
+		return 1
+	}
+	for _, n := range notifications {
+		fmt.Printf("%s %s %s attempts: %d, %s: %s\n", n.ID, n.CreatedAt.Format("2006-01-02 15:04:05"),
+			describeState(&n), n.Attempts, n.Url, n.StatusText)
+	}
+	fmt.Printf("%d notification(s)\n", len(notifications))
+	return 0
+}
+
+// Prints a notification with its attempts. Returns the exit status.
+func showNotification(id string) int {
+	notification := findNotification(id)
+	if notification == nil {
+		return 1
+	}
+	attempts, err := notification.History()
+	if err != nil {
+		fmt.Printf("error reading attempts. %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Notification %s, %s from %s (%s)\n", notification.ID, describeState(notification),
+		notification.FromEmail, notification.TemplateName)
+	if notification.ResolvedAt != nil {
+		fmt.Printf("Resolved %s: %s\n", notification.ResolvedAt.Format("2006-01-02 15:04:05"), notification.ResolutionNote)
+	}
+	fmt.Println("\nAttempts:")
+	for _, attempt := range attempts {
+		fmt.Printf("%s %s sent: %t, %s %s\n", attempt.CreatedAt.Format("2006-01-02 15:04:05"), attempt.Url,
+			attempt.Sent, attempt.StatusText, attempt.ResponseText)
+	}
+	fmt.Printf("\nData:\n%s\n", notification.Data)
+	return 0
+}
+
+// Sends one or all dead letters again, to target if set. Returns the exit status.
+func replayDeadLetters(id string, all bool, target string) int {
+	if utils.IsStringEmpty(id) == !all {
+		fmt.Println("replay requires exactly one of '--id' or '--all'")
+		return 1
+	}
+	if !utils.IsStringEmpty(target) {
+		if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || utils.IsStringEmpty(u.Host) {
+			fmt.Printf("'%s' is not an absolute http or https url\n", target)
+			return 1
+		}
+	}
+
+	var notifications []messaging.TransactionNotification
+	if all {
+		var err error
+		if notifications, err = messaging.DeadLetters(false); err != nil {
+			fmt.Printf("error listing dead letters. %s\n", err.Error())
+			return 1
+		}
+	} else {
+		notification := findNotification(id)
+		if notification == nil {
+			return 1
+		}
+		notifications = append(notifications, *notification)
+	}
+
+	var failed int
+	for i := range notifications {
+		n := &notifications[i]
+		if err := n.Replay(config.GetConfiguration().Callback.ForwardToken, target); err != nil {
+			failed++
+			fmt.Printf("%s: failed, %s\n", n.ID, err.Error())
+		} else {
+			fmt.Printf("%s: sent to %s\n", n.ID, n.Url)
+		}
+	}
+	fmt.Printf("replayed: %d, failed: %d\n", len(notifications)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Takes a dead letter out of the queue without sending it. Returns the exit status.
+func resolveDeadLetter(id string, note string) int {
+	if utils.IsStringEmpty(id) || utils.IsStringEmpty(note) {
+		fmt.Println("resolve requires '--id' and '--note'")
+		return 1
+	}
+	notification := findNotification(id)
+	if notification == nil {
+		return 1
+	}
+	if err := notification.Resolve(note); err != nil {
+		fmt.Printf("error resolving notification. %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("%s: resolved\n", notification.ID)
+	return 0
+}
+
+func findNotification(id string) *messaging.TransactionNotification {
+	if utils.IsStringEmpty(id) {
+		fmt.Println("missing parameter '--id'")
+		return nil
+	}
+	notification, err := messaging.GetNotification(id)
+	if persistence.IsNotFound(err) {
+		fmt.Printf("no notification with id '%s'\n", id)
+		return nil
+	} else if err != nil {
+		fmt.Printf("error reading notification. %s\n", err.Error())
+		return nil
+	}
+	return notification
+}
+
+func describeState(n *messaging.TransactionNotification) string {
+	if utils.IsStringEmpty(n.State) {
+		if n.Sent {
+			return messaging.NOTIFICATION_SENT
+		}
+		return messaging.NOTIFICATION_DEAD_LETTER
+	}
+	return n.State
+}
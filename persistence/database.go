@@ -1,6 +1,7 @@
 package persistence
 
 import (
+	"errors"
 	"fmt"
 
 	log "github.com/sirupsen/logrus"
@@ -47,3 +48,35 @@ func saveModel(model interface{}) *gorm.DB {
 func Save(model interface{}) error {
 	return saveModel(model).Error
 }
+
+func Count(model interface{}) (int64, error) {
+	var count int64
+	err := databaseHandle.Model(model).Count(&count).Error
+	return count, err
+}
+
+// First Loads the first record matching the query into model. Returns gorm.ErrRecordNotFound if there is none
+func First(model interface{}, query string, args ...interface{}) error {
+	return databaseHandle.Where(query, args...).First(model).Error
+}
+
+// Find Loads all records matching the query into models, a pointer to a slice
+func Find(models interface{}, query string, args ...interface{}) error {
+	return databaseHandle.Where(query, args...).Find(models).Error
+}
+
+// Update Saves all fields of an existing record
+func Update(model interface{}) error {
+	return databaseHandle.Save(model).Error
+}
+
+// Delete Deletes the records matching the query. Returns the number of deleted records
+func Delete(model interface{}, query string, args ...interface{}) (int64, error) {
+	result := databaseHandle.Where(query, args...).Delete(model)
+	return result.RowsAffected, result.Error
+}
+
+// IsNotFound Reports whether err means that no record matched
+func IsNotFound(err error) bool {
+	return errors.Is(err, gorm.ErrRecordNotFound)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twinj/uuid"
+
+	"github.com/SharkFourSix/go-transact/config"
+	"github.com/SharkFourSix/go-transact/mailing"
+	"github.com/SharkFourSix/go-transact/messaging"
+	"github.com/SharkFourSix/go-transact/persistence"
+	"github.com/SharkFourSix/go-transact/reconciliation"
+	"github.com/SharkFourSix/go-transact/sms"
+	"github.com/SharkFourSix/go-transact/transaction"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+const (
+	// Sender did not match any template
+	OUTCOME_SPAM = "spam"
+	// Sender matched a template but failed its verification policy or was relayed from a network the template does not allow
+	OUTCOME_UNVERIFIED = "unverified"
+	// Template matched but the transaction could not be parsed
+	OUTCOME_PARSE_FAILED = "parse failed"
+	OUTCOME_TRANSACTION  = "transaction"
+)
+
+var (
+	// Serializes the duplicate check and the saving of received SMS
+	smsLock sync.Mutex
+	// Serializes counting and saving spam, so concurrent workers cannot exceed the spam quota
+	spamLock sync.Mutex
+)
+
+type processOptions struct {
+	// Match and parse only. Nothing is stored and no callback is sent
+	dryRun bool
+	// Store mail and transactions but do not send callbacks
+	storeOnly bool
+}
+
+// Matches received mail against the templates, stores it, parses the transaction and posts the callback.
+// Returns what became of the mail, and the transaction if one was parsed. Returns an error if the mail or the
+// transaction could not be stored, so the mail is processed again.
+func processMail(received *mailing.ReceivedMail, options processOptions) (string, *transaction.Transaction, error) {
+	var (
+		ip      = received.RemoteAddr
+		from    = received.Sender
+		subject = received.Subject
+		data    = received.Body
+	)
+	log.Debugf("Got email from ip %s, sender %s (%s), envelope sender %s", ip.String(), from, received.SenderSource, received.From)
+
+	template, allowlist := config.GetTemplateForMail(from, received.To)
+
+	saveSpam := func() {
+		if options.dryRun {
+			return
+		}
+		spamLock.Lock()
+		defer spamLock.Unlock()
+		if quota := config.GetConfiguration().Server.Limits.SpamQuota; quota > 0 {
+			count, err := persistence.Count(&mailing.SpamMail{})
+			if err != nil {
+				log.Errorf("failed to count spam mail. %s", err.Error())
+				return
+			}
+			if count >= int64(quota) {
+				log.Warnf("spam quota of %d reached. Dropping spam mail from %s, %s", quota, ip.String(), from)
+				return
+			}
+		}
+		spam := mailing.SpamMail{
+			ID:        uuid.NewV4().String(),
+			Body:      data,
+			Email:     from,
+			Subject:   subject,
+			IpAddress: ip.String(),
+			CreatedAt: time.Now(),
+		}
+		if err := persistence.Save(&spam); err != nil {
+			log.Errorf("failed to save spam mail from %s, %s", ip.String(), from)
+		}
+	}
+
+	if template == nil {
+		log.Warnf("sender %s did not match any template. Email will be stored in spam", from)
+		saveSpam()
+		return OUTCOME_SPAM, nil, nil
+	}
+
+	// Checked against the template that matched the resolved sender, so forwarded mail does not bypass it
+	if !allowlist.AllowsRelay(ip) {
+		log.Warnf("%s is not allowed to relay mail for template %s. Email from %s will be stored in spam",
+			ip.String(), template.TemplateName, from)
+		saveSpam()
+		return OUTCOME_UNVERIFIED, nil, nil
+	}
+
+	if err := mailing.CheckPolicy(&template.Verification, received.Verification, template.Email); err != nil {
+		log.Warnf("email from %s failed verification for template %s. %s. Email will be stored in spam",
+			from, template.TemplateName, err.Error())
+		saveSpam()
+		return OUTCOME_UNVERIFIED, nil, nil
+	}
+
+	email := mailing.TransactionEmail{
+		ID:           uuid.NewV4().String(),
+		CreatedAt:    time.Now(),
+		Body:         data,
+		IpAddress:    ip.String(),
+		Subject:      subject,
+		From:         received.From,
+		Sender:       from,
+		SenderSource: received.SenderSource,
+		Recipients:   strings.Join(received.To, ","),
+		TlsVersion:   received.TLSVersion,
+	}
+	if v := received.Verification; v != nil {
+		email.DkimResult = v.Dkim
+		email.DkimDomains = strings.Join(v.DkimDomains, ",")
+		email.SpfResult = v.Spf
+		email.DmarcResult = v.Dmarc
+	}
+
+	if !options.dryRun {
+		log.Debugf("saving transaction email [server=%s, sender=%s]", ip.String(), from)
+		if err := persistence.Save(&email); err != nil {
+			return "", nil, fmt.Errorf("failed to save mail from [server=%s, sender=%s] for template %s. %s",
+				ip.String(), from, template.TemplateName, err.Error())
+		}
+	}
+
+	log.Debugf("parsing transaaction from %s using template %s.", from, template.TemplateName)
+	transaction, err := transaction.ParseTransaction(data, template)
+	if err != nil {
+		log.Errorf("failed to parse transaction. %s", err.Error())
+		if !options.dryRun && !options.storeOnly {
+			notifyParseFailed(messaging.SOURCE_EMAIL, from, email.ID, template.TemplateName, err)
+		}
+		return OUTCOME_PARSE_FAILED, nil, nil
+	}
+	correctReference(transaction)
+
+	if options.dryRun {
+		return OUTCOME_TRANSACTION, transaction, nil
+	}
+
+	duplicateOf := findDuplicate(transaction)
+	if err := persistence.Save(transaction); err != nil {
+		return "", nil, fmt.Errorf("failed to save transaction. %s", err.Error())
+	}
+	var match *reconciliation.Match
+	if utils.IsStringEmpty(duplicateOf) {
+		match = reconcile(transaction)
+	}
+
+	if options.storeOnly {
+		return OUTCOME_TRANSACTION, transaction, nil
+	}
+
+	notify(from, transaction, match, duplicateOf)
+	return OUTCOME_TRANSACTION, transaction, nil
+}
+
+// Matches an SMS against the templates by sender ID, stores it, parses the transaction and posts the callback.
+// Returns an error if the SMS or its transaction could not be stored, so the forwarder sends it again. SMS sent again
+// after they were stored are ignored
+func processSms(received *sms.ReceivedSms) error {
+	log.Debugf("Got SMS from ip %s, sender %s", received.IpAddress, received.Sender)
+
+	template := config.GetTemplateBySmsSender(received.Sender)
+	if template != nil {
+		received.TemplateName = template.TemplateName
+	}
+	// Forwarders retrying a request may race with the request still in progress
+	smsLock.Lock()
+	duplicate, err := sms.FindDuplicate(received)
+	if err == nil && duplicate == nil {
+		err = persistence.Save(received)
+	}
+	smsLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to save SMS from [ip=%s, sender=%s]. %s", received.IpAddress, received.Sender, err.Error())
+	}
+	if duplicate != nil {
+		log.Infof("SMS from %s received at %s was already received as %s", received.Sender, received.ReceivedAt, duplicate.ID)
+		received.ID = duplicate.ID
+		return nil
+	}
+	if template == nil {
+		log.Warnf("SMS sender %s did not match any template", received.Sender)
+		return nil
+	}
+
+	log.Debugf("parsing transaction from SMS sender %s using template %s.", received.Sender, template.TemplateName)
+	transaction, err := transaction.ParseTransaction(received.Message, template)
+	if err != nil {
+		log.Errorf("failed to parse transaction. %s", err.Error())
+		notifyParseFailed(messaging.SOURCE_SMS, received.Sender, received.ID, template.TemplateName, err)
+		return nil
+	}
+	correctReference(transaction)
+	duplicateOf := findDuplicate(transaction)
+	if err := persistence.Save(transaction); err != nil {
+		// Removed so the forwarder's retry is not taken for a duplicate
+		if _, deleteErr := persistence.Delete(&sms.ReceivedSms{}, "id = ?", received.ID); deleteErr != nil {
+			log.Errorf("failed to remove SMS %s. %s", received.ID, deleteErr.Error())
+		}
+		return fmt.Errorf("failed to save transaction. %s", err.Error())
+	}
+	var match *reconciliation.Match
+	if utils.IsStringEmpty(duplicateOf) {
+		match = reconcile(transaction)
+	}
+	notify(received.Sender, transaction, match, duplicateOf)
+	return nil
+}
+
+// Validates the check digit of the transaction's vendor reference and corrects characters customers commonly mistype.
+// References are left as they are unless references are configured with a check digit
+func correctReference(transaction *transaction.Transaction) {
+	generator := config.GetConfiguration().References
+	if !generator.Check() {
+		return
+	}
+	corrected, valid := generator.Correct(transaction.VendorReferenceId)
+	if corrected != transaction.VendorReferenceId {
+		log.Infof("vendor reference %s of transaction %s corrected to %s", transaction.VendorReferenceId, transaction.ID, corrected)
+		transaction.OriginalVendorReferenceId = transaction.VendorReferenceId
+		transaction.VendorReferenceId = corrected
+	} else if !valid {
+		log.Warnf("vendor reference %s of transaction %s failed its check digit and could not be corrected", transaction.VendorReferenceId, transaction.ID)
+	}
+}
+
+// Returns the ID of a transaction stored earlier from the same template with the same transaction reference,
+// i.e, when an alert is forwarded twice. Returns an empty string if there is none
+func findDuplicate(t *transaction.Transaction) string {
+	if utils.IsStringEmpty(t.TransactionReferenceId) {
+		return ""
+	}
+	var existing transaction.Transaction
+	err := persistence.First(&existing, "template_name = ? AND transaction_reference_id = ? AND id <> ?",
+		t.TemplateName, t.TransactionReferenceId, t.ID)
+	if persistence.IsNotFound(err) {
+		return ""
+	}
+	if err != nil {
+		log.Errorf("failed to look up duplicates of transaction %s. %s", t.TransactionReferenceId, err.Error())
+		return ""
+	}
+	log.Warnf("transaction %s from template %s was already received as %s. It will not be reconciled again",
+		t.TransactionReferenceId, t.TemplateName, existing.ID)
+	return existing.ID
+}
+
+// Matches the transaction against the expected payments. Returns nil if reconciliation is disabled or failed
+func reconcile(transaction *transaction.Transaction) *reconciliation.Match {
+	if !config.GetConfiguration().Reconciliation.Enabled {
+		return nil
+	}
+	match, err := reconciliation.Reconcile(transaction)
+	if err != nil {
+		log.Errorf("failed to reconcile transaction %s. %s", transaction.ID, err.Error())
+		return nil
+	}
+	log.Debugf("transaction %s with vendor reference %s reconciled: %s", transaction.ID, transaction.VendorReferenceId, match.Outcome)
+	return match
+}
+
+// Posts the transaction to the callback url. from is the email address or SMS sender the transaction came from.
+// duplicateOf is the ID of the transaction received first if this one is a duplicate
+func notify(from string, transaction *transaction.Transaction, match *reconciliation.Match, duplicateOf string) {
+	event := messaging.EVENT_TRANSACTION_RECEIVED
+	if !utils.IsStringEmpty(duplicateOf) {
+		event = messaging.EVENT_TRANSACTION_DUPLICATE
+	} else if match != nil && !utils.IsStringEmpty(match.Event) {
+		event = match.Event
+	}
+
+	if payload := config.GetCallbackPayload(); payload != nil || legacyCallbacks() {
+		callback := messaging.NotificationData{
+			Event:                  event,
+			CreatedAt:              time.Now(),
+			TemplateName:           transaction.TemplateName,
+			Date:                   transaction.Date,
+			Amount:                 transaction.Amount,
+			Currency:               transaction.Currency,
+			AccountNumber:          transaction.AccountNumber,
+			VendorReferenceId:      transaction.VendorReferenceId,
+			TransactionReferenceId: transaction.TransactionReferenceId,
+			Reconciliation:         match,
+		}
+		deliver(from, transaction.TemplateName, func(n *messaging.TransactionNotification, token string) error {
+			if payload != nil {
+				return n.PostPayload(token, payload, &messaging.PayloadData{NotificationData: callback, Transaction: transaction})
+			}
+			return n.Post(token, &callback)
+		})
+		return
+	}
+
+	data := messaging.NewTransactionData(transaction, match)
+	data.DuplicateOf = duplicateOf
+	deliverEvent(from, transaction.TemplateName, event, transaction.VendorReferenceId, data)
+}
+
+// Posts a parse.failed event. Not sent in the legacy format or with a payload template, which only carry transactions
+func notifyParseFailed(source string, from string, messageId string, templateName string, err error) {
+	if legacyCallbacks() || config.GetCallbackPayload() != nil {
+		return
+	}
+	data := &messaging.ParseFailedData{
+		TemplateName: templateName,
+		Source:       source,
+		Sender:       from,
+		MessageId:    messageId,
+		Error:        err.Error(),
+	}
+	deliverEvent(from, templateName, messaging.EVENT_PARSE_FAILED, "", data)
+}
+
+// Reports whether callbacks are posted as bare NotificationData
+func legacyCallbacks() bool {
+	format := config.GetConfiguration().Callback.Format
+	return utils.IsStringEmpty(format) || format == messaging.FORMAT_LEGACY
+}
+
+// Posts an event as an envelope or a CloudEvent, depending on the callback format. subject is only used by CloudEvents
+func deliverEvent(from string, templateName string, event string, subject string, data interface{}) {
+	callback := config.GetConfiguration().Callback
+	deliver(from, templateName, func(n *messaging.TransactionNotification, token string) error {
+		if callback.Format == messaging.FORMAT_CLOUDEVENTS {
+			return n.PostCloudEvent(token, callback.CloudEventsMode, event, subject, data)
+		}
+		return n.PostEvent(token, event, data)
+	})
+}
+
+// Posts a callback and stores the notification with its outcome. Failed notifications go to the dead-letter queue
+func deliver(from string, templateName string, post func(n *messaging.TransactionNotification, token string) error) {
+	notification := messaging.NewTransactionNotification()
+	notification.FromEmail = from
+	notification.TemplateName = templateName
+	notification.Url = config.GetConfiguration().Callback.ForwardURL
+
+	if err := post(notification, config.GetConfiguration().Callback.ForwardToken); err != nil {
+		log.Errorf("failure posting notification for transaction from %s. %s", from, err.Error())
+	}
+
+	if err := notification.Store(); err != nil {
+		log.Errorf("failure saving notification. %s. response was %s", err.Error(), notification.StatusText)
+	}
+}
@@ -0,0 +1,235 @@
+package reconciliation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twinj/uuid"
+
+	"github.com/SharkFourSix/go-transact/persistence"
+	"github.com/SharkFourSix/go-transact/transaction"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+const (
+	// Waiting for a payment
+	STATUS_PENDING = "pending"
+
+	// The amount paid is the amount expected
+	MATCH_EXACT = "exact"
+	// Less than the expected amount was paid
+	MATCH_PARTIAL = "partial"
+	// More than the expected amount was paid
+	MATCH_OVERPAID = "overpaid"
+	// No payment is expected with the transaction's vendor reference
+	MATCH_UNKNOWN_REFERENCE = "unknown_reference"
+	// The payment arrived after the expected payment expired
+	MATCH_EXPIRED = "expired"
+	// The payment was made in another currency than the one expected
+	MATCH_CURRENCY_MISMATCH = "currency_mismatch"
+
+	// The transaction brought the total received below the expected amount
+	EVENT_PARTIAL_PAYMENT = "payment.partially_paid"
+	// The transaction brought the total received to the expected amount or more
+	EVENT_FULLY_PAID = "payment.fully_paid"
+)
+
+// Returned by Register when a payment is already expected with the same vendor reference
+var ErrDuplicateReference = errors.New("a payment is already expected with vendor reference")
+
+// A payment announced by the vendor, matched against incoming transactions by vendor reference
+type ExpectedPayment struct {
+	ID                string    `gorm:"primaryKey" json:"id"`
+	CreatedAt         time.Time `json:"createdAt"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+	VendorReferenceId string    `gorm:"uniqueIndex" json:"vendorReferenceId"`
+	// Plain decimal, i.e, 5000.00
+	Amount   string `json:"amount"`
+	Currency string `json:"currency,omitempty"`
+	// Payments received later are flagged as expired. Nil = never expires
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// STATUS_PENDING, or the outcome of the last matched transaction
+	Status string `json:"status"`
+	// Total received in the expected currency, see ReceivedTotal
+	ReceivedAmount string `json:"receivedAmount,omitempty"`
+	// Last matched transaction
+	TransactionId string     `json:"transactionId,omitempty"`
+	MatchedAt     *time.Time `json:"matchedAt,omitempty"`
+}
+
+// Outcome of matching a transaction against the expected payments, included in the callback
+type Match struct {
+	// See MATCH_*
+	Outcome           string
+	ExpectedPaymentId string
+	ExpectedAmount    string
+	ExpectedCurrency  string
+	ReceivedAmount    string
+	// Total received with the vendor reference in the transaction's currency since the payment was registered,
+	// including this transaction. Empty if the reference is unknown
+	TotalReceived string
+	// EVENT_PARTIAL_PAYMENT or EVENT_FULLY_PAID. Empty if the reference is unknown, the payment expired or was
+	// already fully paid, or the transaction is in another currency
+	Event string
+}
+
+// Normalizes and checks an expected payment before it is registered
+func (p *ExpectedPayment) validate() error {
+	p.VendorReferenceId = strings.TrimSpace(p.VendorReferenceId)
+	if utils.IsStringEmpty(p.VendorReferenceId) {
+		return fmt.Errorf("vendorReferenceId is required")
+	}
+	amount, err := utils.NormalizeAmount(p.Amount)
+	if err != nil {
+		return err
+	}
+	p.Amount = amount
+	p.Currency = strings.ToUpper(strings.TrimSpace(p.Currency))
+	return nil
+}
+
+// Register Stores a new expected payment. Fails if a payment is already expected with the same vendor reference.
+// Totals left from before the payment was registered are removed
+func Register(payment *ExpectedPayment) error {
+	if err := payment.validate(); err != nil {
+		return err
+	}
+	totalsLock.Lock()
+	defer totalsLock.Unlock()
+	if _, err := Get(payment.VendorReferenceId); err == nil {
+		return fmt.Errorf("%w %s", ErrDuplicateReference, payment.VendorReferenceId)
+	} else if !persistence.IsNotFound(err) {
+		return err
+	}
+	payment.ID = uuid.NewV4().String()
+	payment.Status = STATUS_PENDING
+	payment.ReceivedAmount = ""
+	payment.TransactionId = ""
+	payment.MatchedAt = nil
+	if _, err := persistence.Delete(&ReceivedTotal{}, "UPPER(vendor_reference_id) = UPPER(?)", payment.VendorReferenceId); err != nil {
+		return fmt.Errorf("error removing totals received with vendor reference %s. %v", payment.VendorReferenceId, err)
+	}
+	return persistence.Save(payment)
+}
+
+// Get Returns the payment expected with the vendor reference. References are compared ignoring case
+func Get(vendorReferenceId string) (*ExpectedPayment, error) {
+	var payment ExpectedPayment
+	if err := persistence.First(&payment, "UPPER(vendor_reference_id) = UPPER(?)", strings.TrimSpace(vendorReferenceId)); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// Cancel Removes the payment expected with the vendor reference and the totals received with it.
+// Returns false if there was none
+func Cancel(vendorReferenceId string) (bool, error) {
+	totalsLock.Lock()
+	defer totalsLock.Unlock()
+	query := "UPPER(vendor_reference_id) = UPPER(?)"
+	deleted, err := persistence.Delete(&ExpectedPayment{}, query, strings.TrimSpace(vendorReferenceId))
+	if err != nil || deleted == 0 {
+		return false, err
+	}
+	if _, err := persistence.Delete(&ReceivedTotal{}, query, strings.TrimSpace(vendorReferenceId)); err != nil {
+		log.Errorf("failed to remove totals received with vendor reference %s. %s", vendorReferenceId, err.Error())
+	}
+	return true, nil
+}
+
+// Reconcile Adds the transaction to the total received with its vendor reference, matches the total against the
+// payment expected with the reference and records the outcome. Transactions with an unknown reference are not
+// added up, so a payment registered later only counts what was received after it
+func Reconcile(t *transaction.Transaction) (*Match, error) {
+	totalsLock.Lock()
+	defer totalsLock.Unlock()
+
+	payment, err := Get(t.VendorReferenceId)
+	if persistence.IsNotFound(err) {
+		return &Match{Outcome: MATCH_UNKNOWN_REFERENCE, ReceivedAmount: t.NormalizedAmount}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error looking up expected payment %s. %v", t.VendorReferenceId, err)
+	}
+
+	total, err := accumulate(t)
+	if err != nil {
+		return nil, err
+	}
+	match := &Match{ReceivedAmount: t.NormalizedAmount, TotalReceived: total.Amount}
+	match.ExpectedPaymentId = payment.ID
+	match.ExpectedAmount = payment.Amount
+	match.ExpectedCurrency = payment.Currency
+
+	wasPaid, err := payment.paid()
+	if err != nil {
+		return nil, err
+	}
+	match.Outcome, err = outcome(payment, t, total)
+	if err != nil {
+		return nil, err
+	}
+	if match.Outcome != MATCH_CURRENCY_MISMATCH {
+		payment.ReceivedAmount = total.Amount
+		switch isPaid, _ := payment.paid(); {
+		case match.Outcome == MATCH_EXPIRED:
+		case !isPaid:
+			match.Event = EVENT_PARTIAL_PAYMENT
+		case !wasPaid:
+			match.Event = EVENT_FULLY_PAID
+		}
+	}
+
+	payment.Status = match.Outcome
+	payment.TransactionId = t.ID
+	now := time.Now()
+	payment.MatchedAt = &now
+	if err := persistence.Update(payment); err != nil {
+		log.Errorf("failed to record match of expected payment %s. %s", payment.VendorReferenceId, err.Error())
+	}
+	return match, nil
+}
+
+// Reports whether the amount received so far covers the expected amount
+func (p *ExpectedPayment) paid() (bool, error) {
+	if utils.IsStringEmpty(p.ReceivedAmount) {
+		return false, nil
+	}
+	cmp, err := utils.CompareAmounts(p.ReceivedAmount, p.Amount)
+	return cmp >= 0, err
+}
+
+func outcome(payment *ExpectedPayment, t *transaction.Transaction, total *ReceivedTotal) (string, error) {
+	if !utils.IsStringEmpty(payment.Currency) && !utils.IsStringEmpty(t.Currency) && !strings.EqualFold(payment.Currency, t.Currency) {
+		return MATCH_CURRENCY_MISMATCH, nil
+	}
+	if payment.ExpiresAt != nil && t.CreatedAt.After(*payment.ExpiresAt) {
+		return MATCH_EXPIRED, nil
+	}
+	cmp, err := utils.CompareAmounts(total.Amount, payment.Amount)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case cmp < 0:
+		return MATCH_PARTIAL, nil
+	case cmp > 0:
+		return MATCH_OVERPAID, nil
+	}
+	return MATCH_EXACT, nil
+}
+
+// List Returns the expected payments with the given status, or all of them if status is empty
+func List(status string) ([]ExpectedPayment, error) {
+	var payments []ExpectedPayment
+	var err error
+	if utils.IsStringEmpty(status) {
+		err = persistence.Find(&payments, "1 = 1")
+	} else {
+		err = persistence.Find(&payments, "status = ?", status)
+	}
+	return payments, err
+}
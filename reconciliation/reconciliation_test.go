@@ -0,0 +1,205 @@
+package reconciliation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/twinj/uuid"
+
+	"github.com/SharkFourSix/go-transact/persistence"
+	"github.com/SharkFourSix/go-transact/transaction"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+func setupDatabase(t *testing.T) {
+	if err := persistence.Initialize(5000); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(persistence.Cleanup)
+	if err := persistence.Migrate(&ExpectedPayment{}, &ReceivedTotal{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	setupDatabase(t)
+
+	expired := time.Now().Add(-time.Hour)
+	cases := []struct {
+		name     string
+		expected *ExpectedPayment
+		amount   string
+		currency string
+		outcome  string
+	}{
+		{"exact", &ExpectedPayment{Amount: "20,000.00", Currency: "mwk"}, "20000", "MWK", MATCH_EXACT},
+		{"partial", &ExpectedPayment{Amount: "20000"}, "15,000.00", "MWK", MATCH_PARTIAL},
+		{"overpaid", &ExpectedPayment{Amount: "20000"}, "20,000.50", "MWK", MATCH_OVERPAID},
+		{"expired", &ExpectedPayment{Amount: "20000", ExpiresAt: &expired}, "20,000.00", "MWK", MATCH_EXPIRED},
+		{"currency", &ExpectedPayment{Amount: "20000", Currency: "USD"}, "20,000.00", "MWK", MATCH_CURRENCY_MISMATCH},
+		{"unknown", nil, "20,000.00", "MWK", MATCH_UNKNOWN_REFERENCE},
+	}
+
+	for _, c := range cases {
+		reference := uuid.NewV4().String()
+		if c.expected != nil {
+			c.expected.VendorReferenceId = reference
+			if err := Register(c.expected); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+
+		tx := &transaction.Transaction{
+			ID:                uuid.NewV4().String(),
+			CreatedAt:         time.Now(),
+			Amount:            c.amount,
+			Currency:          c.currency,
+			VendorReferenceId: reference,
+		}
+		tx.NormalizedAmount, _ = utils.NormalizeAmount(c.amount)
+
+		match, err := Reconcile(tx)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if match.Outcome != c.outcome {
+			t.Errorf("%s: expected outcome %s, got %s", c.name, c.outcome, match.Outcome)
+		}
+		if c.expected == nil {
+			continue
+		}
+
+		payment, err := Get(reference)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if payment.Status != c.outcome || payment.TransactionId != tx.ID || payment.MatchedAt == nil {
+			t.Errorf("%s: match was not recorded, status %s", c.name, payment.Status)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	setupDatabase(t)
+
+	reference := uuid.NewV4().String()
+	if err := Register(&ExpectedPayment{VendorReferenceId: reference, Amount: "abc"}); err == nil {
+		t.Error("invalid amount was accepted")
+	}
+	if err := Register(&ExpectedPayment{VendorReferenceId: reference, Amount: "1,500.00"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(&ExpectedPayment{VendorReferenceId: reference, Amount: "10"}); err == nil {
+		t.Error("duplicate reference was accepted")
+	}
+
+	payment, err := Get(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Amount != "1500.00" || payment.Status != STATUS_PENDING {
+		t.Errorf("unexpected payment %+v", payment)
+	}
+
+	if cancelled, err := Cancel(reference); err != nil || !cancelled {
+		t.Errorf("payment was not cancelled. %v", err)
+	}
+	if cancelled, _ := Cancel(reference); cancelled {
+		t.Error("payment was cancelled twice")
+	}
+}
+
+func TestPartialPayments(t *testing.T) {
+	setupDatabase(t)
+
+	reference := uuid.NewV4().String()
+	if err := Register(&ExpectedPayment{VendorReferenceId: reference, Amount: "30,000.00", Currency: "MWK"}); err != nil {
+		t.Fatal(err)
+	}
+
+	payments := []struct {
+		amount   string
+		currency string
+		outcome  string
+		event    string
+		total    string
+	}{
+		{"10,000.00", "MWK", MATCH_PARTIAL, EVENT_PARTIAL_PAYMENT, "10000.00"},
+		{"5.00", "USD", MATCH_CURRENCY_MISMATCH, "", "5.00"},
+		{"15,000.50", "MWK", MATCH_PARTIAL, EVENT_PARTIAL_PAYMENT, "25000.50"},
+		{"4,999.50", "MWK", MATCH_EXACT, EVENT_FULLY_PAID, "30000.00"},
+		{"100", "MWK", MATCH_OVERPAID, "", "30100.00"},
+	}
+	for i, p := range payments {
+		tx := &transaction.Transaction{
+			ID:                uuid.NewV4().String(),
+			CreatedAt:         time.Now(),
+			Amount:            p.amount,
+			Currency:          p.currency,
+			VendorReferenceId: reference,
+		}
+		tx.NormalizedAmount, _ = utils.NormalizeAmount(p.amount)
+
+		match, err := Reconcile(tx)
+		if err != nil {
+			t.Fatalf("payment %d: %v", i, err)
+		}
+		if match.Outcome != p.outcome || match.Event != p.event || match.TotalReceived != p.total {
+			t.Errorf("payment %d: expected %s, %s, %s, got %s, %s, %s", i, p.outcome, p.event, p.total, match.Outcome, match.Event, match.TotalReceived)
+		}
+	}
+
+	payment, err := Get(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.ReceivedAmount != "30100.00" {
+		t.Errorf("expected 30100.00 received, got %s", payment.ReceivedAmount)
+	}
+	if total, err := GetTotal(reference, "usd"); err != nil || total.Amount != "5.00" || total.Transactions != 1 {
+		t.Errorf("unexpected USD total %+v. %v", total, err)
+	}
+
+	if _, err := Cancel(reference); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetTotal(reference, "MWK"); !persistence.IsNotFound(err) {
+		t.Errorf("totals were not removed with the expected payment. %v", err)
+	}
+}
+
+// Transfers made before the payment was registered are not added to its total
+func TestUnregisteredReference(t *testing.T) {
+	setupDatabase(t)
+
+	reference := uuid.NewV4().String()
+	reconcile := func(amount string) *Match {
+		tx := &transaction.Transaction{
+			ID:                uuid.NewV4().String(),
+			CreatedAt:         time.Now(),
+			Amount:            amount,
+			Currency:          "MWK",
+			VendorReferenceId: reference,
+		}
+		tx.NormalizedAmount, _ = utils.NormalizeAmount(amount)
+		match, err := Reconcile(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return match
+	}
+
+	if match := reconcile("10,000.00"); match.Outcome != MATCH_UNKNOWN_REFERENCE || match.TotalReceived != "" {
+		t.Errorf("expected %s without a total, got %s, %s", MATCH_UNKNOWN_REFERENCE, match.Outcome, match.TotalReceived)
+	}
+	if _, err := GetTotal(reference, "MWK"); !persistence.IsNotFound(err) {
+		t.Errorf("transfer to an unknown reference was added up. %v", err)
+	}
+
+	if err := Register(&ExpectedPayment{VendorReferenceId: reference, Amount: "20,000.00"}); err != nil {
+		t.Fatal(err)
+	}
+	if match := reconcile("10,000.00"); match.Outcome != MATCH_PARTIAL || match.TotalReceived != "10000.00" {
+		t.Errorf("expected %s with 10000.00 received, got %s, %s", MATCH_PARTIAL, match.Outcome, match.TotalReceived)
+	}
+}
@@ -0,0 +1,75 @@
+package reconciliation
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twinj/uuid"
+
+	"github.com/SharkFourSix/go-transact/persistence"
+	"github.com/SharkFourSix/go-transact/transaction"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+// Serializes updates of the totals, transactions are processed by several workers
+var totalsLock sync.Mutex
+
+// Cumulative amount received with a vendor reference in a currency, for invoices paid in several transfers
+type ReceivedTotal struct {
+	ID                string    `gorm:"primaryKey" json:"id"`
+	CreatedAt         time.Time `json:"createdAt"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+	VendorReferenceId string    `gorm:"uniqueIndex:idx_received_total" json:"vendorReferenceId"`
+	// Upper case. Empty if the transactions did not state one
+	Currency string `gorm:"uniqueIndex:idx_received_total" json:"currency,omitempty"`
+	// Plain decimal, i.e, 5000.00
+	Amount       string `json:"amount"`
+	Transactions int    `json:"transactions"`
+}
+
+// GetTotal Returns the total received with the vendor reference in the currency. References are compared ignoring case
+func GetTotal(vendorReferenceId string, currency string) (*ReceivedTotal, error) {
+	var total ReceivedTotal
+	err := persistence.First(&total, "UPPER(vendor_reference_id) = UPPER(?) AND currency = ?",
+		strings.TrimSpace(vendorReferenceId), strings.ToUpper(strings.TrimSpace(currency)))
+	if err != nil {
+		return nil, err
+	}
+	return &total, nil
+}
+
+// Adds the amount of the transaction to the total received with its vendor reference and currency.
+// Must be called with totalsLock held
+func accumulate(t *transaction.Transaction) (*ReceivedTotal, error) {
+	if utils.IsStringEmpty(t.NormalizedAmount) {
+		return nil, fmt.Errorf("amount '%s' of transaction %s could not be read", t.Amount, t.ID)
+	}
+	total, err := GetTotal(t.VendorReferenceId, t.Currency)
+	if persistence.IsNotFound(err) {
+		total = &ReceivedTotal{
+			ID:                uuid.NewV4().String(),
+			VendorReferenceId: strings.TrimSpace(t.VendorReferenceId),
+			Currency:          strings.ToUpper(strings.TrimSpace(t.Currency)),
+			Amount:            t.NormalizedAmount,
+			Transactions:      1,
+		}
+		if err := persistence.Save(total); err != nil {
+			return nil, fmt.Errorf("error saving total received with vendor reference %s. %v", t.VendorReferenceId, err)
+		}
+		return total, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error looking up total received with vendor reference %s. %v", t.VendorReferenceId, err)
+	}
+
+	if total.Amount, err = utils.AddAmounts(total.Amount, t.NormalizedAmount); err != nil {
+		return nil, err
+	}
+	total.Transactions++
+	if err := persistence.Update(total); err != nil {
+		return nil, fmt.Errorf("error updating total received with vendor reference %s. %v", t.VendorReferenceId, err)
+	}
+	return total, nil
+}
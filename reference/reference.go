@@ -0,0 +1,282 @@
+package reference
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode"
+
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+const (
+	CHECK_DIGIT_NONE = "none"
+	// Luhn mod N, works with any alphabet. Detects all single character errors and most transpositions
+	CHECK_DIGIT_LUHN = "luhn"
+	// Damm algorithm, requires an alphabet of 10 characters. Detects all single character errors and adjacent transpositions
+	CHECK_DIGIT_DAMM = "damm"
+
+	// Digits and upper case letters without I and O, which are easily confused with 1 and 0
+	DEFAULT_ALPHABET = "0123456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+	DEFAULT_LENGTH   = 8
+	// Most alternatives tried when correcting a reference
+	MAX_CORRECTIONS = 256
+)
+
+var CheckDigits = []string{CHECK_DIGIT_NONE, CHECK_DIGIT_LUHN, CHECK_DIGIT_DAMM}
+
+// Characters customers commonly type instead of one another
+var confusions = map[rune]string{
+	'0': "O",
+	'O': "0",
+	'1': "IL",
+	'I': "1L",
+	'L': "1I",
+	'2': "Z",
+	'Z': "2",
+	'5': "S",
+	'S': "5",
+	'8': "B",
+	'B': "8",
+}
+
+// Weak totally anti-symmetric quasigroup of order 10 used by the Damm algorithm
+var dammTable = [10][10]int{
+	{0, 3, 1, 7, 5, 9, 8, 6, 4, 2},
+	{7, 0, 9, 2, 1, 5, 4, 8, 6, 3},
+	{4, 2, 0, 6, 8, 7, 1, 3, 5, 9},
+	{1, 7, 5, 0, 9, 8, 3, 4, 2, 6},
+	{6, 1, 2, 3, 0, 4, 5, 9, 7, 8},
+	{3, 6, 7, 4, 2, 0, 9, 5, 8, 1},
+	{5, 8, 6, 9, 7, 2, 0, 1, 3, 4},
+	{8, 9, 4, 5, 3, 6, 2, 0, 1, 7},
+	{9, 4, 3, 8, 6, 1, 7, 2, 0, 5},
+	{2, 5, 8, 1, 4, 3, 6, 7, 9, 0},
+}
+
+// Issues vendor references and recognizes them in bank alerts.
+// A reference is Prefix, Length random characters from Alphabet, then a check character unless CheckDigit is none.
+type Generator struct {
+	Alphabet   string `yaml:"alphabet"`
+	Length     int    `yaml:"length"`
+	Prefix     string `yaml:"prefix"`
+	CheckDigit string `yaml:"checkDigit"`
+}
+
+func (g *Generator) alphabet() string {
+	if utils.IsStringEmpty(g.Alphabet) {
+		return DEFAULT_ALPHABET
+	}
+	return g.Alphabet
+}
+
+func (g *Generator) length() int {
+	if g.Length <= 0 {
+		return DEFAULT_LENGTH
+	}
+	return g.Length
+}
+
+func (g *Generator) checkDigit() string {
+	if utils.IsStringEmpty(g.CheckDigit) {
+		return CHECK_DIGIT_NONE
+	}
+	return strings.ToLower(g.CheckDigit)
+}
+
+// Check Reports whether references carry a check character
+func (g *Generator) Check() bool {
+	return g.checkDigit() != CHECK_DIGIT_NONE
+}
+
+// Validate Checks the generator settings
+func (g *Generator) Validate() error {
+	alphabet := g.alphabet()
+	if len(alphabet) < 2 {
+		return fmt.Errorf("alphabet must have at least 2 characters")
+	}
+	seen := map[rune]bool{}
+	for _, c := range alphabet {
+		if c > unicode.MaxASCII || unicode.IsSpace(c) {
+			return fmt.Errorf("alphabet may only contain printable ASCII characters")
+		}
+		if seen[c] {
+			return fmt.Errorf("alphabet contains '%c' twice", c)
+		}
+		seen[c] = true
+	}
+	switch g.checkDigit() {
+	case CHECK_DIGIT_NONE, CHECK_DIGIT_LUHN:
+	case CHECK_DIGIT_DAMM:
+		if len(alphabet) != 10 {
+			return fmt.Errorf("the %s check digit requires an alphabet of 10 characters", CHECK_DIGIT_DAMM)
+		}
+	default:
+		return fmt.Errorf("unsupported check digit '%s'. Supported: %s", g.CheckDigit, strings.Join(CheckDigits, ", "))
+	}
+	return nil
+}
+
+// Generate Issues a new random reference
+func (g *Generator) Generate() (string, error) {
+	if err := g.Validate(); err != nil {
+		return "", err
+	}
+	alphabet := g.alphabet()
+	max := big.NewInt(int64(len(alphabet)))
+	payload := make([]byte, g.length())
+	for i := range payload {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("error generating reference. %v", err)
+		}
+		payload[i] = alphabet[n.Int64()]
+	}
+	return g.Prefix + string(payload) + g.checkCharacter(string(payload)), nil
+}
+
+// Returns the check character of the payload, or an empty string if references carry none
+func (g *Generator) checkCharacter(payload string) string {
+	alphabet := g.alphabet()
+	switch g.checkDigit() {
+	case CHECK_DIGIT_LUHN:
+		n := len(alphabet)
+		factor, sum := 2, 0
+		for i := len(payload) - 1; i >= 0; i-- {
+			addend := factor * strings.IndexByte(alphabet, payload[i])
+			factor = 3 - factor
+			sum += addend/n + addend%n
+		}
+		return string(alphabet[(n-sum%n)%n])
+	case CHECK_DIGIT_DAMM:
+		interim := 0
+		for i := 0; i < len(payload); i++ {
+			interim = dammTable[interim][strings.IndexByte(alphabet, payload[i])]
+		}
+		return string(alphabet[interim])
+	}
+	return ""
+}
+
+// Splits a reference into its payload and check character. ok is false if it cannot be one of ours
+func (g *Generator) split(reference string) (payload string, check string, ok bool) {
+	if !strings.HasPrefix(strings.ToUpper(reference), strings.ToUpper(g.Prefix)) {
+		return "", "", false
+	}
+	rest := reference[len(g.Prefix):]
+	size := g.length()
+	if g.Check() {
+		size++
+	}
+	if len(rest) != size {
+		return "", "", false
+	}
+	for i := 0; i < len(rest); i++ {
+		if strings.IndexByte(g.alphabet(), rest[i]) < 0 {
+			return "", "", false
+		}
+	}
+	return rest[:g.length()], rest[g.length():], true
+}
+
+// Valid Reports whether the reference has the expected shape and a correct check character
+func (g *Generator) Valid(reference string) bool {
+	payload, check, ok := g.split(reference)
+	return ok && check == g.checkCharacter(payload)
+}
+
+// Correct Returns the reference the customer most likely meant, and whether it is valid.
+//
+//	Spaces and dashes customers add are removed and case is adjusted to the alphabet. Characters outside of the
+//	alphabet are replaced with the characters they are commonly confused with (0/O, 1/I, ...). If the check character
+//	still does not match, confusable characters are swapped one at a time. A correction is only made when exactly one
+//	alternative has a valid check character. Without a check character there is no telling whether a change is
+//	right, so the reference is returned unchanged.
+func (g *Generator) Correct(reference string) (string, bool) {
+	if g.Valid(reference) {
+		return reference, true
+	}
+	if !g.Check() {
+		return reference, false
+	}
+	alphabet := g.alphabet()
+	cleaned := strings.Map(func(c rune) rune {
+		if unicode.IsSpace(c) || (c == '-' && !strings.ContainsRune(alphabet+g.Prefix, '-')) {
+			return -1
+		}
+		return c
+	}, reference)
+	if len(cleaned) < len(g.Prefix) {
+		return reference, false
+	}
+	prefix := cleaned[:len(g.Prefix)]
+	if !strings.EqualFold(prefix, g.Prefix) {
+		return reference, false
+	}
+
+	// Characters outside of the alphabet are replaced with the characters in it they are commonly confused with
+	rest := []rune(cleaned[len(g.Prefix):])
+	options := make([][]rune, len(rest))
+	combinations := 1
+	for i, c := range rest {
+		switch {
+		case strings.ContainsRune(alphabet, c):
+			options[i] = []rune{c}
+		case strings.ContainsRune(alphabet, unicode.ToUpper(c)):
+			options[i] = []rune{unicode.ToUpper(c)}
+		case strings.ContainsRune(alphabet, unicode.ToLower(c)):
+			options[i] = []rune{unicode.ToLower(c)}
+		default:
+			options[i] = g.inAlphabet(unicode.ToUpper(c))
+		}
+		combinations *= len(options[i])
+		if combinations == 0 || combinations > MAX_CORRECTIONS {
+			return reference, false
+		}
+	}
+	var corrections []string
+	for n := 0; n < combinations; n++ {
+		if candidate := g.Prefix + string(g.combination(options, n)); g.Valid(candidate) {
+			corrections = append(corrections, candidate)
+		}
+	}
+	if len(corrections) == 0 && combinations == 1 {
+		// Every character is in the alphabet. Try swapping one confusable character at a time
+		rest = g.combination(options, 0)
+		for i, c := range rest {
+			for _, alternative := range g.inAlphabet(c) {
+				swapped := append([]rune{}, rest...)
+				swapped[i] = alternative
+				if g.Valid(g.Prefix + string(swapped)) {
+					corrections = append(corrections, g.Prefix+string(swapped))
+				}
+			}
+		}
+	}
+	if len(corrections) == 1 {
+		return corrections[0], true
+	}
+	return reference, false
+}
+
+// Returns the n-th combination of the options for each character
+func (g *Generator) combination(options [][]rune, n int) []rune {
+	combination := make([]rune, len(options))
+	for i, o := range options {
+		combination[i] = o[n%len(o)]
+		n /= len(o)
+	}
+	return combination
+}
+
+// Characters in the alphabet that are commonly confused with c
+func (g *Generator) inAlphabet(c rune) []rune {
+	var found []rune
+	for _, alternative := range confusions[c] {
+		if strings.ContainsRune(g.alphabet(), alternative) {
+			found = append(found, alternative)
+		}
+	}
+	return found
+}
@@ -0,0 +1,83 @@
+package reference
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckCharacter(t *testing.T) {
+	digits := "0123456789"
+	luhn := &Generator{Alphabet: digits, Length: 10, CheckDigit: CHECK_DIGIT_LUHN}
+	if !luhn.Valid("79927398713") || luhn.Valid("79927398710") {
+		t.Error("luhn check digit does not match the decimal Luhn algorithm")
+	}
+	damm := &Generator{Alphabet: digits, Length: 3, CheckDigit: CHECK_DIGIT_DAMM}
+	if !damm.Valid("5724") || damm.Valid("5734") || damm.Valid("7524") {
+		t.Error("damm check digit does not match the Damm algorithm")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	generators := []*Generator{
+		{},
+		{Prefix: "INV-", Length: 6, CheckDigit: CHECK_DIGIT_LUHN},
+		{Alphabet: "0123456789", Length: 10, CheckDigit: CHECK_DIGIT_DAMM},
+	}
+	for _, g := range generators {
+		for i := 0; i < 50; i++ {
+			reference, err := g.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(reference, g.Prefix) || !g.Valid(reference) {
+				t.Fatalf("%+v: invalid reference %s", g, reference)
+			}
+		}
+	}
+
+	for _, g := range []*Generator{
+		{Alphabet: "A"},
+		{Alphabet: "ABCA"},
+		{Alphabet: "ABC", CheckDigit: CHECK_DIGIT_DAMM},
+		{CheckDigit: "verhoeff"},
+	} {
+		if err := g.Validate(); err == nil {
+			t.Errorf("%+v: invalid settings were accepted", g)
+		}
+	}
+}
+
+func TestCorrect(t *testing.T) {
+	g := &Generator{Prefix: "INV-", Length: 6, CheckDigit: CHECK_DIGIT_LUHN}
+	valid := "INV-" + "10AB2Z"
+	valid += g.checkCharacter("10AB2Z")
+
+	cases := []struct {
+		name   string
+		input  string
+		output string
+		valid  bool
+	}{
+		{"valid", valid, valid, true},
+		{"case and spaces", strings.ToLower(valid[:7]) + " " + valid[7:], valid, true},
+		{"outside of alphabet", strings.Replace(valid, "10", "IO", 1), valid, true},
+		{"confused digit", strings.Replace(valid, "2Z", "ZZ", 1), valid, true},
+		{"unrelated typo", strings.Replace(valid, "AB", "AC", 1), strings.Replace(valid, "AB", "AC", 1), false},
+		{"other prefix", "ORD-10AB2ZX", "ORD-10AB2ZX", false},
+	}
+	for _, c := range cases {
+		output, ok := g.Correct(c.input)
+		if output != c.output || ok != c.valid {
+			t.Errorf("%s: %s corrected to %s (%v), expected %s (%v)", c.name, c.input, output, ok, c.output, c.valid)
+		}
+	}
+}
+
+func TestCorrectWithoutCheckDigit(t *testing.T) {
+	g := &Generator{}
+	for _, input := range []string{"PO001234", "SO12OO34", "ab12 cd34"} {
+		if output, ok := g.Correct(input); output != input || ok {
+			t.Errorf("%s corrected to %s (%v) without a check digit", input, output, ok)
+		}
+	}
+}
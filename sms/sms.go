@@ -0,0 +1,153 @@
+package sms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SharkFourSix/go-transact/persistence"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+// An SMS received through the webhook, stored as received
+type ReceivedSms struct {
+	ID        string `gorm:"primaryKey"`
+	CreatedAt time.Time
+	// Sender ID or phone number the SMS came from
+	Sender  string
+	Message string
+	// When the forwarding device received the SMS, if the forwarder reports it
+	ReceivedAt time.Time
+	// Device or SIM the SMS was received on, if the forwarder reports it
+	Device    string
+	IpAddress string
+	// Template the sender matched. Empty if the sender did not match any template
+	TemplateName string
+}
+
+// Payload field names used by common SMS forwarder apps, matched case insensitively
+var (
+	senderFields     = []string{"from", "sender", "phoneNumber", "phone_number", "originator", "address", "msisdn"}
+	messageFields    = []string{"text", "message", "body", "content", "msg"}
+	receivedAtFields = []string{"receivedStamp", "receivedAt", "received_at", "timestamp", "sentStamp"}
+	deviceFields     = []string{"sim", "deviceId", "device_id", "device", "to"}
+	// Forwarders wrapping the SMS in an envelope, i.e, {"event": "sms:received", "payload": {...}}
+	envelopeFields = []string{"payload", "data", "sms"}
+)
+
+// ParseJSON Reads an SMS from a forwarder's JSON payload
+func ParseJSON(body []byte) (*ReceivedSms, error) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid JSON payload. %v", err)
+	}
+	for _, name := range envelopeFields {
+		if inner, ok := lookup(payload, name).(map[string]interface{}); ok {
+			payload = inner
+			break
+		}
+	}
+	return parse(func(name string) string {
+		switch value := lookup(payload, name).(type) {
+		case string:
+			return value
+		case float64:
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		}
+		return ""
+	})
+}
+
+// ParseForm Reads an SMS from form fields, as posted by forwarders and gateways that do not send JSON
+func ParseForm(form url.Values) (*ReceivedSms, error) {
+	return parse(func(name string) string {
+		for key, values := range form {
+			if strings.EqualFold(key, name) && len(values) > 0 {
+				return values[0]
+			}
+		}
+		return ""
+	})
+}
+
+func lookup(payload map[string]interface{}, name string) interface{} {
+	for key, value := range payload {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return nil
+}
+
+func parse(field func(name string) string) (*ReceivedSms, error) {
+	first := func(names []string) string {
+		for _, name := range names {
+			if value := strings.TrimSpace(field(name)); !utils.IsStringEmpty(value) {
+				return value
+			}
+		}
+		return ""
+	}
+
+	received := &ReceivedSms{
+		Sender:  first(senderFields),
+		Message: first(messageFields),
+		Device:  first(deviceFields),
+	}
+	if utils.IsStringEmpty(received.Sender) {
+		return nil, fmt.Errorf("payload has no sender. Expected one of %s", strings.Join(senderFields, ", "))
+	}
+	if utils.IsStringEmpty(received.Message) {
+		return nil, fmt.Errorf("payload has no message text. Expected one of %s", strings.Join(messageFields, ", "))
+	}
+	received.ReceivedAt = parseTime(first(receivedAtFields))
+	return received, nil
+}
+
+// Reads a timestamp in RFC 3339 or as unix time in seconds or milliseconds. Zero if it cannot be read
+func parseTime(value string) time.Time {
+	if utils.IsStringEmpty(value) {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		// Seconds would not reach this value until the year 33658
+		if n > 1e12 {
+			return time.UnixMilli(n)
+		}
+		return time.Unix(n, 0)
+	}
+	return time.Time{}
+}
+
+// FindDuplicate Returns the SMS stored earlier with the same sender, message and receivedAt, i.e, sent again by a
+// forwarder that got no answer. Returns nil if there is none or the forwarder does not report when the SMS was received,
+// two identical SMS are then both genuine
+func FindDuplicate(received *ReceivedSms) (*ReceivedSms, error) {
+	if received.ReceivedAt.IsZero() {
+		return nil, nil
+	}
+	var existing ReceivedSms
+	err := persistence.First(&existing, "sender = ? AND message = ? AND received_at = ? AND id <> ?",
+		received.Sender, received.Message, received.ReceivedAt, received.ID)
+	if persistence.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+// SenderMatches Compares SMS sender IDs ignoring case, spaces and a leading + on phone numbers
+func SenderMatches(a string, b string) bool {
+	normalize := func(s string) string {
+		return strings.TrimPrefix(strings.ReplaceAll(strings.TrimSpace(s), " ", ""), "+")
+	}
+	return strings.EqualFold(normalize(a), normalize(b))
+}
@@ -0,0 +1,129 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twinj/uuid"
+
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+const (
+	DEFAULT_WEBHOOK_PATH = "/sms"
+	// Same header the callback is signed with
+	TOKEN_HEADER = "X-Go-Transact-Token"
+	// SMS are short, anything larger is not a forwarder payload
+	MAX_PAYLOAD_SIZE = 64 * 1024
+	REQUEST_TIMEOUT  = 30 * time.Second
+)
+
+// HTTP endpoint receiving SMS from forwarder apps. Every accepted SMS is passed to Handler before the
+// request is answered. Handler returns an error if the SMS could not be stored, the request then fails so
+// forwarders send it again.
+type Webhook struct {
+	Address string
+	Path    string
+	// Required from clients in the X-Go-Transact-Token header, as a bearer token or in the token query parameter.
+	// Forwarder apps often only allow the URL to be configured, hence the query parameter.
+	Token   string
+	Handler func(*ReceivedSms) error
+
+	server *http.Server
+}
+
+func (w *Webhook) path() string {
+	if utils.IsStringEmpty(w.Path) {
+		return DEFAULT_WEBHOOK_PATH
+	}
+	return w.Path
+}
+
+// Start Serves the webhook until it is shut down
+func (w *Webhook) Start() error {
+	mux := http.NewServeMux()
+	mux.Handle(w.path(), w)
+	w.server = &http.Server{
+		Addr:         w.Address,
+		Handler:      mux,
+		ReadTimeout:  REQUEST_TIMEOUT,
+		WriteTimeout: REQUEST_TIMEOUT,
+	}
+	log.Infof("receiving SMS on http://%s%s", w.Address, w.path())
+	if err := w.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown Stops accepting requests and waits for SMS being processed
+func (w *Webhook) Shutdown(ctx context.Context) error {
+	if w.server == nil {
+		return nil
+	}
+	return w.server.Shutdown(ctx)
+}
+
+func (w *Webhook) authorized(r *http.Request) bool {
+	return utils.TokenMatches(utils.RequestToken(r, TOKEN_HEADER), w.Token)
+}
+
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	reply := func(status int, fields map[string]string) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(fields)
+	}
+
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		reply(http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !w.authorized(r) {
+		log.Warnf("%s: SMS rejected, invalid token", r.RemoteAddr)
+		reply(http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+		return
+	}
+
+	var (
+		received *ReceivedSms
+		err      error
+	)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		r.Body = http.MaxBytesReader(rw, r.Body, MAX_PAYLOAD_SIZE)
+		if err = r.ParseForm(); err == nil {
+			received, err = ParseForm(r.PostForm)
+		}
+	} else {
+		var body []byte
+		if body, err = ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, MAX_PAYLOAD_SIZE)); err == nil {
+			received, err = ParseJSON(body)
+		}
+	}
+	if err != nil {
+		log.Warnf("%s: SMS rejected. %s", r.RemoteAddr, err.Error())
+		reply(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	received.ID = uuid.NewV4().String()
+	received.CreatedAt = time.Now()
+	received.IpAddress = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		received.IpAddress = host
+	}
+
+	if err := w.Handler(received); err != nil {
+		log.Errorf("%s: SMS from %s not stored. %s", r.RemoteAddr, received.Sender, err.Error())
+		reply(http.StatusInternalServerError, map[string]string{"error": "SMS could not be stored, try again later"})
+		return
+	}
+	reply(http.StatusOK, map[string]string{"id": received.ID})
+}
@@ -0,0 +1,153 @@
+package sms
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twinj/uuid"
+
+	"github.com/SharkFourSix/go-transact/persistence"
+)
+
+const TEST_SMS = "Acct 1001 credited with MWK 5,000.00 Ref INV-42"
+
+func TestParse(t *testing.T) {
+	payloads := map[string]string{
+		"flat":     `{"from": "NBM", "text": "` + TEST_SMS + `", "sentStamp": 1700000000000, "receivedStamp": 1700000001000, "sim": "SIM1"}`,
+		"envelope": `{"event": "sms:received", "payload": {"phoneNumber": "NBM", "message": "` + TEST_SMS + `", "receivedAt": "2023-11-14T22:13:21Z"}}`,
+		"generic":  `{"Sender": "NBM", "Body": "` + TEST_SMS + `"}`,
+	}
+	for name, payload := range payloads {
+		received, err := ParseJSON([]byte(payload))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if received.Sender != "NBM" || received.Message != TEST_SMS {
+			t.Errorf("%s: unexpected sender %s, message %s", name, received.Sender, received.Message)
+		}
+		if name != "generic" && !received.ReceivedAt.Equal(time.Unix(1700000001, 0)) {
+			t.Errorf("%s: unexpected receive time %s", name, received.ReceivedAt)
+		}
+	}
+
+	received, err := ParseForm(url.Values{"From": {"NBM"}, "Body": {TEST_SMS}})
+	if err != nil || received.Sender != "NBM" || received.Message != TEST_SMS {
+		t.Errorf("form: unexpected result %v, %v", received, err)
+	}
+
+	if _, err := ParseJSON([]byte(`{"from": "NBM"}`)); err == nil {
+		t.Error("payload without message text was accepted")
+	}
+
+	if !SenderMatches("+265 888 000 111", "265888000111") || SenderMatches("NBM", "NBS") {
+		t.Error("unexpected sender comparison")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var handled []*ReceivedSms
+	webhook := &Webhook{
+		Token: "secret",
+		Handler: func(received *ReceivedSms) error {
+			if received.Message == "unstored" {
+				return fmt.Errorf("database is locked")
+			}
+			handled = append(handled, received)
+			return nil
+		},
+	}
+
+	post := func(target string, contentType string, body string, header string) int {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		rw := httptest.NewRecorder()
+		webhook.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	payload := `{"from": "NBM", "text": "` + TEST_SMS + `"}`
+	if code := post("/sms", "application/json", payload, ""); code != http.StatusUnauthorized {
+		t.Errorf("missing token: got %d", code)
+	}
+	if code := post("/sms?token=wrong", "application/json", payload, ""); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %d", code)
+	}
+	if code := post("/sms", "application/json", `{"text": "no sender"}`, "Bearer secret"); code != http.StatusBadRequest {
+		t.Errorf("invalid payload: got %d", code)
+	}
+	if code := post("/sms?token=secret", "application/json", payload, ""); code != http.StatusOK {
+		t.Errorf("json: got %d", code)
+	}
+	form := url.Values{"from": {"NBM"}, "message": {TEST_SMS}}.Encode()
+	if code := post("/sms", "application/x-www-form-urlencoded", form, "Bearer secret"); code != http.StatusOK {
+		t.Errorf("form: got %d", code)
+	}
+	// The forwarder must send SMS that could not be stored again
+	if code := post("/sms?token=secret", "application/json", `{"from": "NBM", "text": "unstored"}`, ""); code != http.StatusInternalServerError {
+		t.Errorf("unstored: got %d", code)
+	}
+
+	if len(handled) != 2 {
+		t.Fatalf("expected 2 handled SMS, got %d", len(handled))
+	}
+	for _, received := range handled {
+		if received.ID == "" || received.Sender != "NBM" || received.IpAddress != "192.0.2.1" {
+			t.Errorf("unexpected SMS %+v", received)
+		}
+	}
+}
+
+func TestFindDuplicate(t *testing.T) {
+	if err := persistence.Initialize(5000); err != nil {
+		t.Fatal(err)
+	}
+	defer persistence.Cleanup()
+	if err := persistence.Migrate(&ReceivedSms{}); err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(payload string) *ReceivedSms {
+		received, err := ParseJSON([]byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		received.ID = uuid.NewV4().String()
+		return received
+	}
+	// The database is kept between runs
+	stamp := time.Now().UnixMilli()
+	original := receive(fmt.Sprintf(`{"from": "NBM", "text": "%s", "receivedStamp": %d}`, TEST_SMS, stamp))
+	if err := persistence.Save(original); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		payload   string
+		duplicate bool
+	}{
+		{"retry", fmt.Sprintf(`{"from": "NBM", "text": "%s", "receivedStamp": %d, "sim": "SIM1"}`, TEST_SMS, stamp), true},
+		{"received later", fmt.Sprintf(`{"from": "NBM", "text": "%s", "receivedStamp": %d}`, TEST_SMS, stamp+60000), false},
+		{"other sender", fmt.Sprintf(`{"from": "NBS", "text": "%s", "receivedStamp": %d}`, TEST_SMS, stamp), false},
+		{"no received time", fmt.Sprintf(`{"from": "NBM", "text": "%s"}`, TEST_SMS), false},
+	}
+	for _, c := range cases {
+		duplicate, err := FindDuplicate(receive(c.payload))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if c.duplicate && (duplicate == nil || duplicate.ID != original.ID) {
+			t.Errorf("%s: expected a duplicate of %s, have %+v", c.name, original.ID, duplicate)
+		} else if !c.duplicate && duplicate != nil {
+			t.Errorf("%s: unexpected duplicate %s", c.name, duplicate.ID)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/SharkFourSix/go-transact/config"
+	"github.com/SharkFourSix/go-transact/messaging"
+	"github.com/SharkFourSix/go-transact/transaction"
+	"github.com/SharkFourSix/go-transact/utils"
+)
+
+// Parses a sample message with a template and prints the transaction and the callback it would produce.
+// Nothing is stored or sent. Returns the exit status.
+func testTemplate(templateName string, messageFile string) int {
+	if utils.IsStringEmpty(templateName) || utils.IsStringEmpty(messageFile) {
+		fmt.Println("test-template requires '--template' and '--message'")
+		return 1
+	}
+
+	var template *transaction.TransactionTemplate
+	for _, t := range config.GetTemplates() {
+		if strings.EqualFold(t.TemplateName, templateName) {
+			t := t
+			template = &t
+			break
+		}
+	}
+	if template == nil {
+		fmt.Printf("no template named '%s'\n", templateName)
+		return 1
+	}
+
+	message, err := ioutil.ReadFile(messageFile)
+	if err != nil {
+		fmt.Printf("error reading message %s. %s\n", messageFile, err.Error())
+		return 1
+	}
+	parsed, err := transaction.ParseTransaction(string(message), template)
+	if err != nil {
+		fmt.Printf("failed to parse transaction. %s\n", err.Error())
+		return 1
+	}
+	correctReference(parsed)
+
+	fmt.Printf("Transaction %s\n", strings.TrimPrefix(describeTransaction(parsed), ", "))
+	if !utils.IsStringEmpty(parsed.OriginalVendorReferenceId) {
+		fmt.Printf("Vendor reference corrected from %s\n", parsed.OriginalVendorReferenceId)
+	}
+
+	payload := config.GetCallbackPayload()
+	if payload == nil {
+		body, _ := json.MarshalIndent(messaging.NewTransactionData(parsed, nil), "", "  ")
+		fmt.Printf("\nCallback data:\n%s\n", body)
+		return 0
+	}
+
+	// Expected payments are not looked up, the payload is rendered as when reconciliation is disabled
+	data := messaging.SamplePayloadData()
+	data.Event = messaging.EVENT_TRANSACTION_RECEIVED
+	data.Reconciliation = nil
+	data.CreatedAt = parsed.CreatedAt
+	data.TemplateName = parsed.TemplateName
+	data.Date = parsed.Date
+	data.Amount = parsed.Amount
+	data.Currency = parsed.Currency
+	data.AccountNumber = parsed.AccountNumber
+	data.VendorReferenceId = parsed.VendorReferenceId
+	data.TransactionReferenceId = parsed.TransactionReferenceId
+	data.Transaction = parsed
+	body, headers, err := payload.Render(data)
+	if err != nil {
+		fmt.Printf("failed to render callback payload. %s\n", err.Error())
+		return 1
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("\nCallback payload, without reconciliation:")
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", name, headers[name])
+	}
+	fmt.Printf("\n%s\n", body)
+	return 0
+}
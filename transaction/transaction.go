@@ -15,20 +15,25 @@ import (
 	Represents a credit transaction
 */
 type Transaction struct {
-	ID                     string `gorm:"primaryKey"`
-	CreatedAt              time.Time
-	TemplateName           string
-	Date                   string
-	Amount                 string
-	Currency               string
-	AccountNumber          string
-	VendorReferenceId      string
-	TransactionReferenceId string
+	ID           string `gorm:"primaryKey"`
+	CreatedAt    time.Time
+	TemplateName string
+	Date         string
+	Amount       string
+	// Amount as a plain decimal, i.e, 5000.00. Empty if the amount could not be read
+	NormalizedAmount  string
+	Currency          string
+	AccountNumber     string
+	VendorReferenceId string
+	// Vendor reference as written by the customer, when it had to be corrected
+	OriginalVendorReferenceId string
+	TransactionReferenceId    string
 }
 
 /* Template used for parsing transactions from messages */
 type TransactionTemplate struct {
 	Email                         string `yaml:"email"`
+	SmsSender                     string `yaml:"smsSender"`
 	TemplateName                  string `yaml:"name"`
 	DatePattern                   string `yaml:"datePattern"`
 	AmountPattern                 string `yaml:"amountPattern"`
@@ -36,6 +41,30 @@ type TransactionTemplate struct {
 	AccountNumberPattern          string `yaml:"accountNumberPattern"`
 	VendorReferenceIdPattern      string `yaml:"vendorReferenceIdPattern"`
 	TransactionReferenceIdPattern string `yaml:"transactionReferenceIdPattern"`
+	// Mailboxes this template's mail is delivered to, see mailing.MatchMailbox. Mail to other mailboxes is not
+	// parsed with this template. Empty = any mailbox
+	Mailboxes []string `yaml:"mailboxes"`
+	// Networks (CIDR blocks) allowed to relay mail from this template's email. Empty = any
+	AllowedNetworks []string `yaml:"allowedNetworks"`
+	// Sender authentication required before mail is parsed with this template
+	Verification VerificationPolicy `yaml:"verification"`
+}
+
+// Per template requirements on the sender verification results, checked by mailing.CheckPolicy
+type VerificationPolicy struct {
+	// Require a DKIM signature that verifies, from the domain of Email. Mail whose From header is not in that domain fails
+	RequireDkim bool `yaml:"requireDkim"`
+	// Accept signatures from this domain or its subdomains instead of Email's. Implies requireDkim
+	DkimDomain string `yaml:"dkimDomain"`
+	// Require SPF to pass for the envelope sender
+	RequireSpf bool `yaml:"requireSpf"`
+	// Require DMARC to pass for the From header domain, which must be the domain of Email
+	RequireDmarc bool `yaml:"requireDmarc"`
+}
+
+// IsEmpty Returns true if the policy has no requirements
+func (p *VerificationPolicy) IsEmpty() bool {
+	return !p.RequireDkim && !p.RequireSpf && !p.RequireDmarc && utils.IsStringEmpty(p.DkimDomain)
 }
 
 func ParseTransaction(text string, template *TransactionTemplate) (*Transaction, error) {
@@ -94,6 +123,11 @@ func ParseTransaction(text string, template *TransactionTemplate) (*Transaction,
 	}
 	// remove non-digit chars
 	transaction.Amount = utils.ReplaceAll(transaction.Amount, `[^\d\.,]`, "")
+	if normalized, err := utils.NormalizeAmount(transaction.Amount); err == nil {
+		transaction.NormalizedAmount = normalized
+	} else {
+		log.Printf("amount of transaction[%s] could not be normalized. %s", template.TemplateName, err.Error())
+	}
 
 	if err := getTransactionField(&transaction.Date, "date", template.DatePattern, true); err != nil {
 		return nil, err
@@ -66,6 +66,10 @@ func TestTransaction(t *testing.T) {
 		t.Fatalf("Vendor reference id did not match")
 	}
 
+	if tx.NormalizedAmount != "20000.00" {
+		t.Fatalf("Unexpected normalized amount %s", tx.NormalizedAmount)
+	}
+
 	// Only works if -test.v is specified
 	out, _ := json.Marshal(tx)
 	t.Logf("Transaction: %s\n", out)
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// NormalizeAmount Converts an amount as written in an alert, i.e, "5,000.00", "5.000,00" or "5 000", to a plain
+// decimal such as "5000.00".
+//
+//	When both separators are used the last one is the decimal separator. A single separator between one to three
+//	digits not starting with 0 and exactly three digits is taken as a thousands separator, i.e, "5,000", otherwise as
+//	the decimal separator, i.e, "0.125".
+func NormalizeAmount(amount string) (string, error) {
+	amount = strings.ReplaceAll(strings.TrimSpace(amount), " ", "")
+	if IsStringEmpty(amount) {
+		return "", fmt.Errorf("empty amount")
+	}
+
+	decimal := byte(0)
+	lastDot, lastComma := strings.LastIndex(amount, "."), strings.LastIndex(amount, ",")
+	switch {
+	case lastDot >= 0 && lastComma >= 0:
+		decimal = '.'
+		if lastComma > lastDot {
+			decimal = ','
+		}
+	case lastDot >= 0 || lastComma >= 0:
+		separator, last := byte('.'), lastDot
+		if lastComma >= 0 {
+			separator, last = ',', lastComma
+		}
+		integer := amount[:last]
+		grouped := len(amount)-last-1 == 3 && len(integer) >= 1 && len(integer) <= 3 && integer[0] != '0'
+		if strings.Count(amount, string(separator)) == 1 && !grouped {
+			decimal = separator
+		}
+	}
+
+	var normalized strings.Builder
+	for i := 0; i < len(amount); i++ {
+		c := amount[i]
+		switch {
+		case c >= '0' && c <= '9':
+			normalized.WriteByte(c)
+		case c == decimal:
+			normalized.WriteByte('.')
+		case c == '.' || c == ',':
+			// Thousands separator
+		default:
+			return "", fmt.Errorf("invalid character '%c' in amount '%s'", c, amount)
+		}
+	}
+	result := normalized.String()
+	if strings.HasPrefix(result, ".") {
+		result = "0" + result
+	}
+	if _, ok := new(big.Rat).SetString(result); !ok || strings.HasSuffix(result, ".") {
+		return "", fmt.Errorf("invalid amount '%s'", amount)
+	}
+	return result, nil
+}
+
+// CompareAmounts Compares two normalized amounts. Returns -1, 0 or 1 like big.Rat.Cmp
+func CompareAmounts(a string, b string) (int, error) {
+	x, ok := new(big.Rat).SetString(a)
+	if !ok {
+		return 0, fmt.Errorf("invalid amount '%s'", a)
+	}
+	y, ok := new(big.Rat).SetString(b)
+	if !ok {
+		return 0, fmt.Errorf("invalid amount '%s'", b)
+	}
+	return x.Cmp(y), nil
+}
+
+// AddAmounts Returns the sum of two normalized amounts, with as many decimals as the more precise of them
+func AddAmounts(a string, b string) (string, error) {
+	x, ok := new(big.Rat).SetString(a)
+	if !ok {
+		return "", fmt.Errorf("invalid amount '%s'", a)
+	}
+	y, ok := new(big.Rat).SetString(b)
+	if !ok {
+		return "", fmt.Errorf("invalid amount '%s'", b)
+	}
+	decimals := 0
+	for _, amount := range []string{a, b} {
+		if i := strings.Index(amount, "."); i >= 0 && len(amount)-i-1 > decimals {
+			decimals = len(amount) - i - 1
+		}
+	}
+	return new(big.Rat).Add(x, y).FloatString(decimals), nil
+}
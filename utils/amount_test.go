@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestNormalizeAmount(t *testing.T) {
+	amounts := map[string]string{
+		"20,000.00":    "20000.00",
+		"1.098.724,75": "1098724.75",
+		"5 000,5":      "5000.5",
+		"5,000":        "5000",
+		"12.50":        "12.50",
+		".75":          "0.75",
+		"0.125":        "0.125",
+		".125":         "0.125",
+		"1234,567":     "1234.567",
+		"12,345":       "12345",
+	}
+	for amount, expected := range amounts {
+		if normalized, err := NormalizeAmount(amount); err != nil || normalized != expected {
+			t.Errorf("NormalizeAmount(%s) = %s, %v. Expected %s", amount, normalized, err, expected)
+		}
+	}
+	for _, amount := range []string{"", "1.2.3,4,5", "abc", "12."} {
+		if normalized, err := NormalizeAmount(amount); err == nil {
+			t.Errorf("NormalizeAmount(%s) = %s, expected an error", amount, normalized)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// RequestToken Returns the token sent in the given header, as a bearer token or in the token query parameter,
+// in that order. Empty if the request carries no token
+func RequestToken(r *http.Request, header string) string {
+	if token := r.Header.Get(header); !IsStringEmpty(token) {
+		return token
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return auth[7:]
+	}
+	return r.URL.Query().Get("token")
+}
+
+// TokenMatches Compares a token sent by a client in constant time. An empty token never matches
+func TokenMatches(token string, expected string) bool {
+	return !IsStringEmpty(token) && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
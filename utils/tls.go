@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion Converts a version such as "1.2" to its crypto/tls constant. Empty = 0 (library default)
+func ParseTLSVersion(version string) (uint16, error) {
+	if IsStringEmpty(version) {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(version), "tls")]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version '%s'", version)
+}
+
+// TLSVersionName Returns the name of a negotiated TLS version, i.e, "TLS 1.3". Empty if version is 0
+func TLSVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return "TLS " + name
+		}
+	}
+	if version == 0 {
+		return ""
+	}
+	return fmt.Sprintf("0x%04x", version)
+}